@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nyarly/dns-manager/server"
+	"github.com/spf13/cobra"
+)
+
+var (
+	acmeCmd = &cobra.Command{
+		Use:   "acme",
+		Short: "ACME DNS-01 challenge commands",
+	}
+
+	acmePresentCmd = &cobra.Command{
+		Use:   "present <domain> <value>",
+		Short: "add a DNS-01 challenge answer to the domain's _acme-challenge TXT record",
+		RunE:  acmeFn("/acme/present", "Presented"),
+		Args:  cobra.ExactArgs(2),
+	}
+
+	acmeCleanupCmd = &cobra.Command{
+		Use:   "cleanup <domain> <value>",
+		Short: "remove a DNS-01 challenge answer from the domain's _acme-challenge TXT record",
+		RunE:  acmeFn("/acme/cleanup", "Cleaned up"),
+		Args:  cobra.ExactArgs(2),
+	}
+)
+
+func acmeFn(path, done string) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		client, err := newAPIClient(cmd)
+		if err != nil {
+			return err
+		}
+
+		// the domain being validated, or its challenge name
+		fqdn := strings.TrimPrefix(strings.TrimSuffix(args[0], "."), "*.")
+		if !strings.HasPrefix(fqdn, "_acme-challenge.") {
+			fqdn = "_acme-challenge." + fqdn
+		}
+
+		challenge := &server.ACMEChallenge{}
+		if err := client.doRequest("POST", path, nil, server.ACMEChallenge{FQDN: fqdn, Value: args[1]}, challenge); err != nil {
+			return err
+		}
+
+		fmt.Println(done, challenge.FQDN)
+		return nil
+	}
+}
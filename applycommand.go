@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/nyarly/dns-manager/plan"
+	"github.com/spf13/cobra"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "make NS1 match a desired-state file",
+	Long: "Computes the same plan as `dns-manager plan`, prints it, and then carries it out,\n" +
+		"  stopping at the first change that fails. With --plan, carries out a plan saved by\n" +
+		"  `dns-manager plan --out` instead, if it's still what the plan would be.",
+	RunE: applyFn,
+	Args: cobra.NoArgs,
+}
+
+func applyFn(cmd *cobra.Command, args []string) error {
+	client, changes, err := computePlan(cmd)
+	if err != nil {
+		return err
+	}
+
+	saved, err := cmd.Flags().GetString("plan")
+	if err != nil {
+		return err
+	}
+	if saved != "" {
+		reviewed, err := readPlan(saved)
+		if err != nil {
+			return err
+		}
+		if !samePlan(reviewed, changes) {
+			printPlan(os.Stdout, changes)
+			return fmt.Errorf("the plan in %s is out of date - NS1 or the desired state has changed since it was made, and the plan is now as above", saved)
+		}
+		changes = reviewed
+	}
+
+	printPlan(os.Stdout, changes)
+	if len(changes) == 0 {
+		return nil
+	}
+	fmt.Println()
+
+	for _, c := range changes {
+		if err := applyChange(client, c); err != nil {
+			return fmt.Errorf("%s %s %s %s: %w", c.Action, c.Zone, c.Domain, c.Type, err)
+		}
+	}
+
+	fmt.Println("Applied.")
+	return nil
+}
+
+func applyChange(client *apiClient, c plan.Change) error {
+	if c.Domain == "" {
+		fmt.Printf("Creating zone %s\n", c.Zone)
+		return client.doRequest("PUT", "/zone", map[string]string{"name": c.Zone}, nil, &dns.Zone{})
+	}
+
+	query := map[string]string{
+		"zone":   c.Zone,
+		"domain": c.Domain,
+		"type":   c.Type,
+	}
+
+	if c.Action == plan.Delete {
+		fmt.Printf("Deleting %s %s\n", c.Domain, c.Type)
+		return client.doRequest("DELETE", "/record", query, nil, nil)
+	}
+
+	if c.TTL != 0 {
+		query["ttl"] = strconv.Itoa(c.TTL)
+	}
+	answers := [][]string{}
+	for _, a := range c.Answers {
+		answers = append(answers, a)
+	}
+
+	fmt.Printf("Putting %s %s\n", c.Domain, c.Type)
+	return client.doRequest("PUT", "/record", query, answers, &dns.Record{})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/nyarly/dns-manager/plan"
+	"github.com/spf13/cobra"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+func TestSamePlan(t *testing.T) {
+	computed := []plan.Change{{Action: plan.Create, Zone: "example.com", Domain: "www.example.com", Type: "A", Answers: []plan.Answer{{"1.2.3.4"}}, Before: []plan.Answer{}}}
+	saved := []plan.Change{{Action: plan.Create, Zone: "example.com", Domain: "www.example.com", Type: "A", Answers: []plan.Answer{{"1.2.3.4"}}}}
+	if !samePlan(computed, saved) {
+		t.Errorf("Expected a plan to match its saved copy")
+	}
+	saved[0].Answers = []plan.Answer{{"5.6.7.8"}}
+	if samePlan(computed, saved) {
+		t.Errorf("Expected plans with different answers to differ")
+	}
+	if samePlan(computed, nil) {
+		t.Errorf("Expected a plan to differ from no changes")
+	}
+}
+
+func TestApplySavedPlan(t *testing.T) {
+	client, fake, cleanup := serverHarness(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "plan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	desired := filepath.Join(dir, "zones.yaml")
+	desiredYAML := "zones:\n- zone: jdl-example.com\n  records:\n  - domain: www\n    type: A\n    answers: [1.2.3.4]\n"
+	if err := ioutil.WriteFile(desired, []byte(desiredYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+	saved := filepath.Join(dir, "plan.json")
+
+	command := func(args ...string) *cobra.Command {
+		cmd := &cobra.Command{}
+		clientFlags(cmd)
+		cmd.Flags().StringP("file", "f", "", "")
+		cmd.Flags().StringP("out", "o", "", "")
+		cmd.Flags().String("plan", "", "")
+		if err := cmd.ParseFlags(append([]string{"--address", client.base.Host, "--file", desired}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return cmd
+	}
+
+	if err := planFn(command("--out", saved), nil); err != nil {
+		t.Fatalf("Planning: %v", err)
+	}
+	changes, err := readPlan(saved)
+	if err != nil {
+		t.Fatalf("Reading the saved plan: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Action != plan.Create || changes[0].Domain != "www.jdl-example.com" {
+		t.Fatalf("Expected a plan to create www, got %#v", changes)
+	}
+
+	// someone else gets there first
+	record := dns.NewRecord("jdl-example.com", "www.jdl-example.com", "A")
+	record.AddAnswer(dns.NewAnswer([]string{"5.6.7.8"}))
+	fake.AddRecord(record)
+	before := writes(fake)
+	if err := applyFn(command("--plan", saved), nil); err == nil {
+		t.Errorf("Expected an out of date plan to be refused")
+	}
+	if after := writes(fake); len(after) != len(before) {
+		t.Errorf("Expected nothing to be written to NS1 for an out of date plan, got %v", after[len(before):])
+	}
+
+	if err := planFn(command("--out", saved), nil); err != nil {
+		t.Fatalf("Planning again: %v", err)
+	}
+	if err := applyFn(command("--plan", saved), nil); err != nil {
+		t.Fatalf("Applying the new plan: %v", err)
+	}
+	if a := answers(t, client, "www.jdl-example.com", "A"); !reflect.DeepEqual(a, []string{"1.2.3.4"}) {
+		t.Errorf("Expected the plan to have been carried out, got %v", a)
+	}
+
+	// with the zone cached, the server would fall back to it for listings
+	if err := client.doRequest("GET", "/zone", map[string]string{"name": "jdl-example.com"}, nil, &dns.Zone{}); err != nil {
+		t.Fatal(err)
+	}
+	fake.Close()
+	if err := planFn(command(), nil); err == nil {
+		t.Errorf("Expected no plan to be made while NS1 can't be reached")
+	}
+}
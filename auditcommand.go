@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nyarly/dns-manager/server"
+	"github.com/nyarly/inlinefiles/templatestore"
+	"github.com/spf13/cobra"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "show changes made through the server, and who made them",
+	RunE:  auditFn,
+	Args:  cobra.NoArgs,
+}
+
+// auditLine is an AuditEntry as the audit template shows it
+type auditLine struct {
+	server.AuditEntry
+	Target string
+	Was    string
+	Now    string
+}
+
+func auditFn(cmd *cobra.Command, args []string) error {
+	tmpl, err := templatestore.LoadText(Templates, "audit", "audit.tmpl")
+	if err != nil {
+		panic(err)
+	}
+
+	client, err := newAPIClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	query := map[string]string{}
+	for _, name := range []string{"zone", "principal"} {
+		value, err := cmd.Flags().GetString(name)
+		if err != nil {
+			return err
+		}
+		if value != "" {
+			query[name] = value
+		}
+	}
+
+	since, err := cmd.Flags().GetString("since")
+	if err != nil {
+		return err
+	}
+	if since != "" {
+		t, err := parseSince(since)
+		if err != nil {
+			return err
+		}
+		query["since"] = t.Format(time.RFC3339)
+	}
+
+	entries := []server.AuditEntry{}
+	if err := client.doRequest("GET", "/audit", query, nil, &entries); err != nil {
+		return err
+	}
+
+	lines := []auditLine{}
+	for _, e := range entries {
+		line := auditLine{AuditEntry: e, Target: e.Zone}
+		if e.Domain != "" {
+			line.Target = fmt.Sprintf("%s %s", e.Domain, e.Type)
+		}
+		line.Was, line.Now = auditState(e.Before), auditState(e.After)
+		if e.PriorUnknown {
+			line.Was = "unknown (not cached)"
+		}
+		lines = append(lines, line)
+	}
+
+	return tmpl.Execute(os.Stdout, lines)
+}
+
+// parseSince accepts either a time, or a duration to count back from now
+func parseSince(since string) (time.Time, error) {
+	if d, err := time.ParseDuration(since); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return t, fmt.Errorf("--since should be a duration like 24h, or a time like 2006-01-02T15:04:05Z")
+	}
+	return t, nil
+}
+
+// auditState summarizes the zone or record on one side of an audited change
+func auditState(raw json.RawMessage) string {
+	if raw == nil {
+		return ""
+	}
+	record := dns.Record{}
+	if err := json.Unmarshal(raw, &record); err != nil {
+		return string(raw)
+	}
+	if record.Type == "" {
+		return "zone exists"
+	}
+	answers := []string{}
+	for _, a := range record.Answers {
+		answers = append(answers, fmt.Sprintf("%q", strings.Join(a.Rdata, " ")))
+	}
+	return fmt.Sprintf("ttl %d: %s", record.TTL, strings.Join(answers, ", "))
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nyarly/dns-manager/server"
+	"github.com/nyarly/dns-manager/validate"
+	"github.com/spf13/cobra"
+)
+
+// apiClient talks to a dns-manager server on behalf of a command
+type apiClient struct {
+	base  *url.URL
+	token string
+	http  *http.Client
+}
+
+// clientFlags adds the flags every command that talks to the server needs
+func clientFlags(cmds ...*cobra.Command) {
+	for _, cmd := range cmds {
+		cmd.Flags().StringP("address", "S", "localhost:4444", "the address to talk to the server on")
+		cmd.Flags().String("token", "", "the API token to present to the server (default $DNS_MANAGER_TOKEN)")
+		cmd.Flags().String("ca-cert", "", "a PEM file of CA certificates to trust the server's certificate by, instead of the system's")
+		cmd.Flags().String("client-cert", "", "a PEM certificate to present to a server that requires one")
+		cmd.Flags().String("client-key", "", "the PEM private key for --client-cert")
+	}
+}
+
+// newAPIClient configures an apiClient from the flags added by clientFlags
+func newAPIClient(cmd *cobra.Command) (*apiClient, error) {
+	addr, err := cmd.Flags().GetString("address")
+	if err != nil {
+		return nil, err
+	}
+	token, err := cmd.Flags().GetString("token")
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		token = os.Getenv("DNS_MANAGER_TOKEN")
+	}
+
+	tlsConfig, err := clientTLS(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	base, err := serverURL(addr, tlsConfig != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.DefaultClient
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client = &http.Client{Transport: transport}
+	}
+
+	return &apiClient{
+		base:  base,
+		token: token,
+		http:  client,
+	}, nil
+}
+
+// clientTLS builds a TLS configuration from the --ca-cert, --client-cert and
+// --client-key flags, or returns nil if none were given
+func clientTLS(cmd *cobra.Command) (*tls.Config, error) {
+	caCert, err := cmd.Flags().GetString("ca-cert")
+	if err != nil {
+		return nil, err
+	}
+	clientCert, err := cmd.Flags().GetString("client-cert")
+	if err != nil {
+		return nil, err
+	}
+	clientKey, err := cmd.Flags().GetString("client-key")
+	if err != nil {
+		return nil, err
+	}
+
+	if caCert == "" && clientCert == "" && clientKey == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if caCert != "" {
+		config.RootCAs, err = server.LoadCertPool(caCert)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if clientCert != "" || clientKey != "" {
+		if clientCert == "" || clientKey == "" {
+			return nil, errors.New("--client-cert and --client-key must be given together")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// serverURL turns an --address into a URL. Addresses without a scheme use
+// https if the client has been configured for TLS, and http otherwise.
+func serverURL(addr string, secure bool) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		scheme := "http"
+		if secure {
+			scheme = "https"
+		}
+		addr = scheme + "://" + addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("can't talk to a server at %s: only http and https are supported", addr)
+	}
+	return u, nil
+}
+
+func (c *apiClient) doRequest(method, path string, query map[string]string, dtoIn, dtoOut interface{}) error {
+	u := *c.base
+	u.Path = path
+	vs := url.Values{}
+	for k, v := range query {
+		vs.Set(k, v)
+	}
+	u.RawQuery = vs.Encode()
+
+	var req *http.Request
+	var err error
+
+	if r, raw := dtoIn.(io.Reader); raw {
+		req, err = http.NewRequest(method, u.String(), r)
+		if err != nil {
+			return err
+		}
+	} else if dtoIn != nil {
+		body := &bytes.Buffer{}
+		if err := json.NewEncoder(body).Encode(dtoIn); err != nil {
+			return err
+		}
+		req, err = http.NewRequest(method, u.String(), body)
+		if err != nil {
+			return err
+		}
+	} else {
+		req, err = http.NewRequest(method, u.String(), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	rz, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rz.Body.Close()
+
+	if rz.StatusCode != 200 {
+		return responseError(rz)
+	}
+
+	if dtoOut == nil {
+		return nil
+	}
+
+	if w, raw := dtoOut.(io.Writer); raw {
+		_, err := io.Copy(w, rz.Body)
+		return err
+	}
+
+	return json.NewDecoder(rz.Body).Decode(dtoOut)
+}
+
+// responseError decodes the server.ErrorResponse in an error response, or
+// makes one up for a response that doesn't have one (e.g. from a proxy)
+func responseError(rz *http.Response) error {
+	body, err := ioutil.ReadAll(rz.Body)
+	if err != nil {
+		return err
+	}
+
+	e := &server.ErrorResponse{}
+	if err := json.Unmarshal(body, e); err != nil || e.Code == "" {
+		message := strings.TrimSpace(string(body))
+		if message == "" {
+			message = rz.Status
+		}
+		return &server.ErrorResponse{
+			Code:      statusCode(rz.StatusCode),
+			Message:   message,
+			RequestID: rz.Header.Get("X-Request-Id"),
+		}
+	}
+
+	if e.Code == server.CodeInvalidAnswers {
+		invalid := struct{ Details validate.Errors }{}
+		if err := json.Unmarshal(body, &invalid); err == nil && len(invalid.Details) > 0 {
+			e.Message += ": " + invalid.Details.Error()
+			e.Details = invalid.Details
+		}
+	}
+	return e
+}
+
+// statusCode guesses the error code for a response status
+func statusCode(status int) string {
+	switch {
+	case status == 401:
+		return server.CodeUnauthenticated
+	case status == 403:
+		return server.CodeForbidden
+	case status == 404:
+		return server.CodeNotFound
+	case status == 429:
+		return server.CodeRateLimited
+	case status < 500:
+		return server.CodeBadRequest
+	default:
+		return server.CodeInternal
+	}
+}
+
+// Exit statuses of commands that talk to the server, so that scripts can tell
+// failures apart
+const (
+	exitFailed       = 1 // anything not below, including usage errors
+	exitBadRequest   = 2
+	exitNotFound     = 3
+	exitDenied       = 4
+	exitRateLimited  = 5
+	exitNS1Down      = 6
+	exitUnreachable  = 7
+	exitServerFailed = 8
+)
+
+var exitStatuses = map[string]int{
+	server.CodeBadRequest:       exitBadRequest,
+	server.CodeInvalidAnswers:   exitBadRequest,
+	server.CodeMethodNotAllowed: exitBadRequest,
+	server.CodeConflict:         exitBadRequest,
+	server.CodeNS1Rejected:      exitBadRequest,
+	server.CodeNotFound:         exitNotFound,
+	server.CodeUnauthenticated:  exitDenied,
+	server.CodeForbidden:        exitDenied,
+	server.CodeRateLimited:      exitRateLimited,
+	server.CodeNS1Unavailable:   exitNS1Down,
+	server.CodeStorage:          exitServerFailed,
+	server.CodeInternal:         exitServerFailed,
+}
+
+// exitStatus is the status a command that failed with err should exit with
+func exitStatus(err error) int {
+	e := &server.ErrorResponse{}
+	if errors.As(err, &e) {
+		if status, known := exitStatuses[e.Code]; known {
+			return status
+		}
+		return exitFailed
+	}
+	unreachable := &url.Error{}
+	if errors.As(err, &unreachable) {
+		return exitUnreachable
+	}
+	return exitFailed
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nyarly/dns-manager/server"
+	"github.com/spf13/cobra"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+var ddnsCmd = &cobra.Command{
+	Use:   "ddns <name>",
+	Short: "keep a record pointed at this host's address",
+	Long: "Finds this host's IPv4 and IPv6 addresses, from --interface, --from-file or --from-command,\n" +
+		"  and updates the name's A and AAAA records if they've changed. With --interval, carries on\n" +
+		"  checking until interrupted.",
+	RunE: ddnsFn,
+	Args: cobra.ExactArgs(1),
+}
+
+func ddnsFn(cmd *cobra.Command, args []string) error {
+	client, err := newAPIClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	source, err := addressSource(cmd)
+	if err != nil {
+		return err
+	}
+
+	name := args[0]
+	zone, err := recordZone(cmd, name)
+	if err != nil {
+		return err
+	}
+	kind, err := cmd.Flags().GetString("type")
+	if err != nil {
+		return err
+	}
+	kind = strings.ToUpper(kind)
+	if kind != "" && kind != "A" && kind != "AAAA" {
+		return fmt.Errorf("--type must be A or AAAA, not %q", kind)
+	}
+	ttl, err := cmd.Flags().GetInt("ttl")
+	if err != nil {
+		return err
+	}
+	interval, err := cmd.Flags().GetDuration("interval")
+	if err != nil {
+		return err
+	}
+
+	sync := func() error {
+		addrs, err := source()
+		if err != nil {
+			return err
+		}
+		return ddnsSync(client, zone, name, kind, ttl, addrs, interval == 0)
+	}
+	if interval == 0 {
+		return sync()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// a server or address that's briefly unavailable shouldn't stop us
+		if err := sync(); err != nil {
+			log.Printf("problem updating %s: %v", name, err)
+		}
+		select {
+		case <-sigs:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// ddnsSync points name's A and AAAA records at the first address of each
+// family, or just the kind of record asked for. Records that were already
+// right are only mentioned if verbose.
+func ddnsSync(client *apiClient, zone, name, kind string, ttl int, addrs []net.IP, verbose bool) error {
+	wanted := map[string]net.IP{}
+	for _, ip := range addrs {
+		family := "AAAA"
+		if ip.To4() != nil {
+			family = "A"
+		}
+		if wanted[family] == nil && (kind == "" || kind == family) {
+			wanted[family] = ip
+		}
+	}
+	if len(wanted) == 0 {
+		if kind == "" {
+			return errors.New("found no addresses for this host")
+		}
+		return fmt.Errorf("found no addresses for this host to put in an %s record", kind)
+	}
+
+	for _, family := range []string{"A", "AAAA"} {
+		ip := wanted[family]
+		if ip == nil {
+			continue
+		}
+		changed, err := ddnsRecord(client, zone, name, family, ttl, ip)
+		if err != nil {
+			return err
+		}
+		if changed {
+			fmt.Printf("Updated %s %s to %s\n", name, family, ip)
+		} else if verbose {
+			fmt.Printf("%s %s is already %s\n", name, family, ip)
+		}
+	}
+	return nil
+}
+
+// ddnsRecord updates a record to have ip as its only answer, unless it
+// already does, returning whether it changed
+func ddnsRecord(client *apiClient, zone, name, kind string, ttl int, ip net.IP) (bool, error) {
+	query := map[string]string{
+		"zone":   zone,
+		"domain": name,
+		"type":   kind,
+	}
+
+	existing := &dns.Record{}
+	err := client.doRequest("GET", "/record", query, nil, existing)
+	missing := &server.ErrorResponse{}
+	if errors.As(err, &missing) && missing.Code == server.CodeNotFound {
+		existing, err = nil, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if existing != nil && len(existing.Answers) == 1 && len(existing.Answers[0].Rdata) == 1 &&
+		ip.Equal(net.ParseIP(existing.Answers[0].Rdata[0])) && (ttl == 0 || existing.TTL == ttl) {
+		return false, nil
+	}
+
+	if ttl != 0 {
+		query["ttl"] = strconv.Itoa(ttl)
+	}
+	if err := client.doRequest("PUT", "/record", query, [][]string{{ip.String()}}, &dns.Record{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// addressSource checks that exactly one of --interface, --from-file or
+// --from-command was given, and returns a function that finds this host's
+// addresses from it
+func addressSource(cmd *cobra.Command) (func() ([]net.IP, error), error) {
+	iface, err := cmd.Flags().GetString("interface")
+	if err != nil {
+		return nil, err
+	}
+	file, err := cmd.Flags().GetString("from-file")
+	if err != nil {
+		return nil, err
+	}
+	command, err := cmd.Flags().GetString("from-command")
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case iface != "" && file == "" && command == "":
+		return func() ([]net.IP, error) { return interfaceAddresses(iface) }, nil
+	case file != "" && iface == "" && command == "":
+		return func() ([]net.IP, error) {
+			text, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			return parseAddresses(string(text)), nil
+		}, nil
+	case command != "" && iface == "" && file == "":
+		return func() ([]net.IP, error) {
+			out, err := exec.Command("sh", "-c", command).Output()
+			if err != nil {
+				return nil, fmt.Errorf("running %q: %v", command, err)
+			}
+			return parseAddresses(string(out)), nil
+		}, nil
+	default:
+		return nil, errors.New("exactly one of --interface, --from-file or --from-command is needed")
+	}
+}
+
+// interfaceAddresses returns the global unicast addresses of a network interface
+func interfaceAddresses(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.IsGlobalUnicast() {
+			ips = append(ips, network.IP)
+		}
+	}
+	return ips, nil
+}
+
+// parseAddresses picks the IP addresses (or CIDR blocks' addresses) out of
+// text, e.g. the output of `curl -s https://ifconfig.me` or `ip -brief addr`
+func parseAddresses(text string) []net.IP {
+	ips := []net.IP{}
+	for _, field := range strings.Fields(text) {
+		ip := net.ParseIP(field)
+		if ip == nil {
+			ip, _, _ = net.ParseCIDR(field)
+		}
+		if ip != nil && ip.IsGlobalUnicast() {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
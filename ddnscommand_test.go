@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyarly/dns-manager/ns1fake"
+	"github.com/nyarly/dns-manager/server"
+	"github.com/nyarly/dns-manager/storage"
+	"github.com/spf13/cobra"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+func TestParseAddresses(t *testing.T) {
+	cases := []struct {
+		text     string
+		expected []string
+	}{
+		{"203.0.113.7\n", []string{"203.0.113.7"}},
+		{"2001:db8::7", []string{"2001:db8::7"}},
+		// `ip -brief addr`
+		{"eth0 UP 203.0.113.7/24 2001:db8::7/64 fe80::1/64\n", []string{"203.0.113.7", "2001:db8::7"}},
+		{"lo UNKNOWN 127.0.0.1/8 ::1/128\n", []string{}},
+		{"0.0.0.0 :: 224.0.0.1 ff02::1 169.254.1.1", []string{}},
+		{"not an address 203.0.113.300 2001:db8::7/200", []string{}},
+		{"", []string{}},
+	}
+	for _, c := range cases {
+		found := []string{}
+		for _, ip := range parseAddresses(c.text) {
+			found = append(found, ip.String())
+		}
+		if !reflect.DeepEqual(found, c.expected) {
+			t.Errorf("Expected %v from %q, got %v", c.expected, c.text, found)
+		}
+	}
+}
+
+func TestAddressSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ddns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "addrs")
+	if err := ioutil.WriteFile(file, []byte("203.0.113.7\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"--from-file", file}, true},
+		{[]string{"--from-command", "echo 203.0.113.7"}, true},
+		{[]string{}, false},
+		{[]string{"--interface", ""}, false},
+		{[]string{"--interface", "eth0", "--from-file", file}, false},
+	}
+	for _, c := range cases {
+		cmd := &cobra.Command{}
+		cmd.Flags().StringP("interface", "i", "", "")
+		cmd.Flags().String("from-file", "", "")
+		cmd.Flags().String("from-command", "", "")
+		if err := cmd.ParseFlags(c.args); err != nil {
+			t.Fatal(err)
+		}
+		source, err := addressSource(cmd)
+		if (err == nil) != c.ok {
+			t.Errorf("Expected %v to be accepted %v, got %v", c.args, c.ok, err)
+		}
+		if err != nil {
+			continue
+		}
+		addrs, err := source()
+		if err != nil || len(addrs) != 1 || addrs[0].String() != "203.0.113.7" {
+			t.Errorf("Expected the address from %v, got %v, %v", c.args, addrs, err)
+		}
+	}
+}
+
+// serverHarness starts a dns-manager server, backed by a fake NS1 with one
+// zone, and returns a client for it
+func serverHarness(t *testing.T) (*apiClient, *ns1fake.Fake, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "ddns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := ns1fake.Start()
+	fake.AddZone("jdl-example.com")
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.New(addr, store, "fake", fake.ClientFn).Start(ctx) }()
+	cleanup := func() {
+		stop()
+		<-done
+		fake.Close()
+		store.Close()
+		os.RemoveAll(dir)
+	}
+
+	base := &url.URL{Scheme: "http", Host: addr}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		rz, err := http.Get(base.String())
+		if err == nil {
+			rz.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			cleanup()
+			t.Fatalf("Server didn't start: %v", err)
+		}
+	}
+	return &apiClient{base: base, http: http.DefaultClient}, fake, cleanup
+}
+
+// answers returns the addresses a record points at, or nil if there's no such record
+func answers(t *testing.T, client *apiClient, name, kind string) []string {
+	t.Helper()
+	record := &dns.Record{}
+	query := map[string]string{"zone": "jdl-example.com", "domain": name, "type": kind}
+	err := client.doRequest("GET", "/record", query, nil, record)
+	missing := &server.ErrorResponse{}
+	if errors.As(err, &missing) && missing.Code == server.CodeNotFound {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Getting %s %s: %v", name, kind, err)
+	}
+	found := []string{}
+	for _, a := range record.Answers {
+		found = append(found, a.Rdata...)
+	}
+	return found
+}
+
+// writes returns the requests that have changed anything at NS1
+func writes(fake *ns1fake.Fake) []string {
+	changes := []string{}
+	for _, r := range fake.Requests() {
+		if !strings.HasPrefix(r, "GET ") {
+			changes = append(changes, r)
+		}
+	}
+	return changes
+}
+
+func TestDDNSFamilies(t *testing.T) {
+	client, _, cleanup := serverHarness(t)
+	defer cleanup()
+
+	addrs := []net.IP{net.ParseIP("2001:db8::7"), net.ParseIP("203.0.113.7"), net.ParseIP("203.0.113.8"), net.ParseIP("2001:db8::8")}
+	cases := []struct {
+		name, kind string
+		a, aaaa    []string
+	}{
+		{"both.jdl-example.com", "", []string{"203.0.113.7"}, []string{"2001:db8::7"}},
+		{"v4.jdl-example.com", "A", []string{"203.0.113.7"}, nil},
+		{"v6.jdl-example.com", "AAAA", nil, []string{"2001:db8::7"}},
+	}
+	for _, c := range cases {
+		if err := ddnsSync(client, "jdl-example.com", c.name, c.kind, 0, addrs, false); err != nil {
+			t.Fatalf("Updating %s: %v", c.name, err)
+		}
+		if a := answers(t, client, c.name, "A"); !reflect.DeepEqual(a, c.a) {
+			t.Errorf("Expected %s A to be %v, got %v", c.name, c.a, a)
+		}
+		if aaaa := answers(t, client, c.name, "AAAA"); !reflect.DeepEqual(aaaa, c.aaaa) {
+			t.Errorf("Expected %s AAAA to be %v, got %v", c.name, c.aaaa, aaaa)
+		}
+	}
+
+	v4 := []net.IP{net.ParseIP("203.0.113.7")}
+	if err := ddnsSync(client, "jdl-example.com", "none.jdl-example.com", "AAAA", 0, v4, false); err == nil {
+		t.Errorf("Expected an error asking for an AAAA record without an IPv6 address")
+	}
+	if err := ddnsSync(client, "jdl-example.com", "none.jdl-example.com", "", 0, nil, false); err == nil {
+		t.Errorf("Expected an error without any addresses")
+	}
+}
+
+func TestDDNSUnchanged(t *testing.T) {
+	client, fake, cleanup := serverHarness(t)
+	defer cleanup()
+
+	name := "home.jdl-example.com"
+	ip := net.ParseIP("203.0.113.7")
+	changed, err := ddnsRecord(client, "jdl-example.com", name, "A", 300, ip)
+	if err != nil || !changed {
+		t.Fatalf("Expected the record to be created, got %v, %v", changed, err)
+	}
+	before := writes(fake)
+	if len(before) == 0 {
+		t.Fatalf("Expected the record to be written to NS1, got %v", fake.Requests())
+	}
+
+	for _, ttl := range []int{300, 0} {
+		changed, err = ddnsRecord(client, "jdl-example.com", name, "A", ttl, ip)
+		if err != nil || changed {
+			t.Errorf("Expected a record that's already right to be left alone with TTL %d, got %v, %v", ttl, changed, err)
+		}
+	}
+	if after := writes(fake); len(after) != len(before) {
+		t.Errorf("Expected nothing more to be written to NS1, got %v", after[len(before):])
+	}
+
+	for _, c := range []struct {
+		ttl int
+		ip  string
+	}{{600, "203.0.113.7"}, {0, "203.0.113.8"}} {
+		changed, err = ddnsRecord(client, "jdl-example.com", name, "A", c.ttl, net.ParseIP(c.ip))
+		if err != nil || !changed {
+			t.Errorf("Expected the record to be updated to %s with TTL %d, got %v, %v", c.ip, c.ttl, changed, err)
+		}
+	}
+	if a := answers(t, client, name, "A"); !reflect.DeepEqual(a, []string{"203.0.113.8"}) {
+		t.Errorf("Expected the record to point at the new address, got %v", a)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/nyarly/dns-manager/ns1fake"
+	"github.com/spf13/cobra"
+)
+
+var fakeNS1Cmd = &cobra.Command{
+	Use:   "fake-ns1",
+	Short: "run a local stand-in for the NS1 API",
+	Long: "Starts an HTTP server that imitates the parts of the NS1 API dns-manager uses, keeping its state in memory.\n" +
+		"  Point a server at it with `dns-manager server --ns1-endpoint http://<listen address>`",
+	RunE: fakeNS1Fn,
+	Args: cobra.NoArgs,
+}
+
+func fakeNS1Fn(cmd *cobra.Command, args []string) error {
+	listen, err := cmd.Flags().GetString("listen")
+	if err != nil {
+		return err
+	}
+	latency, err := cmd.Flags().GetDuration("latency")
+	if err != nil {
+		return err
+	}
+	zones, err := cmd.Flags().GetStringSlice("zone")
+	if err != nil {
+		return err
+	}
+
+	fake := ns1fake.New()
+	fake.SetLatency(latency)
+	for _, z := range zones {
+		fake.AddZone(z)
+	}
+
+	fmt.Printf("Fake NS1 API listening on http://%s\n", listen)
+	return http.ListenAndServe(listen, fake)
+}
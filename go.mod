@@ -4,9 +4,14 @@ go 1.13
 
 require (
 	github.com/dnaeon/go-vcr v1.0.1
+	github.com/miekg/dns v1.1.27
 	github.com/nyarly/inlinefiles v0.0.0-20190505234105-847932cdc7e5
 	github.com/nyarly/spies v0.0.0-20180720181000-70fe86ca2a7b
+	github.com/prometheus/client_golang v1.7.1
 	github.com/spf13/cobra v0.0.5
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	golang.org/x/tools v0.0.0-20200216192241-b320d3a0f5a2
 	gopkg.in/ns1/ns1-go.v2 v2.2.0
+	gopkg.in/yaml.v2 v2.2.5
 )
@@ -1,13 +1,8 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"net/url"
+	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -16,6 +11,10 @@ var (
 	rootCmd = &cobra.Command{
 		Use:   "dns-manager",
 		Short: "A management tool for NS1 records.",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			// once its arguments are accepted, a command's errors aren't usage errors
+			cmd.SilenceUsage = true
+		},
 	}
 
 	zoneCmd = &cobra.Command{
@@ -32,84 +31,85 @@ var (
 func main() {
 	setup()
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatal(err)
+		os.Exit(exitStatus(err))
 	}
 }
 
 //go:generate inlinefiles --package=main --vfs=Templates templates templates.go
 
 func setup() {
-	rootCmd.AddCommand(serverCmd, zoneCmd, recordCmd)
-	zoneCmd.AddCommand(zoneAddCmd, zoneDeleteCmd)
-	recordCmd.AddCommand(recordAddCmd, recordDeleteCmd)
+	rootCmd.AddCommand(serverCmd, zoneCmd, recordCmd, fakeNS1Cmd, planCmd, applyCmd, auditCmd, acmeCmd, ddnsCmd)
+	zoneCmd.AddCommand(zoneAddCmd, zoneDeleteCmd, zoneListCmd, zoneExportCmd, zoneImportCmd)
+	recordCmd.AddCommand(recordAddCmd, recordDeleteCmd, recordListCmd, recordHistoryCmd, recordRollbackCmd)
+	acmeCmd.AddCommand(acmePresentCmd, acmeCleanupCmd)
 
 	serverCmd.Flags().StringP("listen", "L", "localhost:4444", "the address to listen for client requests on")
 	serverCmd.Flags().StringP("store", "s", "manager.cache", "the path to use to store local records of DNS states")
-
-	zoneAddCmd.Flags().StringP("address", "S", "localhost:4444", "the address to talk to the server on")
-	zoneDeleteCmd.Flags().StringP("address", "S", "localhost:4444", "the address to talk to the server on")
-
-	recordAddCmd.Flags().StringP("address", "S", "localhost:4444", "the address to talk to the server on")
+	serverCmd.Flags().String("store-driver", "text", "how to store local records: 'text' for a JSON file, 'bolt' for an embedded database")
+	serverCmd.Flags().Duration("cache-ttl", 0, "how long cached zones and records are trusted before re-fetching from NS1, e.g. 5m (by default, they never expire)")
+	serverCmd.Flags().String("tokens", "", "a YAML file of API tokens clients must present (by default, anyone may use the server)")
+	serverCmd.Flags().String("policy", "", "a YAML file of rules restricting which changes each token may make (reloaded on SIGHUP)")
+	serverCmd.Flags().String("audit-log", "", "a file to append a JSON line to for every change made through the server")
+	serverCmd.Flags().String("tls-cert", "", "a PEM certificate to serve HTTPS with")
+	serverCmd.Flags().String("tls-key", "", "the PEM private key for --tls-cert")
+	serverCmd.Flags().String("tls-client-ca", "", "a PEM file of CA certificates; clients must present a certificate signed by one")
+	serverCmd.Flags().Duration("refresh-interval", 0, "how often to re-fetch everything cached from NS1, reporting changes made there directly (0 to never)")
+	serverCmd.Flags().String("dns-listen", "", "also answer DNS queries for cached zones on this address, over UDP and TCP (e.g. :5353)")
+	serverCmd.Flags().StringSlice("transfer-allow", nil, "let secondaries at these addresses or CIDR blocks transfer cached zones (AXFR and IXFR) from --dns-listen")
+	serverCmd.Flags().String("tsig-keys", "", "a YAML file of TSIG keys that DNS messages may be signed with; if given, zone transfers must be signed")
+	serverCmd.Flags().Bool("dns-update", false, "accept dynamic updates (RFC 2136) signed with --tsig-keys on --dns-listen, writing them through to NS1")
+	serverCmd.Flags().Duration("drain-timeout", 30*time.Second, "how long to wait for requests in flight to finish when stopping")
+	serverCmd.Flags().String("ns1-endpoint", "", "send NS1 API requests here instead, e.g. to a `dns-manager fake-ns1`")
+
+	fakeNS1Cmd.Flags().StringP("listen", "L", "localhost:4445", "the address to listen for NS1 API requests on")
+	fakeNS1Cmd.Flags().Duration("latency", 0, "how long to wait before answering each request")
+	fakeNS1Cmd.Flags().StringSlice("zone", nil, "a zone to create at startup (may be repeated)")
+
+	clientFlags(zoneAddCmd)
+	clientFlags(zoneDeleteCmd)
+	clientFlags(zoneListCmd)
+	clientFlags(zoneExportCmd)
+	zoneExportCmd.Flags().StringP("format", "f", "bind", "the format to export the zone in")
+	clientFlags(zoneImportCmd)
+
+	clientFlags(recordAddCmd)
 	recordAddCmd.Flags().StringP("zone", "z", "", "The zone to add the record under - by default we guess from the name")
 
-	recordDeleteCmd.Flags().StringP("address", "S", "localhost:4444", "the address to talk to the server on")
+	clientFlags(recordDeleteCmd)
 	recordDeleteCmd.Flags().StringP("zone", "z", "", "The zone to add the record under - by default we guess from the name")
-}
 
-func doRequest(method, addr, path string, query map[string]string, dtoIn, dtoOut interface{}) error {
-	u, err := url.Parse(addr)
-	if err != nil {
-		return err
-	}
-	if u.Scheme != "http" { // XXX https
-		u, err = url.Parse("http://" + addr)
-		if err != nil {
-			return err
-		}
-	}
+	clientFlags(recordListCmd)
 
-	u.Path = path
-	vs := url.Values{}
-	for k, v := range query {
-		vs.Set(k, v)
-	}
-	u.RawQuery = vs.Encode()
-
-	var req *http.Request
-
-	if dtoIn != nil {
-		body := &bytes.Buffer{}
-		if err := json.NewEncoder(body).Encode(dtoIn); err != nil {
-			return err
-		}
-		req, err = http.NewRequest(method, u.String(), body)
-		if err != nil {
-			return err
-		}
-	} else {
-		req, err = http.NewRequest(method, u.String(), nil)
-		if err != nil {
-			return err
-		}
-	}
+	clientFlags(recordHistoryCmd)
+	recordHistoryCmd.Flags().StringP("zone", "z", "", "The zone the record is under - by default we guess from the name")
 
-	rz, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
-	}
+	clientFlags(recordRollbackCmd)
+	recordRollbackCmd.Flags().StringP("zone", "z", "", "The zone the record is under - by default we guess from the name")
+	recordRollbackCmd.Flags().Int("to", 0, "the version to roll back to, as listed by 'record history'")
+	recordRollbackCmd.MarkFlagRequired("to")
 
-	if rz.StatusCode != 200 {
-		body, err := ioutil.ReadAll(rz.Body)
-		if err != nil {
-			return err
-		}
+	clientFlags(planCmd)
+	planCmd.Flags().StringP("file", "f", "zones.yaml", "the desired-state file describing zones and records")
+	planCmd.Flags().StringP("out", "o", "", "save the plan to this file, for 'apply --plan'")
 
-		return errors.New(string(body))
-	}
+	clientFlags(applyCmd)
+	applyCmd.Flags().StringP("file", "f", "zones.yaml", "the desired-state file describing zones and records")
+	applyCmd.Flags().String("plan", "", "a plan saved by 'plan --out' to carry out, which must still match the desired-state file")
 
-	if dtoOut == nil {
-		return nil
-	}
+	clientFlags(acmePresentCmd)
+	clientFlags(acmeCleanupCmd)
+
+	clientFlags(ddnsCmd)
+	ddnsCmd.Flags().StringP("zone", "z", "", "The zone the record is under - by default we guess from the name")
+	ddnsCmd.Flags().StringP("interface", "i", "", "use the addresses of this network interface, e.g. eth0")
+	ddnsCmd.Flags().String("from-file", "", "use the addresses written in this file")
+	ddnsCmd.Flags().String("from-command", "", "use the addresses this shell command prints, e.g. 'curl -s https://ifconfig.me'")
+	ddnsCmd.Flags().String("type", "", "only update this type of record, A or AAAA (by default, each the host has an address for)")
+	ddnsCmd.Flags().Int("ttl", 0, "the TTL to give the record, in seconds (by default, NS1's)")
+	ddnsCmd.Flags().Duration("interval", 0, "check again this often until interrupted (by default, check once)")
 
-	return json.NewDecoder(rz.Body).Decode(dtoOut)
+	clientFlags(auditCmd)
+	auditCmd.Flags().StringP("zone", "z", "", "only show changes to this zone")
+	auditCmd.Flags().String("principal", "", "only show changes made with this token")
+	auditCmd.Flags().String("since", "", "only show changes since this time, or this long ago (e.g. 24h)")
 }
@@ -0,0 +1,472 @@
+// Package ns1fake provides a stand-in for the parts of the NS1 REST API that
+// dns-manager uses, so that the server can be exercised without network
+// access or an NS1 account.
+package ns1fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+const (
+	rateLimit  = 900
+	ratePeriod = 300
+)
+
+// Fault describes a failure the Fake should produce instead of handling a request
+type Fault struct {
+	// Method restricts the fault to requests with this method; empty matches any
+	Method string
+	// Path restricts the fault to requests whose path starts with it,
+	// e.g. "/v1/zones/example.com"; empty matches any
+	Path string
+	// Status is the HTTP status to respond with, e.g. 404, 429 or 503
+	Status int
+	// Times is how many requests fail before the fault clears; 0 means forever
+	Times int
+}
+
+// Fake is an in-memory NS1 API. It implements http.Handler, serving the
+// /v1/zones family of endpoints.
+type Fake struct {
+	mu       sync.Mutex
+	zones    map[string]*dns.Zone
+	records  map[string]*dns.Record
+	faults   []*Fault
+	latency  time.Duration
+	requests []string
+	nextID   int
+	server   *httptest.Server
+}
+
+// New constructs an empty Fake
+func New() *Fake {
+	return &Fake{
+		zones:   map[string]*dns.Zone{},
+		records: map[string]*dns.Record{},
+	}
+}
+
+// Start constructs an empty Fake, serving on a local httptest.Server.
+// Close should be called when it is no longer needed.
+func Start() *Fake {
+	f := New()
+	f.server = httptest.NewServer(f)
+	return f
+}
+
+// URL returns the base URL of a Fake's httptest.Server
+func (f *Fake) URL() string {
+	return f.server.URL
+}
+
+// Close shuts down a started Fake's httptest.Server
+func (f *Fake) Close() {
+	f.server.Close()
+}
+
+// ClientFn is a suitable implementation for server.New's httpClientFn,
+// directing all requests to a started Fake.
+func (f *Fake) ClientFn(ctx context.Context) ns1.Doer {
+	return ClientFor(f.URL())(ctx)
+}
+
+// ClientFor returns an httpClientFn for server.New which sends requests meant
+// for NS1 to base instead - e.g. to a Fake running in another process.
+func ClientFor(base string) func(context.Context) ns1.Doer {
+	return func(ctx context.Context) ns1.Doer {
+		return redirectingClient{base: base, ctx: ctx}
+	}
+}
+
+type redirectingClient struct {
+	base string
+	ctx  context.Context
+}
+
+func (c redirectingClient) Do(rq *http.Request) (*http.Response, error) {
+	base, err := url.Parse(c.base)
+	if err != nil {
+		return nil, err
+	}
+	rq = rq.WithContext(c.ctx)
+	rq.URL.Scheme = base.Scheme
+	rq.URL.Host = base.Host
+	rq.Host = base.Host
+	return http.DefaultClient.Do(rq)
+}
+
+// Inject adds a Fault to the Fake. Faults are checked in the order they were added.
+func (f *Fake) Inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, &fault)
+}
+
+// SetLatency makes the Fake wait before answering every request
+func (f *Fake) SetLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = d
+}
+
+// Requests returns the "METHOD /path" of every request the Fake has received
+func (f *Fake) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+// AddZone creates a zone directly, as if it had been created through the API
+func (f *Fake) AddZone(name string) *dns.Zone {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.createZone(dns.NewZone(name))
+}
+
+// AddRecord creates a record directly, as if it had been created through the
+// API. Its zone is created if need be.
+func (f *Fake) AddRecord(record *dns.Record) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, has := f.zones[record.Zone]; !has {
+		f.createZone(dns.NewZone(record.Zone))
+	}
+	f.putRecord(record)
+}
+
+// RemoveRecord deletes a record directly, as if it had been deleted through the API
+func (f *Fake) RemoveRecord(zone, domain, kind string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, has := f.records[recordKey(zone, domain, kind)]; !has {
+		return
+	}
+	delete(f.records, recordKey(zone, domain, kind))
+	f.zones[zone].Serial++
+}
+
+func (f *Fake) id() string {
+	f.nextID++
+	return fmt.Sprintf("%024x", f.nextID)
+}
+
+func recordKey(zone, domain, kind string) string {
+	return strings.Join([]string{zone, domain, kind}, "/")
+}
+
+func (f *Fake) createZone(z *dns.Zone) *dns.Zone {
+	zone := *z
+	zone.ID = f.id()
+	zone.TTL = 3600
+	zone.NxTTL = 3600
+	zone.Retry = 7200
+	zone.Refresh = 43200
+	zone.Expiry = 1209600
+	zone.Serial = int(time.Now().Unix())
+	zone.Hostmaster = "hostmaster@nsone.net"
+	zone.NetworkIDs = []int{0}
+	zone.DNSServers = []string{
+		"dns1.p01.nsone.net", "dns2.p01.nsone.net", "dns3.p01.nsone.net", "dns4.p01.nsone.net",
+	}
+	f.zones[zone.Zone] = &zone
+
+	ns := dns.NewRecord(zone.Zone, zone.Zone, "NS")
+	for _, server := range zone.DNSServers {
+		ns.AddAnswer(dns.NewAnswer([]string{server}))
+	}
+	f.putRecord(ns)
+
+	return &zone
+}
+
+func (f *Fake) putRecord(r *dns.Record) {
+	record := *r
+	if record.ID == "" {
+		record.ID = f.id()
+	}
+	if record.TTL == 0 {
+		record.TTL = 3600
+	}
+	for _, a := range record.Answers {
+		if a.ID == "" {
+			a.ID = f.id()
+		}
+	}
+	f.records[recordKey(record.Zone, record.Domain, record.Type)] = &record
+	f.zones[record.Zone].Serial++
+}
+
+// withRecords returns a copy of zone with its record summaries filled in
+func (f *Fake) withRecords(zone *dns.Zone) *dns.Zone {
+	z := *zone
+	z.Records = []*dns.ZoneRecord{}
+	for _, r := range f.records {
+		if r.Zone != zone.Zone {
+			continue
+		}
+		short := []string{}
+		for _, a := range r.Answers {
+			short = append(short, a.String())
+		}
+		z.Records = append(z.Records, &dns.ZoneRecord{
+			Domain:   r.Domain,
+			ID:       r.ID,
+			Link:     r.Link,
+			ShortAns: short,
+			Tier:     json.Number("1"),
+			TTL:      r.TTL,
+			Type:     r.Type,
+		})
+	}
+	sort.Slice(z.Records, func(i, j int) bool {
+		if z.Records[i].Domain == z.Records[j].Domain {
+			return z.Records[i].Type < z.Records[j].Type
+		}
+		return z.Records[i].Domain < z.Records[j].Domain
+	})
+	return &z
+}
+
+// fault returns the status of the first matching Fault, or 0
+func (f *Fake) fault(req *http.Request) int {
+	for i, fault := range f.faults {
+		if fault.Method != "" && fault.Method != req.Method {
+			continue
+		}
+		if !strings.HasPrefix(req.URL.Path, fault.Path) {
+			continue
+		}
+		if fault.Times > 0 {
+			fault.Times--
+			if fault.Times == 0 {
+				f.faults = append(f.faults[:i], f.faults[i+1:]...)
+			}
+		}
+		return fault.Status
+	}
+	return 0
+}
+
+func (f *Fake) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path)
+	latency := f.latency
+	status := f.fault(req)
+	f.mu.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Ratelimit-Limit", strconv.Itoa(rateLimit))
+	rw.Header().Set("X-Ratelimit-Period", strconv.Itoa(ratePeriod))
+
+	if status != 0 {
+		remaining := rateLimit - 1
+		if status == http.StatusTooManyRequests {
+			remaining = 0
+		}
+		rw.Header().Set("X-Ratelimit-Remaining", strconv.Itoa(remaining))
+		writeError(rw, status, http.StatusText(status))
+		return
+	}
+	rw.Header().Set("X-Ratelimit-Remaining", strconv.Itoa(rateLimit-1))
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/v1/zones"), "/")
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, "/")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch len(parts) {
+	case 0:
+		if req.Method != "GET" {
+			writeError(rw, 405, "method not allowed")
+			return
+		}
+		f.listZones(rw)
+	case 1:
+		f.zone(rw, req, parts[0])
+	case 3:
+		f.record(rw, req, parts[0], parts[1], parts[2])
+	default:
+		writeError(rw, 404, "not found")
+	}
+}
+
+func (f *Fake) listZones(rw http.ResponseWriter) {
+	zones := []*dns.Zone{}
+	for _, z := range f.zones {
+		zones = append(zones, z)
+	}
+	sort.Slice(zones, func(i, j int) bool { return zones[i].Zone < zones[j].Zone })
+	writeJSON(rw, zones)
+}
+
+func (f *Fake) zone(rw http.ResponseWriter, req *http.Request, name string) {
+	existing, has := f.zones[name]
+
+	switch req.Method {
+	case "GET":
+		if !has {
+			writeError(rw, 404, "zone not found")
+			return
+		}
+		writeJSON(rw, f.withRecords(existing))
+	case "PUT":
+		if has {
+			writeError(rw, 400, "zone already exists")
+			return
+		}
+		zone := dns.Zone{}
+		if !readJSON(rw, req, &zone) {
+			return
+		}
+		zone.Zone = name
+		writeJSON(rw, f.withRecords(f.createZone(&zone)))
+	case "POST":
+		if !has {
+			writeError(rw, 404, "zone not found")
+			return
+		}
+		zone := dns.Zone{}
+		if !readJSON(rw, req, &zone) {
+			return
+		}
+		updateZone(existing, &zone)
+		writeJSON(rw, f.withRecords(existing))
+	case "DELETE":
+		if !has {
+			writeError(rw, 404, "zone not found")
+			return
+		}
+		delete(f.zones, name)
+		for k, r := range f.records {
+			if r.Zone == name {
+				delete(f.records, k)
+			}
+		}
+		writeJSON(rw, struct{}{})
+	default:
+		writeError(rw, 405, "method not allowed")
+	}
+}
+
+func updateZone(existing, changes *dns.Zone) {
+	if changes.TTL != 0 {
+		existing.TTL = changes.TTL
+	}
+	if changes.NxTTL != 0 {
+		existing.NxTTL = changes.NxTTL
+	}
+	if changes.Retry != 0 {
+		existing.Retry = changes.Retry
+	}
+	if changes.Refresh != 0 {
+		existing.Refresh = changes.Refresh
+	}
+	if changes.Expiry != 0 {
+		existing.Expiry = changes.Expiry
+	}
+	if changes.Hostmaster != "" {
+		existing.Hostmaster = changes.Hostmaster
+	}
+	existing.Serial++
+}
+
+func (f *Fake) record(rw http.ResponseWriter, req *http.Request, zone, domain, kind string) {
+	key := recordKey(zone, domain, kind)
+	existing, has := f.records[key]
+	_, hasZone := f.zones[zone]
+
+	switch req.Method {
+	case "GET":
+		if !has {
+			writeError(rw, 404, "record not found")
+			return
+		}
+		writeJSON(rw, existing)
+	case "PUT":
+		if !hasZone {
+			writeError(rw, 404, "zone not found")
+			return
+		}
+		if has {
+			writeError(rw, 400, "record already exists")
+			return
+		}
+		record := dns.Record{}
+		if !readJSON(rw, req, &record) {
+			return
+		}
+		record.Zone, record.Domain, record.Type = zone, domain, kind
+		f.putRecord(&record)
+		writeJSON(rw, f.records[key])
+	case "POST":
+		if !has {
+			writeError(rw, 404, "record not found")
+			return
+		}
+		record := dns.Record{}
+		if !readJSON(rw, req, &record) {
+			return
+		}
+		record.Zone, record.Domain, record.Type = zone, domain, kind
+		record.ID = existing.ID
+		if record.TTL == 0 {
+			record.TTL = existing.TTL
+		}
+		f.putRecord(&record)
+		writeJSON(rw, f.records[key])
+	case "DELETE":
+		if !has {
+			writeError(rw, 404, "record not found")
+			return
+		}
+		delete(f.records, key)
+		f.zones[zone].Serial++
+		writeJSON(rw, struct{}{})
+	default:
+		writeError(rw, 405, "method not allowed")
+	}
+}
+
+func readJSON(rw http.ResponseWriter, req *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil {
+		writeError(rw, 400, fmt.Sprintf("invalid json: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		panic(err)
+	}
+}
+
+func writeError(rw http.ResponseWriter, status int, message string) {
+	rw.WriteHeader(status)
+	writeJSON(rw, map[string]string{"message": message})
+}
@@ -0,0 +1,131 @@
+package ns1fake
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+func testClient(t *testing.T) (*Fake, *ns1.Client) {
+	t.Helper()
+	fake := Start()
+	return fake, ns1.NewClient(fake.ClientFn(context.Background()), ns1.SetAPIKey("fake"))
+}
+
+func TestZones(t *testing.T) {
+	fake, client := testClient(t)
+	defer fake.Close()
+
+	if _, err := client.Zones.Create(dns.NewZone("example.com")); err != nil {
+		t.Fatalf("Creating zone: %v", err)
+	}
+	if _, err := client.Zones.Create(dns.NewZone("example.com")); err != ns1.ErrZoneExists {
+		t.Errorf("Re-creating zone: expected ErrZoneExists, got %v", err)
+	}
+
+	zone, _, err := client.Zones.Get("example.com")
+	if err != nil {
+		t.Fatalf("Getting zone: %v", err)
+	}
+	if len(zone.DNSServers) == 0 || len(zone.Records) != 1 || zone.Records[0].Type != "NS" {
+		t.Errorf("Zone lacks nameservers: %#v", zone)
+	}
+
+	zones, _, err := client.Zones.List()
+	if err != nil {
+		t.Fatalf("Listing zones: %v", err)
+	}
+	if len(zones) != 1 {
+		t.Errorf("Expected 1 zone, got %d", len(zones))
+	}
+
+	if _, err := client.Zones.Delete("example.com"); err != nil {
+		t.Fatalf("Deleting zone: %v", err)
+	}
+	if _, _, err := client.Zones.Get("example.com"); err != ns1.ErrZoneMissing {
+		t.Errorf("Getting deleted zone: expected ErrZoneMissing, got %v", err)
+	}
+}
+
+func TestRecords(t *testing.T) {
+	fake, client := testClient(t)
+	defer fake.Close()
+
+	record := dns.NewRecord("example.com", "www.example.com", "A")
+	record.AddAnswer(dns.NewAv4Answer("1.2.3.4"))
+	if _, err := client.Records.Create(record); err != ns1.ErrZoneMissing {
+		t.Errorf("Creating record without zone: expected ErrZoneMissing, got %v", err)
+	}
+
+	fake.AddZone("example.com")
+	if _, err := client.Records.Create(record); err != nil {
+		t.Fatalf("Creating record: %v", err)
+	}
+	if _, err := client.Records.Create(record); err != ns1.ErrRecordExists {
+		t.Errorf("Re-creating record: expected ErrRecordExists, got %v", err)
+	}
+
+	record.Answers = []*dns.Answer{dns.NewAv4Answer("5.6.7.8")}
+	if _, err := client.Records.Update(record); err != nil {
+		t.Fatalf("Updating record: %v", err)
+	}
+
+	got, _, err := client.Records.Get("example.com", "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("Getting record: %v", err)
+	}
+	if len(got.Answers) != 1 || got.Answers[0].Rdata[0] != "5.6.7.8" {
+		t.Errorf("Record wasn't updated: %v", got.Answers)
+	}
+
+	if _, err := client.Records.Delete("example.com", "www.example.com", "A"); err != nil {
+		t.Fatalf("Deleting record: %v", err)
+	}
+	if _, _, err := client.Records.Get("example.com", "www.example.com", "A"); err != ns1.ErrRecordMissing {
+		t.Errorf("Getting deleted record: expected ErrRecordMissing, got %v", err)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	fake, client := testClient(t)
+	defer fake.Close()
+	fake.AddZone("example.com")
+
+	fake.Inject(Fault{Method: "GET", Path: "/v1/zones/example.com", Status: 429, Times: 1})
+
+	_, rz, err := client.Zones.Get("example.com")
+	if err == nil || rz == nil || rz.StatusCode != 429 {
+		t.Fatalf("Expected a 429, got %v, %v", rz, err)
+	}
+	if rz.Header.Get("X-Ratelimit-Remaining") != "0" {
+		t.Errorf("Expected no remaining rate limit, got %q", rz.Header.Get("X-Ratelimit-Remaining"))
+	}
+
+	if _, _, err := client.Zones.Get("example.com"); err != nil {
+		t.Errorf("Fault should have cleared: %v", err)
+	}
+
+	fake.Inject(Fault{Status: 503})
+	for i := 0; i < 3; i++ {
+		if _, rz, _ := client.Zones.List(); rz == nil || rz.StatusCode != 503 {
+			t.Errorf("Expected a persistent 503, got %v", rz)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	fake := Start()
+	defer fake.Close()
+	fake.SetLatency(time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	client := ns1.NewClient(fake.ClientFn(ctx), ns1.SetAPIKey("fake"))
+
+	if _, _, err := client.Zones.List(); err == nil {
+		t.Errorf("Expected the request to time out")
+	}
+}
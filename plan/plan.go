@@ -0,0 +1,244 @@
+// Package plan compares a declarative description of zones and records with
+// what NS1 currently holds, and works out the changes needed to make them agree.
+package plan
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// State describes zones and their records, as loaded from a desired-state file:
+//
+//	zones:
+//	- zone: example.com
+//	  records:
+//	  - domain: www          # relative to the zone, or "@" for the zone itself
+//	    type: A
+//	    ttl: 300             # optional - NS1's default if omitted
+//	    answers:
+//	    - 1.2.3.4
+//	    - [10, mail.example.com] # answers with several fields are lists
+type State struct {
+	Zones []Zone `yaml:"zones"`
+}
+
+// Zone is a zone and the complete set of records it should contain
+type Zone struct {
+	Zone    string   `yaml:"zone"`
+	Records []Record `yaml:"records"`
+}
+
+// Record is a single record and all its answers
+type Record struct {
+	Domain  string   `yaml:"domain"`
+	Type    string   `yaml:"type"`
+	TTL     int      `yaml:"ttl,omitempty"`
+	Answers []Answer `yaml:"answers"`
+}
+
+// Answer is the fields of one answer to a record, e.g. [10, mail.example.com] for an MX
+type Answer []string
+
+// UnmarshalYAML allows single-field answers to be written as plain strings
+func (a *Answer) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	single := ""
+	if err := unmarshal(&single); err == nil {
+		*a = Answer{single}
+		return nil
+	}
+	fields := []string{}
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	*a = Answer(fields)
+	return nil
+}
+
+func (a Answer) String() string {
+	return strings.Join(a, " ")
+}
+
+// Load reads a desired State, resolving relative domains against their zones
+func Load(r io.Reader) (*State, error) {
+	state := &State{}
+	if err := yaml.NewDecoder(r).Decode(state); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for i := range state.Zones {
+		z := &state.Zones[i]
+		z.Zone = strings.TrimSuffix(z.Zone, ".")
+		if z.Zone == "" {
+			return nil, fmt.Errorf("zone %d has no name", i+1)
+		}
+		if seen[z.Zone] {
+			return nil, fmt.Errorf("zone %s is described twice", z.Zone)
+		}
+		seen[z.Zone] = true
+
+		records := map[string]bool{}
+		for j := range z.Records {
+			r := &z.Records[j]
+			r.Domain = qualify(r.Domain, z.Zone)
+			r.Type = strings.ToUpper(r.Type)
+			if r.Type == "" {
+				return nil, fmt.Errorf("record %s in %s has no type", r.Domain, z.Zone)
+			}
+			if len(r.Answers) == 0 {
+				return nil, fmt.Errorf("record %s %s has no answers", r.Domain, r.Type)
+			}
+			key := recordKey(r.Domain, r.Type)
+			if records[key] {
+				return nil, fmt.Errorf("record %s %s is described twice", r.Domain, r.Type)
+			}
+			records[key] = true
+		}
+	}
+	return state, nil
+}
+
+func qualify(domain, zone string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	switch {
+	case domain == "@" || domain == "":
+		return zone
+	case domain == zone || strings.HasSuffix(domain, "."+zone):
+		return domain
+	default:
+		return domain + "." + zone
+	}
+}
+
+func recordKey(domain, kind string) string {
+	return strings.ToLower(domain) + "/" + strings.ToUpper(kind)
+}
+
+// Action is the kind of change a plan makes
+type Action string
+
+const (
+	// Create makes a new zone or record
+	Create Action = "create"
+	// Update changes the answers or TTL of an existing record
+	Update Action = "update"
+	// Delete removes a record
+	Delete Action = "delete"
+)
+
+// Change is a single step of a plan. Changes to zones have no Domain.
+type Change struct {
+	Action  Action   `json:"action"`
+	Zone    string   `json:"zone"`
+	Domain  string   `json:"domain,omitempty"`
+	Type    string   `json:"type,omitempty"`
+	TTL     int      `json:"ttl,omitempty"`
+	Answers []Answer `json:"answers,omitempty"`
+	// Before is the answers of a record prior to an update or delete
+	Before []Answer `json:"before,omitempty"`
+}
+
+// Compute works out the Changes needed to bring current into line with desired.
+// current maps zone names to the records NS1 has in them; zones absent from
+// the map don't exist yet. Only zones mentioned in desired are considered, and
+// NS records at a zone's apex are left to NS1 to manage.
+func Compute(desired *State, current map[string][]*dns.Record) []Change {
+	changes := []Change{}
+
+	for _, z := range desired.Zones {
+		existing, has := current[z.Zone]
+		if !has {
+			changes = append(changes, Change{Action: Create, Zone: z.Zone})
+		}
+
+		actual := map[string]*dns.Record{}
+		for _, r := range existing {
+			actual[recordKey(r.Domain, r.Type)] = r
+		}
+
+		for _, want := range z.Records {
+			key := recordKey(want.Domain, want.Type)
+			got, has := actual[key]
+			delete(actual, key)
+
+			change := Change{
+				Zone:    z.Zone,
+				Domain:  want.Domain,
+				Type:    want.Type,
+				TTL:     want.TTL,
+				Answers: want.Answers,
+			}
+			switch {
+			case !has:
+				change.Action = Create
+			case !sameAnswers(want.Answers, answersOf(got)) || (want.TTL != 0 && want.TTL != got.TTL):
+				change.Action = Update
+				change.Before = answersOf(got)
+			default:
+				continue
+			}
+			changes = append(changes, change)
+		}
+
+		leftover := []*dns.Record{}
+		for _, r := range actual {
+			if r.Type == "NS" && strings.EqualFold(strings.TrimSuffix(r.Domain, "."), z.Zone) {
+				continue
+			}
+			leftover = append(leftover, r)
+		}
+		sort.Slice(leftover, func(i, j int) bool {
+			return recordKey(leftover[i].Domain, leftover[i].Type) < recordKey(leftover[j].Domain, leftover[j].Type)
+		})
+		for _, r := range leftover {
+			changes = append(changes, Change{
+				Action: Delete,
+				Zone:   z.Zone,
+				Domain: r.Domain,
+				Type:   r.Type,
+				Before: answersOf(r),
+			})
+		}
+	}
+
+	return changes
+}
+
+func answersOf(r *dns.Record) []Answer {
+	answers := []Answer{}
+	for _, a := range r.Answers {
+		answers = append(answers, Answer(a.Rdata))
+	}
+	return answers
+}
+
+// sameAnswers compares answers regardless of order, and of the trailing dots of names
+func sameAnswers(a, b []Answer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	normal := func(as []Answer) []string {
+		out := []string{}
+		for _, a := range as {
+			fields := []string{}
+			for _, f := range a {
+				fields = append(fields, strings.TrimSuffix(f, "."))
+			}
+			out = append(out, strings.Join(fields, " "))
+		}
+		sort.Strings(out)
+		return out
+	}
+	na, nb := normal(a), normal(b)
+	for i := range na {
+		if na[i] != nb[i] {
+			return false
+		}
+	}
+	return true
+}
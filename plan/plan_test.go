@@ -0,0 +1,134 @@
+package plan
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+const desiredYAML = `
+zones:
+- zone: example.com
+  records:
+  - domain: www
+    type: a
+    ttl: 300
+    answers:
+    - 1.2.3.4
+    - 5.6.7.8
+  - domain: "@"
+    type: MX
+    answers:
+    - [10, mail.example.com]
+  - domain: mail.example.com
+    type: A
+    answers: [1.2.3.5]
+- zone: new.example.com
+  records:
+  - domain: www
+    type: CNAME
+    answers: [www.example.com]
+`
+
+func load(t *testing.T) *State {
+	t.Helper()
+	state, err := Load(strings.NewReader(desiredYAML))
+	if err != nil {
+		t.Fatalf("err from Load: %v", err)
+	}
+	return state
+}
+
+func record(domain, kind string, ttl int, answers ...[]string) *dns.Record {
+	r := dns.NewRecord("example.com", domain, kind)
+	r.TTL = ttl
+	for _, a := range answers {
+		r.AddAnswer(dns.NewAnswer(a))
+	}
+	return r
+}
+
+func TestLoad(t *testing.T) {
+	state := load(t)
+
+	if len(state.Zones) != 2 {
+		t.Fatalf("Expected 2 zones, got %d", len(state.Zones))
+	}
+	records := state.Zones[0].Records
+	if records[0].Domain != "www.example.com" || records[0].Type != "A" {
+		t.Errorf("Relative domain wasn't resolved: %#v", records[0])
+	}
+	if records[1].Domain != "example.com" {
+		t.Errorf("@ wasn't resolved to the zone: %#v", records[1])
+	}
+	if len(records[1].Answers[0]) != 2 {
+		t.Errorf("MX answer should have two fields: %#v", records[1].Answers)
+	}
+	if records[2].Domain != "mail.example.com" {
+		t.Errorf("Qualified domain was changed: %#v", records[2])
+	}
+}
+
+func TestLoadRejectsDuplicates(t *testing.T) {
+	_, err := Load(strings.NewReader(`
+zones:
+- zone: example.com
+  records:
+  - {domain: www, type: A, answers: [1.2.3.4]}
+  - {domain: www.example.com, type: a, answers: [1.2.3.5]}
+`))
+	if err == nil {
+		t.Errorf("Expected an error for a record described twice")
+	}
+}
+
+func TestCompute(t *testing.T) {
+	current := map[string][]*dns.Record{
+		"example.com": {
+			record("example.com", "NS", 3600, []string{"dns1.p01.nsone.net"}),
+			record("www.example.com", "A", 300, []string{"5.6.7.8"}, []string{"1.2.3.4"}),
+			record("example.com", "MX", 3600, []string{"10", "mail.example.com."}),
+			record("mail.example.com", "A", 3600, []string{"9.9.9.9"}),
+			record("old.example.com", "A", 3600, []string{"1.1.1.1"}),
+		},
+	}
+
+	changes := Compute(load(t), current)
+
+	summary := []string{}
+	for _, c := range changes {
+		summary = append(summary, strings.TrimSpace(strings.Join([]string{string(c.Action), c.Zone, c.Domain, c.Type}, " ")))
+	}
+	expected := []string{
+		"update example.com mail.example.com A",
+		"delete example.com old.example.com A",
+		"create new.example.com",
+		"create new.example.com www.new.example.com CNAME",
+	}
+	if strings.Join(summary, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected changes:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(summary, "\n"))
+	}
+
+	if len(changes) > 0 && (len(changes[0].Before) != 1 || changes[0].Before[0][0] != "9.9.9.9") {
+		t.Errorf("Update should record previous answers: %#v", changes[0])
+	}
+}
+
+func TestComputeTTLChange(t *testing.T) {
+	current := map[string][]*dns.Record{
+		"example.com": {
+			record("www.example.com", "A", 3600, []string{"1.2.3.4"}, []string{"5.6.7.8"}),
+			record("example.com", "MX", 60, []string{"10", "mail.example.com"}),
+			record("mail.example.com", "A", 3600, []string{"1.2.3.5"}),
+		},
+		"new.example.com": {
+			record("www.new.example.com", "CNAME", 3600, []string{"www.example.com"}),
+		},
+	}
+
+	changes := Compute(load(t), current)
+	if len(changes) != 1 || changes[0].Action != Update || changes[0].Domain != "www.example.com" {
+		t.Errorf("Expected only the TTL change on www, got %#v", changes)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/nyarly/dns-manager/plan"
+	"github.com/spf13/cobra"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "show the changes needed to match a desired-state file",
+	Long: "Compares the zones and records described in a YAML file with what NS1 currently holds,\n" +
+		"  and prints what `dns-manager apply` would create, update and delete. With --out, also\n" +
+		"  saves the plan, for `dns-manager apply --plan` to carry out.",
+	RunE: planFn,
+	Args: cobra.NoArgs,
+}
+
+func planFn(cmd *cobra.Command, args []string) error {
+	_, changes, err := computePlan(cmd)
+	if err != nil {
+		return err
+	}
+
+	printPlan(os.Stdout, changes)
+
+	out, err := cmd.Flags().GetString("out")
+	if err != nil {
+		return err
+	}
+	if out != "" {
+		return writePlan(out, changes)
+	}
+	return nil
+}
+
+// writePlan saves a plan for apply to carry out later
+func writePlan(path string, changes []plan.Change) error {
+	saved, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(saved, '\n'), 0644)
+}
+
+// readPlan loads a plan saved by writePlan
+func readPlan(path string) ([]plan.Change, error) {
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	changes := []plan.Change{}
+	if err := json.Unmarshal(saved, &changes); err != nil {
+		return nil, fmt.Errorf("reading plan %s: %v", path, err)
+	}
+	return changes, nil
+}
+
+// samePlan compares plans as they'd be saved, so that e.g. a missing list
+// and an empty one are alike
+func samePlan(a, b []plan.Change) bool {
+	ja, erra := json.Marshal(a)
+	jb, errb := json.Marshal(b)
+	return erra == nil && errb == nil && bytes.Equal(ja, jb)
+}
+
+// computePlan loads the desired state named by the --file flag and compares
+// it with the state the server reports. The server is asked for NS1's
+// current state, rather than what it has cached, so that a plan is never made
+// against a partial or out of date view.
+func computePlan(cmd *cobra.Command) (*apiClient, []plan.Change, error) {
+	client, err := newAPIClient(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	path, err := cmd.Flags().GetString("file")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	desired, err := plan.Load(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	fresh := map[string]string{"fresh": "true"}
+	zones := []*dns.Zone{}
+	if err := client.doRequest("GET", "/zones", fresh, nil, &zones); err != nil {
+		return nil, nil, err
+	}
+	exists := map[string]bool{}
+	for _, z := range zones {
+		exists[z.Zone] = true
+	}
+
+	current := map[string][]*dns.Record{}
+	for _, z := range desired.Zones {
+		if !exists[z.Zone] {
+			continue
+		}
+		records := []*dns.Record{}
+		if err := client.doRequest("GET", fmt.Sprintf("/zones/%s/records", z.Zone), fresh, nil, &records); err != nil {
+			return nil, nil, err
+		}
+		current[z.Zone] = records
+	}
+
+	return client, plan.Compute(desired, current), nil
+}
+
+func printPlan(w io.Writer, changes []plan.Change) {
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "No changes.")
+		return
+	}
+
+	symbols := map[plan.Action]string{plan.Create: "+", plan.Update: "~", plan.Delete: "-"}
+	for _, c := range changes {
+		if c.Domain == "" {
+			fmt.Fprintf(w, "%s zone %s\n", symbols[c.Action], c.Zone)
+			continue
+		}
+		fmt.Fprintf(w, "%s record %s %s", symbols[c.Action], c.Domain, c.Type)
+		if c.TTL != 0 {
+			fmt.Fprintf(w, " ttl=%d", c.TTL)
+		}
+		fmt.Fprintln(w)
+		if c.Action == plan.Update || c.Action == plan.Delete {
+			fmt.Fprintf(w, "    was: %s\n", describeAnswers(c.Before))
+		}
+		if c.Action == plan.Create || c.Action == plan.Update {
+			fmt.Fprintf(w, "    now: %s\n", describeAnswers(c.Answers))
+		}
+	}
+
+	counts := map[plan.Action]int{}
+	for _, c := range changes {
+		counts[c.Action]++
+	}
+	fmt.Fprintf(w, "\n%d to create, %d to update, %d to delete.\n", counts[plan.Create], counts[plan.Update], counts[plan.Delete])
+}
+
+func describeAnswers(answers []plan.Answer) string {
+	described := []string{}
+	for _, a := range answers {
+		described = append(described, strconv.Quote(a.String()))
+	}
+	return strings.Join(described, ", ")
+}
@@ -3,8 +3,8 @@ package main
 import (
 	"errors"
 	"fmt"
-	"strings"
 
+	"github.com/nyarly/dns-manager/validate"
 	"github.com/spf13/cobra"
 	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
 )
@@ -17,12 +17,7 @@ var recordAddCmd = &cobra.Command{
 }
 
 func recordAddFn(cmd *cobra.Command, args []string) error {
-	addr, err := cmd.Flags().GetString("address")
-	if err != nil {
-		return err
-	}
-
-	zone, err := cmd.Flags().GetString("zone")
+	client, err := newAPIClient(cmd)
 	if err != nil {
 		return err
 	}
@@ -31,13 +26,20 @@ func recordAddFn(cmd *cobra.Command, args []string) error {
 	kind := args[1]
   answer := args[2:len(args)]
 
-	if zone == "" {
-		idx := strings.Index(name, ".")
-		if idx == -1 {
-			return errors.New("no dots in name")
+	zone, err := recordZone(cmd, name)
+	if err != nil {
+		return err
+	}
+
+	if err := validate.Answers(kind, [][]string{answer}); err != nil {
+		errs, ok := err.(validate.Errors)
+		if !ok {
+			return err
 		}
-    zone = name[idx+1:len(name)]
-		fmt.Printf("Using %q as zone\n", zone)
+		for _, fe := range errs {
+			fmt.Println(fe.Error())
+		}
+		return errors.New("not sending an invalid record")
 	}
 
 	record := &dns.Record{}
@@ -47,9 +49,8 @@ func recordAddFn(cmd *cobra.Command, args []string) error {
 		"type":   kind,
 	}
 
-  if err := doRequest("PUT", addr, "/record", query, [][]string{answer}, record); err != nil {
-		fmt.Println(err)
-		return nil
+  if err := client.doRequest("PUT", "/record", query, [][]string{answer}, record); err != nil {
+		return err
 	}
 
 	fmt.Println("Added")
@@ -1,9 +1,7 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -16,12 +14,7 @@ var recordDeleteCmd = &cobra.Command{
 }
 
 func recordDeleteFn(cmd *cobra.Command, args []string) error {
-	addr, err := cmd.Flags().GetString("address")
-	if err != nil {
-		return err
-	}
-
-	zone, err := cmd.Flags().GetString("zone")
+	client, err := newAPIClient(cmd)
 	if err != nil {
 		return err
 	}
@@ -29,13 +22,9 @@ func recordDeleteFn(cmd *cobra.Command, args []string) error {
 	name := args[0]
 	kind := args[1]
 
-	if zone == "" {
-		idx := strings.Index(name, ".")
-		if idx == -1 {
-			return errors.New("no dots in name")
-		}
-		zone = name[idx+1 : len(name)]
-		fmt.Printf("Using %q as zone\n", zone)
+	zone, err := recordZone(cmd, name)
+	if err != nil {
+		return err
 	}
 
 	query := map[string]string{
@@ -44,9 +33,8 @@ func recordDeleteFn(cmd *cobra.Command, args []string) error {
 		"type":   kind,
 	}
 
-	if err := doRequest("DELETE", addr, "/record", query, nil, nil); err != nil {
-		fmt.Println(err)
-		return nil
+	if err := client.doRequest("DELETE", "/record", query, nil, nil); err != nil {
+		return err
 	}
 
 	fmt.Println("Deleted")
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nyarly/dns-manager/storage"
+	"github.com/nyarly/inlinefiles/templatestore"
+	"github.com/spf13/cobra"
+)
+
+var recordHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "list the versions of a record the server has seen",
+	RunE:  recordHistoryFn,
+	Args:  cobra.ExactArgs(2),
+}
+
+func recordHistoryFn(cmd *cobra.Command, args []string) error {
+	tmpl, err := templatestore.LoadText(Templates, "record-history", "record-history.tmpl")
+	if err != nil {
+		panic(err)
+	}
+
+	client, err := newAPIClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	history, err := fetchHistory(cmd, client, args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(os.Stdout, history)
+}
+
+func fetchHistory(cmd *cobra.Command, client *apiClient, name, kind string) ([]storage.RecordVersion, error) {
+	zone, err := recordZone(cmd, name)
+	if err != nil {
+		return nil, err
+	}
+
+	query := map[string]string{
+		"zone":   zone,
+		"domain": name,
+		"type":   kind,
+	}
+
+	history := []storage.RecordVersion{}
+	err = client.doRequest("GET", "/record/history", query, nil, &history)
+	return history, err
+}
+
+// recordZone is the --zone flag, or failing that a guess from a record's name
+func recordZone(cmd *cobra.Command, name string) (string, error) {
+	zone, err := cmd.Flags().GetString("zone")
+	if err != nil {
+		return "", err
+	}
+
+	if zone == "" {
+		idx := strings.Index(name, ".")
+		if idx == -1 {
+			return "", errors.New("no dots in name")
+		}
+		zone = name[idx+1:]
+		fmt.Printf("Using %q as zone\n", zone)
+	}
+	return zone, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nyarly/inlinefiles/templatestore"
+	"github.com/spf13/cobra"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+var recordListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the records in a zone",
+	RunE:  recordListFn,
+	Args:  cobra.ExactArgs(1),
+}
+
+func recordListFn(cmd *cobra.Command, args []string) error {
+	tmpl, err := templatestore.LoadText(Templates, "record-list", "record-list.tmpl")
+	if err != nil {
+		panic(err)
+	}
+
+	client, err := newAPIClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	records := []*dns.Record{}
+	path := fmt.Sprintf("/zones/%s/records", args[0]) // underflow should be guarded by Cobra
+	if err := client.doRequest("GET", path, nil, nil, &records); err != nil {
+		return err
+	}
+
+	return tmpl.Execute(os.Stdout, records)
+}
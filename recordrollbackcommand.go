@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+var recordRollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "put back the answers a record had in an earlier version",
+	Long: "Looks up a version listed by `dns-manager record history`, and updates the record\n" +
+		"  to have its answers and TTL again.",
+	RunE: recordRollbackFn,
+	Args: cobra.ExactArgs(2),
+}
+
+func recordRollbackFn(cmd *cobra.Command, args []string) error {
+	client, err := newAPIClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	to, err := cmd.Flags().GetInt("to")
+	if err != nil {
+		return err
+	}
+
+	name := args[0]
+	kind := args[1]
+
+	history, err := fetchHistory(cmd, client, name, kind)
+	if err != nil {
+		return err
+	}
+
+	var target *dns.Record
+	for _, v := range history {
+		if v.Version == to {
+			target = v.Record
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("%s %s has no version %d - see `dns-manager record history`", name, kind, to)
+	}
+
+	query := map[string]string{
+		"zone":   target.Zone,
+		"domain": target.Domain,
+		"type":   target.Type,
+	}
+	if target.TTL != 0 {
+		query["ttl"] = strconv.Itoa(target.TTL)
+	}
+	answers := [][]string{}
+	for _, a := range target.Answers {
+		answers = append(answers, a.Rdata)
+	}
+
+	if err := client.doRequest("PUT", "/record", query, answers, &dns.Record{}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Rolled %s %s back to version %d\n", name, kind, to)
+	return nil
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// acmeTTL is the TTL of challenge records we create, so that a failed
+// validation's answers don't linger in resolvers for the next attempt
+const acmeTTL = 60
+
+// ACMEChallenge is the body of /acme/present and /acme/cleanup requests, as
+// lego's httpreq DNS provider sends it: FQDN and Value by default, or Domain,
+// Token and KeyAuth in its RAW mode. Responses carry FQDN and Value.
+type ACMEChallenge struct {
+	FQDN  string `json:"fqdn,omitempty"`
+	Value string `json:"value,omitempty"`
+
+	Domain  string `json:"domain,omitempty"`
+	Token   string `json:"token,omitempty"`
+	KeyAuth string `json:"keyAuth,omitempty"`
+}
+
+// normalize fills in FQDN and Value from a RAW mode challenge, returning
+// false if the challenge isn't complete
+func (c *ACMEChallenge) normalize() bool {
+	if c.FQDN == "" && c.Domain != "" && c.KeyAuth != "" {
+		sum := sha256.Sum256([]byte(c.KeyAuth))
+		c.FQDN = "_acme-challenge." + strings.TrimPrefix(c.Domain, "*.")
+		c.Value = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	c.FQDN = strings.ToLower(strings.TrimSuffix(c.FQDN, "."))
+	c.Domain, c.Token, c.KeyAuth = "", "", ""
+	return c.FQDN != "" && c.Value != ""
+}
+
+// acmeParams reads a challenge, responding with an error and returning nil
+// unless it's for an _acme-challenge name
+func acmeParams(rw http.ResponseWriter, req *http.Request) *ACMEChallenge {
+	challenge := &ACMEChallenge{}
+	if err := json.NewDecoder(req.Body).Decode(challenge); err != nil {
+		fail(rw, 400, CodeBadRequest, "body of request ill formed: %v", err)
+		return nil
+	}
+	if !challenge.normalize() {
+		fail(rw, 400, CodeBadRequest, "a challenge needs fqdn and value, or domain and keyAuth")
+		return nil
+	}
+	if !strings.HasPrefix(challenge.FQDN, "_acme-challenge.") {
+		fail(rw, 400, CodeBadRequest, "%s is not an _acme-challenge name", challenge.FQDN)
+		return nil
+	}
+	return challenge
+}
+
+// acmeZone finds the zone a challenge record belongs in: the longest
+// suffix of the challenged name that NS1 has a zone for. Zones the policy
+// wouldn't let the requester change the record in with any of verbs are
+// only looked for in the cache, so that NS1 isn't asked about them, and a
+// name that's only in such zones is forbidden rather than not found.
+func (s *Server) acmeZone(ctx context.Context, rw http.ResponseWriter, fqdn string, verbs ...string) string {
+	name := mdns.Fqdn(strings.TrimPrefix(fqdn, "_acme-challenge."))
+	var denied error
+	for off, end := 0, false; !end; off, end = mdns.NextLabel(name, off) {
+		candidate := strings.TrimSuffix(name[off:], ".")
+		if candidate == "" {
+			break
+		}
+
+		permitted := s.allowedAny(ctx, verbs, candidate, fqdn, "TXT")
+		zone, err := s.storage.GetZone(candidate)
+		if err != nil {
+			fail(rw, 503, CodeStorage, "problem checking for zone: %v", err)
+			return ""
+		}
+		if zone != nil && permitted != nil {
+			fail(rw, 403, CodeForbidden, "%v", permitted)
+			return ""
+		}
+		if zone != nil {
+			return candidate
+		}
+		if permitted != nil {
+			if denied == nil {
+				denied = permitted
+			}
+			continue
+		}
+
+		f := s.fetchZone(ctx, candidate)
+		switch {
+		case f.err == ns1.ErrZoneMissing:
+			continue
+		case f.err != nil:
+			ns1Failure(rw, f.rz, f.err)
+			return ""
+		case f.storeErr != nil:
+			fail(rw, 503, CodeStorage, "problem recording zone: %v", f.storeErr)
+			return ""
+		}
+		return candidate
+	}
+	if denied != nil {
+		fail(rw, 403, CodeForbidden, "%v", denied)
+		return ""
+	}
+	fail(rw, 404, CodeNotFound, "no zone at NS1 holds %s", fqdn)
+	return ""
+}
+
+// acmeRecord fetches a challenge's TXT record from NS1 - rather than the
+// cache, since other challenges' answers must be kept - or returns nil if
+// there isn't one yet
+func (s *Server) acmeRecord(ctx context.Context, rw http.ResponseWriter, zone, fqdn string) (*dns.Record, bool) {
+	record, rz, err := s.getRecordAPI(ctx, zone, fqdn, "TXT")
+	if err == ns1.ErrRecordMissing {
+		return nil, true
+	}
+	if err != nil {
+		ns1Failure(rw, rz, err)
+		return nil, false
+	}
+	return record, true
+}
+
+// acmePresent adds a challenge's answer to its TXT record, alongside any
+// answers already there, e.g. for a certificate's wildcard name
+func (s *Server) acmePresent(rw http.ResponseWriter, req *http.Request) {
+	challenge := acmeParams(rw, req)
+	if challenge == nil {
+		return
+	}
+	ctx := req.Context()
+	zone := s.acmeZone(ctx, rw, challenge.FQDN, UpdateRecord)
+	if zone == "" {
+		return
+	}
+	if !s.authorize(rw, req, UpdateRecord, zone, challenge.FQDN, "TXT") {
+		return
+	}
+
+	// challenges for one name come in together; one mustn't undo another
+	s.acme.Lock()
+	defer s.acme.Unlock()
+	existing, ok := s.acmeRecord(ctx, rw, zone, challenge.FQDN)
+	if !ok {
+		return
+	}
+
+	record := buildRecord(zone, challenge.FQDN, "TXT", nil)
+	record.TTL = acmeTTL
+	if existing != nil {
+		record.TTL = existing.TTL
+		for _, a := range existing.Answers {
+			if len(a.Rdata) == 1 && a.Rdata[0] == challenge.Value {
+				writeJSON(rw, challenge)
+				return
+			}
+			record.AddAnswer(dns.NewAnswer(a.Rdata))
+		}
+	}
+	record.AddAnswer(dns.NewAnswer([]string{challenge.Value}))
+
+	var rz *http.Response
+	var err error
+	if existing == nil {
+		rz, err = s.createRecordAPI(ctx, record)
+	} else {
+		rz, err = s.updateRecordAPI(ctx, record)
+	}
+	if err != nil {
+		ns1Failure(rw, rz, err)
+		return
+	}
+	if _, err := s.storage.RecordRecord(*record); err != nil {
+		fail(rw, 503, CodeStorage, "problem recording record: %v", err)
+		return
+	}
+	if err := s.summarize(zone, challenge.FQDN, "TXT", record); err != nil {
+		fail(rw, 503, CodeStorage, "problem updating zone: %v", err)
+		return
+	}
+	s.audit(ctx, UpdateRecord, zone, challenge.FQDN, "TXT", existing, record)
+	writeJSON(rw, challenge)
+}
+
+// acmeCleanup removes a challenge's answer from its TXT record, deleting
+// the record once no answers are left
+func (s *Server) acmeCleanup(rw http.ResponseWriter, req *http.Request) {
+	challenge := acmeParams(rw, req)
+	if challenge == nil {
+		return
+	}
+	ctx := req.Context()
+	zone := s.acmeZone(ctx, rw, challenge.FQDN, UpdateRecord, DeleteRecord)
+	if zone == "" {
+		return
+	}
+
+	s.acme.Lock()
+	defer s.acme.Unlock()
+	existing, ok := s.acmeRecord(ctx, rw, zone, challenge.FQDN)
+	if !ok {
+		return
+	}
+
+	record := buildRecord(zone, challenge.FQDN, "TXT", nil)
+	found := false
+	if existing != nil {
+		record.TTL = existing.TTL
+		for _, a := range existing.Answers {
+			if len(a.Rdata) == 1 && a.Rdata[0] == challenge.Value {
+				found = true
+				continue
+			}
+			record.AddAnswer(dns.NewAnswer(a.Rdata))
+		}
+	}
+	if !found {
+		// already cleaned up, or never presented
+		writeJSON(rw, challenge)
+		return
+	}
+
+	verb := UpdateRecord
+	if len(record.Answers) == 0 {
+		verb = DeleteRecord
+	}
+	if !s.authorize(rw, req, verb, zone, challenge.FQDN, "TXT") {
+		return
+	}
+
+	if verb == DeleteRecord {
+		if rz, err := s.deleteRecordAPI(ctx, zone, challenge.FQDN, "TXT"); err != nil {
+			ns1Failure(rw, rz, err)
+			return
+		}
+		if _, err := s.storage.DeleteRecord(zone, challenge.FQDN, "TXT"); err != nil {
+			fail(rw, 503, CodeStorage, "problem forgetting record: %v", err)
+			return
+		}
+		record = nil
+	} else {
+		if rz, err := s.updateRecordAPI(ctx, record); err != nil {
+			ns1Failure(rw, rz, err)
+			return
+		}
+		if _, err := s.storage.RecordRecord(*record); err != nil {
+			fail(rw, 503, CodeStorage, "problem recording record: %v", err)
+			return
+		}
+	}
+	if err := s.summarize(zone, challenge.FQDN, "TXT", record); err != nil {
+		fail(rw, 503, CodeStorage, "problem updating zone: %v", err)
+		return
+	}
+	s.audit(ctx, verb, zone, challenge.FQDN, "TXT", existing, record)
+	writeJSON(rw, challenge)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// AuditEntry records one change made through the server. Before and After
+// are the JSON of the dns.Zone or dns.Record concerned, and are absent when
+// it didn't exist before, or doesn't exist after. Before comes from the
+// cache, so if the server hadn't seen it, Before is absent and PriorUnknown
+// is set instead.
+type AuditEntry struct {
+	Time         time.Time       `json:"time"`
+	RequestID    string          `json:"request_id"`
+	Principal    string          `json:"principal"`
+	Verb         string          `json:"verb"`
+	Zone         string          `json:"zone"`
+	Domain       string          `json:"domain,omitempty"`
+	Type         string          `json:"type,omitempty"`
+	Before       json.RawMessage `json:"before,omitempty"`
+	PriorUnknown bool            `json:"prior_unknown,omitempty"`
+	After        json.RawMessage `json:"after,omitempty"`
+}
+
+// AuditFilter selects AuditEntries. Empty fields select everything.
+type AuditFilter struct {
+	Zone      string
+	Principal string
+	Since     time.Time
+}
+
+func (f AuditFilter) matches(e AuditEntry) bool {
+	return (f.Zone == "" || normalName(f.Zone) == normalName(e.Zone)) &&
+		(f.Principal == "" || f.Principal == e.Principal) &&
+		!e.Time.Before(f.Since)
+}
+
+// AuditFile is an append-only log of AuditEntries, one JSON object per line
+type AuditFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// OpenAuditFile opens the audit log at path for appending, creating it if need be
+func OpenAuditFile(path string) (*AuditFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditFile{path: path, file: f}, nil
+}
+
+// Append adds an entry to the end of the log
+func (a *AuditFile) Append(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(append(line, '\n'))
+	return err
+}
+
+// Query returns the entries f selects, oldest first
+func (a *AuditFile) Query(f AuditFilter) ([]AuditEntry, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []AuditEntry{}
+	r := bufio.NewReader(file)
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			e := AuditEntry{}
+			if err := json.Unmarshal(line, &e); err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", a.path, n, err)
+			}
+			if f.matches(e) {
+				entries = append(entries, e)
+			}
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close closes the underlying file
+func (a *AuditFile) Close() error {
+	return a.file.Close()
+}
+
+// SetAuditLog records every change made through the server in log
+func SetAuditLog(log *AuditFile) Option {
+	return func(s *Server) {
+		s.auditLog = log
+	}
+}
+
+// audit notes a successful change. The change has already been made by the
+// time we get here, so a failure to record it is logged rather than reported
+// to the client.
+func (s *Server) audit(ctx context.Context, verb, zone, domain, kind string, before, after interface{}) {
+	if s.auditLog == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		RequestID: requestID(ctx),
+		Principal: principal(ctx),
+		Verb:      verb,
+		Zone:      zone,
+		Domain:    domain,
+		Type:      kind,
+		After:     auditJSON(after),
+	}
+	if _, ok := before.(unknownPrior); ok {
+		entry.PriorUnknown = true
+	} else {
+		entry.Before = auditJSON(before)
+	}
+	if err := s.auditLog.Append(entry); err != nil {
+		log.Printf("failed to audit %s by %s (request %s): %v", verb, entry.Principal, entry.RequestID, err)
+	}
+}
+
+func auditJSON(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil || string(data) == "null" {
+		return nil
+	}
+	return data
+}
+
+// unknownPrior stands in for what was there before a change when we
+// hadn't cached it. Asking NS1 would cost every write another request, and
+// could still be out of date by the time the write lands.
+type unknownPrior struct{}
+
+// priorRecord is what a record was before a change, as far as we know
+func priorRecord(cached *dns.Record) interface{} {
+	if cached == nil {
+		return unknownPrior{}
+	}
+	return cached
+}
+
+// priorZone is priorRecord for zones
+func priorZone(cached *dns.Zone) interface{} {
+	if cached == nil {
+		return unknownPrior{}
+	}
+	return cached
+}
+
+func (s *Server) queryAudit(rw http.ResponseWriter, req *http.Request) {
+	if s.auditLog == nil {
+		fail(rw, 404, CodeNotFound, "this server isn't keeping an audit log")
+		return
+	}
+
+	query := req.URL.Query()
+	filter := AuditFilter{
+		Zone:      query.Get("zone"),
+		Principal: query.Get("principal"),
+	}
+	if since := query.Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			fail(rw, 400, CodeBadRequest, "since parameter must be an RFC 3339 time: %v", err)
+			return
+		}
+		filter.Since = t
+	}
+
+	entries, err := s.auditLog.Query(filter)
+	if err != nil {
+		fail(rw, 503, CodeStorage, "problem reading audit log: %v", err)
+		return
+	}
+	writeJSON(rw, entries)
+}
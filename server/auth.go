@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Token is a credential a client presents to the server, and who it belongs to.
+// Either Token or SHA256 (the hex digest of the token) must be set; the
+// latter keeps the token itself out of the file.
+type Token struct {
+	Name   string `yaml:"name"`
+	Token  string `yaml:"token,omitempty"`
+	SHA256 string `yaml:"sha256,omitempty"`
+	// ReadOnly tokens may only make GET requests
+	ReadOnly bool `yaml:"readonly,omitempty"`
+}
+
+// Tokens is the set of clients allowed to use the server
+type Tokens []Token
+
+// LoadTokens reads a token file:
+//
+//	tokens:
+//	- name: alice
+//	  token: 8c1f0e4a...
+//	- name: dashboard
+//	  sha256: 2bb80d53...
+//	  readonly: true
+func LoadTokens(path string) (Tokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	file := struct {
+		Tokens Tokens `yaml:"tokens"`
+	}{}
+	dec := yaml.NewDecoder(f)
+	// a misspelt key mustn't quietly leave the server open
+	dec.SetStrict(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(file.Tokens) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+
+	names := map[string]bool{}
+	for i, t := range file.Tokens {
+		if t.Name == "" {
+			return nil, fmt.Errorf("%s: token %d has no name", path, i+1)
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("%s: %s is named twice", path, t.Name)
+		}
+		names[t.Name] = true
+		if (t.Token == "") == (t.SHA256 == "") {
+			return nil, fmt.Errorf("%s: %s needs exactly one of token or sha256", path, t.Name)
+		}
+		if t.SHA256 != "" {
+			if sum, err := hex.DecodeString(t.SHA256); err != nil || len(sum) != sha256.Size {
+				return nil, fmt.Errorf("%s: %s's sha256 is not a hex SHA-256 digest", path, t.Name)
+			}
+		}
+	}
+	return file.Tokens, nil
+}
+
+func (t Token) digest() []byte {
+	if t.SHA256 != "" {
+		sum, _ := hex.DecodeString(t.SHA256)
+		return sum
+	}
+	sum := sha256.Sum256([]byte(t.Token))
+	return sum[:]
+}
+
+// find returns the Token matching presented, comparing digests in constant time
+func (ts Tokens) find(presented string) (Token, bool) {
+	sum := sha256.Sum256([]byte(presented))
+	for _, t := range ts {
+		if subtle.ConstantTimeCompare(sum[:], t.digest()) == 1 {
+			return t, true
+		}
+	}
+	return Token{}, false
+}
+
+// SetTokens requires every request to carry one of tokens as a bearer token,
+// or as the password of basic credentials. Without it, the server accepts
+// requests from anyone; with no tokens, it accepts none.
+func SetTokens(tokens Tokens) Option {
+	return func(s *Server) {
+		s.tokens = tokens
+		s.requireTokens = true
+	}
+}
+
+type principalKey struct{}
+
+// principal returns the name of the token a request was authenticated with,
+// or "" if the server doesn't require tokens.
+func principal(ctx context.Context) string {
+	name, _ := ctx.Value(principalKey{}).(string)
+	return name
+}
+
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if !s.requireTokens {
+		return next
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		header := req.Header.Get("Authorization")
+		presented := strings.TrimPrefix(header, "Bearer ")
+		if _, password, basic := req.BasicAuth(); basic {
+			// for clients that can only send a username and password, e.g. lego's httpreq
+			presented = password
+		}
+		if header == "" || presented == header {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="dns-manager"`)
+			fail(rw, 401, CodeUnauthenticated, "a bearer token is required")
+			return
+		}
+
+		token, ok := s.tokens.find(presented)
+		if !ok {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="dns-manager", error="invalid_token"`)
+			fail(rw, 401, CodeUnauthenticated, "unknown token")
+			return
+		}
+
+		if token.ReadOnly && req.Method != "GET" && req.Method != "HEAD" {
+			fail(rw, 403, CodeForbidden, "%s may only read", token.Name)
+			return
+		}
+
+		next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), principalKey{}, token.Name)))
+	})
+}
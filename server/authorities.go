@@ -0,0 +1,119 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/nyarly/dns-manager/storage"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// authorityTTL is how long the DNS server answers from zones built from the
+// cache before building them again, so that entries which expire from the
+// cache stop being served
+const authorityTTL = time.Minute
+
+// authorities holds the zones the DNS server answers from, built from the
+// cache as queries need them, so that queries don't have to read storage.
+// They're all discarded whenever storage changes.
+type authorities struct {
+	mu sync.Mutex
+	// listed is when zones was read from storage
+	listed time.Time
+	// zones and built are keyed by lower case apex
+	zones map[string]*dns.Zone
+	built map[string]*authority
+}
+
+// forget discards every zone, to be built again from storage
+func (a *authorities) forget() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.zones, a.built = nil, nil
+}
+
+// authorityFor finds the zone that name is in, among the zones we have
+// cached, or returns nil. Queries never reach NS1.
+func (s *Server) authorityFor(name string) (*authority, error) {
+	a := s.authorities
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.zones == nil || time.Since(a.listed) > authorityTTL {
+		cached, err := s.storage.ListZones()
+		if err != nil {
+			return nil, err
+		}
+		a.listed = time.Now()
+		a.zones, a.built = map[string]*dns.Zone{}, map[string]*authority{}
+		for _, zone := range cached {
+			a.zones[strings.ToLower(mdns.Fqdn(zone.Zone))] = zone
+		}
+	}
+
+	name = strings.ToLower(mdns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = mdns.NextLabel(name, off) {
+		apex := name[off:]
+		if z, built := a.built[apex]; built {
+			return z, nil
+		}
+		zone := a.zones[apex]
+		if zone == nil {
+			continue
+		}
+
+		records, err := s.zoneRecords(zone)
+		if err != nil {
+			return nil, err
+		}
+		z := newAuthority(zone, records)
+		// the serial counts up as we see the zone change, for secondaries' sake
+		z.soa.Serial = s.journal.observe(z.apex, z.soa.Serial, z.records())
+		a.built[apex] = z
+		return z, nil
+	}
+	return nil, nil
+}
+
+// watchedStorage discards the DNS server's zones whenever storage changes
+type watchedStorage struct {
+	storage.Storage
+	authorities *authorities
+}
+
+func (w watchedStorage) RecordZone(zone dns.Zone) (bool, error) {
+	defer w.authorities.forget()
+	return w.Storage.RecordZone(zone)
+}
+
+func (w watchedStorage) DeleteZone(name string) (bool, error) {
+	defer w.authorities.forget()
+	return w.Storage.DeleteZone(name)
+}
+
+func (w watchedStorage) RecordSummary(zone string, summary dns.ZoneRecord) (bool, error) {
+	defer w.authorities.forget()
+	return w.Storage.RecordSummary(zone, summary)
+}
+
+func (w watchedStorage) DeleteSummary(zone, domain, kind string) (bool, error) {
+	defer w.authorities.forget()
+	return w.Storage.DeleteSummary(zone, domain, kind)
+}
+
+func (w watchedStorage) RecordRecord(record dns.Record) (bool, error) {
+	defer w.authorities.forget()
+	return w.Storage.RecordRecord(record)
+}
+
+func (w watchedStorage) DeleteRecord(zone, domain, kind string) (bool, error) {
+	defer w.authorities.forget()
+	return w.Storage.DeleteRecord(zone, domain, kind)
+}
+
+func (w watchedStorage) DeleteZoneRecords(zone string) (bool, error) {
+	defer w.authorities.forget()
+	return w.Storage.DeleteZoneRecords(zone)
+}
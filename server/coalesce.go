@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// fetchTimeout bounds a shared fetch from NS1, since no one request's
+// context does
+const fetchTimeout = time.Minute
+
+// fetched is the outcome of a fetch from NS1, shared by every request that
+// was waiting on it
+type fetched struct {
+	zone   *dns.Zone
+	record *dns.Record
+	rz     *http.Response
+	// err is NS1's error, and storeErr the error caching the result, if any
+	err      error
+	storeErr error
+}
+
+// detached has the values of the context it wraps, e.g. the request ID, but
+// not its deadline or cancellation
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
+
+// share runs fetch once for all the concurrent callers with the same key.
+// The fetch carries on if the caller that started it gives up, so the others
+// still get its result; each caller stops waiting when its own ctx is done.
+func (s *Server) share(ctx context.Context, key string, fetch func(context.Context) fetched) fetched {
+	ch := s.fetches.DoChan(key, func() (interface{}, error) {
+		shared, cancel := context.WithTimeout(detached{ctx}, fetchTimeout)
+		defer cancel()
+		return fetch(shared), nil
+	})
+	select {
+	case result := <-ch:
+		return result.Val.(fetched)
+	case <-ctx.Done():
+		return fetched{err: ctx.Err()}
+	}
+}
+
+// fetchZone gets a zone from NS1 and caches it. Concurrent fetches of the
+// same zone share one call to NS1 and one write to storage.
+func (s *Server) fetchZone(ctx context.Context, name string) fetched {
+	return s.share(ctx, "zone/"+name, func(ctx context.Context) fetched {
+		f := fetched{}
+		f.zone, f.rz, f.err = s.getZoneAPI(ctx, name)
+		if f.err == nil {
+			_, f.storeErr = s.storage.RecordZone(*f.zone)
+		}
+		return f
+	})
+}
+
+// fetchRecord is fetchZone for records
+func (s *Server) fetchRecord(ctx context.Context, zone, domain, kind string) fetched {
+	return s.share(ctx, "record/"+zone+"/"+domain+"/"+kind, func(ctx context.Context) fetched {
+		f := fetched{}
+		f.record, f.rz, f.err = s.getRecordAPI(ctx, zone, domain, kind)
+		if f.err == nil {
+			_, f.storeErr = s.storage.RecordRecord(*f.record)
+		}
+		return f
+	})
+}
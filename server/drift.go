@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nyarly/dns-manager/storage"
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// Kinds of Drift
+const (
+	Changed = "changed"
+	Deleted = "deleted"
+	Added   = "added"
+)
+
+// Drift is a change found at NS1 that wasn't made through this server.
+// Domain and Type are empty when a whole zone was deleted. Before is absent
+// for records added upstream, and After for records deleted upstream.
+type Drift struct {
+	Time   time.Time   `json:"time"`
+	Change string      `json:"change"`
+	Zone   string      `json:"zone"`
+	Domain string      `json:"domain,omitempty"`
+	Type   string      `json:"type,omitempty"`
+	Before *dns.Record `json:"before,omitempty"`
+	After  *dns.Record `json:"after,omitempty"`
+}
+
+// driftLog keeps the most recent Drifts in memory
+type driftLog struct {
+	mu      sync.Mutex
+	max     int
+	entries []Drift
+}
+
+func (l *driftLog) add(d Drift) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, d)
+	if over := len(l.entries) - l.max; over > 0 {
+		l.entries = append([]Drift{}, l.entries[over:]...)
+	}
+}
+
+// query returns the Drifts in zone (or any zone, if it's empty) found since, oldest first
+func (l *driftLog) query(zone string, since time.Time) []Drift {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	found := []Drift{}
+	for _, d := range l.entries {
+		if (zone == "" || normalName(zone) == normalName(d.Zone)) && !d.Time.Before(since) {
+			found = append(found, d)
+		}
+	}
+	return found
+}
+
+// SetRefresh makes Start re-fetch every cached zone and record from NS1 this
+// often, bringing the cache up to date and reporting any drift: changes made
+// at NS1 other than through this server. By default nothing is refreshed.
+func SetRefresh(interval time.Duration) Option {
+	return func(s *Server) {
+		s.refresh = interval
+	}
+}
+
+// refreshEvery runs refreshAll every interval until ctx is done
+func (s *Server) refreshEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.refreshAll(ctx); err != nil && ctx.Err() == nil {
+				s.metrics.refreshErrors.Inc()
+				log.Printf("problem refreshing cache: %v", err)
+				continue
+			}
+			s.metrics.lastRefresh.SetToCurrentTime()
+		}
+	}
+}
+
+// refreshAll refreshes every zone we've cached, or have cached records in,
+// including those that have expired. It carries on past a zone that can't be
+// refreshed, returning the last problem it had.
+func (s *Server) refreshAll(ctx context.Context) error {
+	cached, err := s.storage.ListAllZones()
+	if err != nil {
+		return err
+	}
+	zones := map[string]*dns.Zone{}
+	names := []string{}
+	for _, z := range cached {
+		zones[z.Zone] = z
+		names = append(names, z.Zone)
+	}
+
+	// zones may have been forgotten while their records are still cached
+	var failed error
+	upstream, _, err := s.listZonesAPI(ctx)
+	if err != nil {
+		failed = err
+	}
+	for _, z := range upstream {
+		if _, has := zones[z.Zone]; !has {
+			names = append(names, z.Zone)
+		}
+	}
+
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		records, err := s.storage.ListAllRecords(name)
+		if err != nil {
+			failed = err
+			continue
+		}
+		if zones[name] == nil && len(records) == 0 {
+			continue
+		}
+		if err := s.refreshZone(ctx, name, zones[name], records); err != nil {
+			failed = fmt.Errorf("zone %s: %v", name, err)
+		}
+	}
+	return failed
+}
+
+// refreshZone re-fetches a zone and the records of it we have cached,
+// reporting any differences from what we had. It carries on past records
+// that can't be refreshed, returning what went wrong with all of them.
+func (s *Server) refreshZone(ctx context.Context, name string, cached *dns.Zone, records []*dns.Record) error {
+	f := s.fetchZone(ctx, name)
+	if f.err == ns1.ErrZoneMissing {
+		if cached != nil {
+			s.drifted(Drift{Change: Deleted, Zone: name})
+		}
+		for _, r := range records {
+			s.drifted(Drift{Change: Deleted, Zone: name, Domain: r.Domain, Type: r.Type, Before: r})
+		}
+		if _, err := s.storage.DeleteZoneRecords(name); err != nil {
+			return err
+		}
+		_, err := s.storage.DeleteZone(name)
+		return err
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if f.storeErr != nil {
+		return f.storeErr
+	}
+
+	// one record that can't be refreshed mustn't hold up the rest
+	reported := map[string]bool{}
+	failures := []string{}
+	for _, r := range records {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		reported[r.Domain+"/"+r.Type] = true
+		if err := s.refreshRecord(ctx, r); err != nil {
+			log.Printf("problem refreshing %s record %s in zone %s: %v", r.Type, r.Domain, name, err)
+			failures = append(failures, fmt.Sprintf("%s %s: %v", r.Domain, r.Type, err))
+		}
+	}
+	var failed error
+	if len(failures) > 0 {
+		failed = fmt.Errorf("%d of %d records couldn't be refreshed: %s", len(failures), len(records), strings.Join(failures, "; "))
+	}
+
+	// the zone's summaries show records we haven't cached coming and going
+	if cached == nil {
+		return failed
+	}
+	before := map[string]*dns.ZoneRecord{}
+	for _, zr := range cached.Records {
+		before[zr.Domain+"/"+zr.Type] = zr
+	}
+	after := map[string]*dns.ZoneRecord{}
+	for _, zr := range f.zone.Records {
+		after[zr.Domain+"/"+zr.Type] = zr
+	}
+	for key, zr := range after {
+		if before[key] == nil && !reported[key] {
+			s.drifted(Drift{Change: Added, Zone: name, Domain: zr.Domain, Type: zr.Type, After: summaryRecord(name, zr)})
+		}
+	}
+	for key, zr := range before {
+		if after[key] == nil && !reported[key] {
+			s.drifted(Drift{Change: Deleted, Zone: name, Domain: zr.Domain, Type: zr.Type, Before: summaryRecord(name, zr)})
+		}
+	}
+	return failed
+}
+
+// refreshRecord re-fetches a cached record, reporting it if it's changed
+func (s *Server) refreshRecord(ctx context.Context, cached *dns.Record) error {
+	f := s.fetchRecord(ctx, cached.Zone, cached.Domain, cached.Type)
+	if f.err == ns1.ErrRecordMissing {
+		s.drifted(Drift{Change: Deleted, Zone: cached.Zone, Domain: cached.Domain, Type: cached.Type, Before: cached})
+		_, err := s.storage.DeleteRecord(cached.Zone, cached.Domain, cached.Type)
+		return err
+	}
+	if f.err != nil {
+		return f.err
+	}
+	if f.storeErr != nil {
+		return f.storeErr
+	}
+	if !storage.SameRecord(cached, f.record) {
+		s.drifted(Drift{Change: Changed, Zone: cached.Zone, Domain: cached.Domain, Type: cached.Type, Before: cached, After: f.record})
+	}
+	return nil
+}
+
+// drifted reports a Drift in the log, the metrics and at /drift
+func (s *Server) drifted(d Drift) {
+	d.Time = time.Now().UTC()
+	s.drift.add(d)
+	s.metrics.drift.WithLabelValues(d.Change).Inc()
+	if d.Domain == "" {
+		log.Printf("drift: zone %s %s at NS1", d.Zone, d.Change)
+		return
+	}
+	log.Printf("drift: %s record %s in zone %s %s at NS1", d.Type, d.Domain, d.Zone, d.Change)
+}
+
+func (s *Server) queryDrift(rw http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	since := time.Time{}
+	if param := query.Get("since"); param != "" {
+		t, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			fail(rw, 400, CodeBadRequest, "since parameter must be an RFC 3339 time: %v", err)
+			return
+		}
+		since = t
+	}
+
+	writeJSON(rw, s.drift.query(query.Get("zone"), since))
+}
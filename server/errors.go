@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
+)
+
+// Codes for ErrorResponses. They're stable, so clients may rely on them.
+const (
+	// CodeBadRequest is for requests missing parameters, or with malformed ones or bodies
+	CodeBadRequest = "bad_request"
+	// CodeInvalidAnswers is for records whose answers don't suit their type
+	CodeInvalidAnswers = "invalid_answers"
+	// CodeUnauthenticated is for requests without a token we know
+	CodeUnauthenticated = "unauthenticated"
+	// CodeForbidden is for requests the token or policy doesn't allow
+	CodeForbidden = "forbidden"
+	// CodeNotFound is for zones, records and endpoints that don't exist
+	CodeNotFound = "not_found"
+	// CodeMethodNotAllowed is for methods an endpoint doesn't support
+	CodeMethodNotAllowed = "method_not_allowed"
+	// CodeConflict is for creating what NS1 says already exists
+	CodeConflict = "conflict"
+	// CodeNS1Rejected is for other requests NS1 refused
+	CodeNS1Rejected = "ns1_rejected"
+	// CodeRateLimited is for requests NS1 kept refusing for exceeding its rate limit
+	CodeRateLimited = "rate_limited"
+	// CodeNS1Unavailable is for requests NS1 couldn't be reached for, or failed
+	CodeNS1Unavailable = "ns1_unavailable"
+	// CodeStorage is for problems with this server's cache
+	CodeStorage = "storage_error"
+	// CodeInternal is for anything else that went wrong in this server
+	CodeInternal = "internal_error"
+)
+
+// ErrorResponse is the body of every error response from the server
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// NS1Status is the status NS1 answered with, if the error came from NS1
+	NS1Status int    `json:"ns1_status,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+	// Details elaborates on some codes, e.g. the validate.Errors for CodeInvalidAnswers
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *ErrorResponse) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+	}
+	return fmt.Sprintf("%s (%s, request %s)", e.Message, e.Code, e.RequestID)
+}
+
+// writeError responds with e, filling in the request ID identify gave the response
+func writeError(rw http.ResponseWriter, status int, e ErrorResponse) {
+	e.RequestID = rw.Header().Get("X-Request-Id")
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(e)
+}
+
+// fail responds with an ErrorResponse with a formatted message
+func fail(rw http.ResponseWriter, status int, code, format string, args ...interface{}) {
+	writeError(rw, status, ErrorResponse{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// writeJSON responds with v, or an error if it can't be serialized. It's
+// serialized in full first, so that a status hasn't already been sent if
+// that fails.
+func writeJSON(rw http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		fail(rw, 500, CodeInternal, "problem serializing response: %v", err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(append(body, '\n'))
+}
+
+func methodNotAllowed(rw http.ResponseWriter) {
+	fail(rw, 405, CodeMethodNotAllowed, "method not allowed")
+}
+
+// ns1Failure responds to a request NS1 didn't fulfil. NS1's status is
+// passed on, unless NS1 couldn't be reached or refused our API key.
+func ns1Failure(rw http.ResponseWriter, rz *http.Response, err error) {
+	limited := &RateLimitError{}
+	switch {
+	case rz == nil && errors.As(err, &limited):
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limited.RetryAfter.Seconds()))))
+		writeError(rw, 429, ErrorResponse{Code: CodeRateLimited, Message: err.Error(), NS1Status: 429})
+	case rz == nil:
+		fail(rw, 503, CodeNS1Unavailable, "problem reaching NS1: %v", err)
+	default:
+		status := rz.StatusCode
+		if status == 401 || status == 403 {
+			// it's our key NS1 doesn't like, not the client's token
+			status = 502
+		}
+		writeError(rw, status, ErrorResponse{Code: ns1Code(rz.StatusCode, err), Message: "NS1: " + err.Error(), NS1Status: rz.StatusCode})
+	}
+}
+
+func ns1Code(status int, err error) string {
+	switch {
+	case err == ns1.ErrZoneExists || err == ns1.ErrRecordExists:
+		return CodeConflict
+	case status == 404:
+		return CodeNotFound
+	case status == 409:
+		return CodeConflict
+	case status == 429:
+		return CodeRateLimited
+	case status == 401 || status == 403 || status >= 500:
+		return CodeNS1Unavailable
+	default:
+		return CodeNS1Rejected
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	mdns "github.com/miekg/dns"
+)
+
+// Journal remembers the changes the DNS server has seen to each zone, so
+// that secondaries can be sent just what changed (IXFR, RFC 1995). A zone's
+// serial starts as NS1's, and counts up whenever its records change. A
+// Journal from LoadJournal is saved to its file as it changes, so that
+// serials never go backwards across a restart; otherwise it's kept in memory.
+type Journal struct {
+	mu    sync.Mutex
+	path  string
+	max   int
+	zones map[string]*zoneJournal
+}
+
+type zoneJournal struct {
+	Serial uint32 `json:"serial"`
+	// RRs are the zone's current RRs, in presentation format
+	RRs     []string     `json:"rrs"`
+	Changes []zoneChange `json:"changes,omitempty"`
+}
+
+// zoneChange is what changed between two serials of a zone
+type zoneChange struct {
+	From    uint32   `json:"from"`
+	To      uint32   `json:"to"`
+	Deleted []string `json:"deleted,omitempty"`
+	Added   []string `json:"added,omitempty"`
+}
+
+func newJournal() *Journal {
+	return &Journal{max: 100, zones: map[string]*zoneJournal{}}
+}
+
+// LoadJournal reads the journal saved at path, or starts an empty one if
+// there isn't one yet, and saves it there as it changes
+func LoadJournal(path string) (*Journal, error) {
+	j := newJournal()
+	j.path = path
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&j.zones); err != nil {
+		return nil, err
+	}
+	if j.zones == nil {
+		j.zones = map[string]*zoneJournal{}
+	}
+	return j, nil
+}
+
+// SetJournal has the DNS server number zones' versions with j, e.g. one
+// from LoadJournal
+func SetJournal(j *Journal) Option {
+	return func(s *Server) {
+		s.journal = j
+	}
+}
+
+// observe notes a zone's current RRs, returning the serial they're known by
+func (j *Journal) observe(apex string, upstream uint32, rrs []mdns.RR) uint32 {
+	current := map[string]bool{}
+	for _, rr := range rrs {
+		current[rr.String()] = true
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	zj, seen := j.zones[apex]
+	if !seen {
+		j.zones[apex] = &zoneJournal{Serial: upstream, RRs: sorted(current)}
+		j.save()
+		return upstream
+	}
+
+	had := map[string]bool{}
+	for _, rr := range zj.RRs {
+		had[rr] = true
+	}
+	change := zoneChange{From: zj.Serial, To: zj.Serial + 1}
+	for rr := range had {
+		if !current[rr] {
+			change.Deleted = append(change.Deleted, rr)
+		}
+	}
+	for rr := range current {
+		if !had[rr] {
+			change.Added = append(change.Added, rr)
+		}
+	}
+	if len(change.Deleted) == 0 && len(change.Added) == 0 {
+		return zj.Serial
+	}
+
+	if serialAfter(upstream, change.To) {
+		change.To = upstream
+	}
+	sort.Strings(change.Deleted)
+	sort.Strings(change.Added)
+	zj.Serial, zj.RRs = change.To, sorted(current)
+	zj.Changes = append(zj.Changes, change)
+	if over := len(zj.Changes) - j.max; over > 0 {
+		zj.Changes = append([]zoneChange{}, zj.Changes[over:]...)
+	}
+	j.save()
+	return zj.Serial
+}
+
+// between returns the changes that lead from one serial of a zone to
+// another, or false if the journal doesn't reach back that far
+func (j *Journal) between(apex string, from, to uint32) ([]zoneChange, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	zj, seen := j.zones[apex]
+	if !seen {
+		return nil, false
+	}
+
+	changes := []zoneChange{}
+	for _, c := range zj.Changes {
+		if len(changes) == 0 && c.From != from {
+			continue
+		}
+		changes = append(changes, c)
+		if c.To == to {
+			return changes, true
+		}
+	}
+	return nil, false
+}
+
+// save writes the journal to its file, if it has one. A failure is only
+// logged: the DNS server carries on, but serials may repeat after a restart.
+func (j *Journal) save() {
+	if j.path == "" {
+		return
+	}
+	if err := j.store(); err != nil {
+		log.Printf("problem saving DNS journal: %v", err)
+	}
+}
+
+// store writes a temporary file and renames it over the real one, so a crash
+// part way through leaves the previous journal intact
+func (j *Journal) store() error {
+	f, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+
+	if err := json.NewEncoder(f).Encode(j.zones); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), j.path)
+}
+
+func sorted(set map[string]bool) []string {
+	list := []string{}
+	for key := range set {
+		list = append(list, key)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// parseRRs parses RRs the journal kept in presentation format
+func parseRRs(texts []string) ([]mdns.RR, error) {
+	rrs := []mdns.RR{}
+	for _, text := range texts {
+		rr, err := mdns.NewRR(text)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
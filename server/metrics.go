@@ -0,0 +1,270 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nyarly/dns-manager/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// metrics are the Prometheus collectors a Server reports on. Each Server has
+// its own registry, so that several can run in one process (e.g. in tests).
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	cacheLookups    *prometheus.CounterVec
+	ns1Duration     *prometheus.HistogramVec
+	ns1Errors       *prometheus.CounterVec
+	storageDuration *prometheus.HistogramVec
+	drift           *prometheus.CounterVec
+	refreshErrors   prometheus.Counter
+	lastRefresh     prometheus.Gauge
+	dnsQueries      *prometheus.CounterVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_manager_http_requests_total",
+			Help: "Requests served, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dns_manager_http_request_duration_seconds",
+			Help:    "Time taken to serve requests, by route, method and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method", "status"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_manager_cache_lookups_total",
+			Help: "Lookups of zones and records in the cache, by kind and whether they were found.",
+		}, []string{"kind", "result"}),
+		ns1Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dns_manager_ns1_request_duration_seconds",
+			Help:    "Time taken by requests to the NS1 API, by endpoint, method and status.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"endpoint", "method", "status"}),
+		ns1Errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_manager_ns1_errors_total",
+			Help: "Requests to the NS1 API that failed or got an error status, by endpoint and status.",
+		}, []string{"endpoint", "status"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "dns_manager_storage_operation_duration_seconds",
+			Help:    "Time taken by storage operations, by operation.",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+		}, []string{"operation"}),
+		drift: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_manager_drift_total",
+			Help: "Changes found at NS1 that weren't made through this server, by kind of change.",
+		}, []string{"change"}),
+		refreshErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dns_manager_refresh_errors_total",
+			Help: "Background refreshes of the cache that failed, in whole or in part.",
+		}),
+		lastRefresh: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dns_manager_refresh_last_success_timestamp_seconds",
+			Help: "When the cache was last refreshed from NS1 without error.",
+		}),
+		dnsQueries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_manager_dns_queries_total",
+			Help: "DNS queries answered, by query type and response code.",
+		}, []string{"type", "rcode"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.cacheLookups, m.ns1Duration, m.ns1Errors, m.storageDuration,
+		m.drift, m.refreshErrors, m.lastRefresh, m.dnsQueries,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// statusRecorder remembers the status a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = 200
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// instrument counts and times requests, labelled with the mux pattern they
+// were routed by rather than their full path, to keep the labels few
+func (m *metrics) instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(recorder, req)
+
+		if recorder.status == 0 {
+			recorder.status = 200
+		}
+		_, route := mux.Handler(req)
+		labels := prometheus.Labels{
+			"route":  route,
+			"method": req.Method,
+			"status": strconv.Itoa(recorder.status),
+		}
+		m.requests.With(labels).Inc()
+		m.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// instrumentedDoer times requests to NS1
+type instrumentedDoer struct {
+	ns1.Doer
+	metrics *metrics
+}
+
+func (d instrumentedDoer) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	rz, err := d.Doer.Do(req)
+
+	endpoint := ns1Endpoint(req.URL.Path)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(rz.StatusCode)
+	}
+	d.metrics.ns1Duration.WithLabelValues(endpoint, req.Method, status).Observe(time.Since(start).Seconds())
+	if err != nil || rz.StatusCode >= 400 {
+		d.metrics.ns1Errors.WithLabelValues(endpoint, status).Inc()
+	}
+	return rz, err
+}
+
+// ns1Endpoint replaces the names in an NS1 API path with placeholders,
+// e.g. /v1/zones/example.com becomes /v1/zones/:zone
+func ns1Endpoint(path string) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[1] != "zones" {
+		return path
+	}
+	placeholders := []string{":zone", ":domain", ":type"}
+	for i := 2; i < len(parts) && i-2 < len(placeholders); i++ {
+		parts[i] = placeholders[i-2]
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// instrumentedStorage times every storage operation, and counts cache hits
+// and misses for zones and records
+type instrumentedStorage struct {
+	storage.Storage
+	metrics *metrics
+}
+
+func (s instrumentedStorage) time(operation string) func() {
+	start := time.Now()
+	return func() {
+		s.metrics.storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (s instrumentedStorage) lookup(kind string, found bool) {
+	result := "miss"
+	if found {
+		result = "hit"
+	}
+	s.metrics.cacheLookups.WithLabelValues(kind, result).Inc()
+}
+
+func (s instrumentedStorage) GetZone(name string) (*dns.Zone, error) {
+	defer s.time("GetZone")()
+	zone, err := s.Storage.GetZone(name)
+	if err == nil {
+		s.lookup("zone", zone != nil)
+	}
+	return zone, err
+}
+
+func (s instrumentedStorage) RecordZone(zone dns.Zone) (bool, error) {
+	defer s.time("RecordZone")()
+	return s.Storage.RecordZone(zone)
+}
+
+func (s instrumentedStorage) DeleteZone(name string) (bool, error) {
+	defer s.time("DeleteZone")()
+	return s.Storage.DeleteZone(name)
+}
+
+func (s instrumentedStorage) ListZones() ([]*dns.Zone, error) {
+	defer s.time("ListZones")()
+	return s.Storage.ListZones()
+}
+
+func (s instrumentedStorage) ListAllZones() ([]*dns.Zone, error) {
+	defer s.time("ListAllZones")()
+	return s.Storage.ListAllZones()
+}
+
+func (s instrumentedStorage) RecordSummary(zone string, summary dns.ZoneRecord) (bool, error) {
+	defer s.time("RecordSummary")()
+	return s.Storage.RecordSummary(zone, summary)
+}
+
+func (s instrumentedStorage) DeleteSummary(zone, domain, kind string) (bool, error) {
+	defer s.time("DeleteSummary")()
+	return s.Storage.DeleteSummary(zone, domain, kind)
+}
+
+func (s instrumentedStorage) GetRecord(zone, domain, kind string) (*dns.Record, error) {
+	defer s.time("GetRecord")()
+	record, err := s.Storage.GetRecord(zone, domain, kind)
+	if err == nil {
+		s.lookup("record", record != nil)
+	}
+	return record, err
+}
+
+func (s instrumentedStorage) RecordRecord(record dns.Record) (bool, error) {
+	defer s.time("RecordRecord")()
+	return s.Storage.RecordRecord(record)
+}
+
+func (s instrumentedStorage) DeleteRecord(zone, domain, kind string) (bool, error) {
+	defer s.time("DeleteRecord")()
+	return s.Storage.DeleteRecord(zone, domain, kind)
+}
+
+func (s instrumentedStorage) ListRecords(zone string) ([]*dns.Record, error) {
+	defer s.time("ListRecords")()
+	return s.Storage.ListRecords(zone)
+}
+
+func (s instrumentedStorage) ListAllRecords(zone string) ([]*dns.Record, error) {
+	defer s.time("ListAllRecords")()
+	return s.Storage.ListAllRecords(zone)
+}
+
+func (s instrumentedStorage) DeleteZoneRecords(zone string) (bool, error) {
+	defer s.time("DeleteZoneRecords")()
+	return s.Storage.DeleteZoneRecords(zone)
+}
+
+func (s instrumentedStorage) RecordHistory(zone, domain, kind string) ([]storage.RecordVersion, error) {
+	defer s.time("RecordHistory")()
+	return s.Storage.RecordHistory(zone, domain, kind)
+}
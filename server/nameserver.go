@@ -0,0 +1,359 @@
+package server
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/nyarly/dns-manager/zonefile"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// maxChain is how many CNAMEs we follow within a zone before giving up
+const maxChain = 8
+
+// SetDNS makes Start also answer DNS queries, over UDP and TCP on address,
+// for the zones in the cache. Answers come from the cache rather than NS1, so
+// they carry on if NS1 can't be reached.
+func SetDNS(address string) Option {
+	return func(s *Server) {
+		s.dnsAddress = address
+	}
+}
+
+// listenDNS binds the DNS listeners, so that Start can report a clash at once
+func (s *Server) listenDNS() ([]*mdns.Server, error) {
+	handler := mdns.HandlerFunc(s.serveDNS)
+	pc, err := net.ListenPacket("udp", s.dnsAddress)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", s.dnsAddress)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	secrets := s.tsigKeys.secrets()
+	return []*mdns.Server{
+		{PacketConn: pc, Handler: handler, TsigSecret: secrets, MsgAcceptFunc: s.acceptDNS},
+		{Listener: l, Handler: handler, TsigSecret: secrets, MsgAcceptFunc: s.acceptDNS},
+	}, nil
+}
+
+// startDNS starts servers serving, sending the error each stops with to failed
+func startDNS(servers []*mdns.Server, failed chan<- error) error {
+	for _, d := range servers {
+		started := make(chan struct{})
+		d.NotifyStartedFunc = func() { close(started) }
+		stopped := make(chan error, 1)
+		go func(d *mdns.Server) { stopped <- d.ActivateAndServe() }(d)
+		select {
+		case <-started:
+			go func() { failed <- <-stopped }()
+		case err := <-stopped:
+			return err
+		}
+	}
+	return nil
+}
+
+func shutdownDNS(servers []*mdns.Server) {
+	for _, d := range servers {
+		d.Shutdown()
+	}
+}
+
+func (s *Server) serveDNS(w mdns.ResponseWriter, req *mdns.Msg) {
+	kind := "none"
+	switch {
+	case req.Opcode == mdns.OpcodeUpdate:
+		kind = "UPDATE"
+	case len(req.Question) > 0:
+		kind = mdns.TypeToString[req.Question[0].Qtype]
+	}
+
+	if _, err := s.tsigKeys.signer(w, req); err != nil {
+		s.metrics.dnsQueries.WithLabelValues(kind, mdns.RcodeToString[mdns.RcodeNotAuth]).Inc()
+		w.WriteMsg(new(mdns.Msg).SetRcode(req, mdns.RcodeNotAuth))
+		return
+	}
+	if req.Opcode == mdns.OpcodeQuery && len(req.Question) == 1 {
+		if t := req.Question[0].Qtype; t == mdns.TypeAXFR || t == mdns.TypeIXFR {
+			rcode := s.serveTransfer(w, req)
+			s.metrics.dnsQueries.WithLabelValues(kind, mdns.RcodeToString[rcode]).Inc()
+			return
+		}
+	}
+
+	var m *mdns.Msg
+	if req.Opcode == mdns.OpcodeUpdate && s.dnsUpdate {
+		m = s.serveUpdate(w, req)
+	} else {
+		m = s.answerDNS(req)
+	}
+
+	size := mdns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), false)
+		if int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+	}
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+		m.Truncate(size)
+	}
+	// the signature goes last, and is made as the response is written
+	if tsig := req.IsTsig(); tsig != nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+	}
+
+	s.metrics.dnsQueries.WithLabelValues(kind, mdns.RcodeToString[m.Rcode]).Inc()
+	w.WriteMsg(m)
+}
+
+// answerDNS answers a query from the zones we have cached
+func (s *Server) answerDNS(req *mdns.Msg) *mdns.Msg {
+	m := new(mdns.Msg)
+	if req.Opcode != mdns.OpcodeQuery {
+		return m.SetRcode(req, mdns.RcodeNotImplemented)
+	}
+	if len(req.Question) != 1 || req.Question[0].Qclass != mdns.ClassINET {
+		return m.SetRcode(req, mdns.RcodeRefused)
+	}
+	m.SetReply(req)
+	q := req.Question[0]
+
+	z, err := s.authorityFor(q.Name)
+	if err != nil {
+		return m.SetRcode(req, mdns.RcodeServerFailure)
+	}
+	if z == nil {
+		return m.SetRcode(req, mdns.RcodeRefused)
+	}
+	z.answer(m, q.Name, q.Qtype)
+	return m
+}
+
+// authority is a zone's resource records, ready to answer queries from
+type authority struct {
+	apex string
+	soa  *mdns.SOA
+	// names holds every RR in the zone, keyed by lower case owner name
+	names map[string][]mdns.RR
+}
+
+func newAuthority(zone *dns.Zone, records []*dns.Record) *authority {
+	z := &authority{
+		apex:  strings.ToLower(mdns.Fqdn(zone.Zone)),
+		soa:   zonefile.SOA(zone),
+		names: map[string][]mdns.RR{},
+	}
+	z.names[z.apex] = []mdns.RR{z.soa}
+
+	apexNS := false
+	for _, r := range records {
+		rrs, err := zonefile.ToRRs(r)
+		if err != nil {
+			// e.g. NS1's ALIAS, which has no plain DNS representation
+			continue
+		}
+		for _, rr := range rrs {
+			owner := strings.ToLower(rr.Header().Name)
+			z.names[owner] = append(z.names[owner], rr)
+			apexNS = apexNS || (owner == z.apex && rr.Header().Rrtype == mdns.TypeNS)
+		}
+	}
+	if !apexNS {
+		for _, ns := range zone.DNSServers {
+			z.names[z.apex] = append(z.names[z.apex], &mdns.NS{
+				Hdr: mdns.RR_Header{Name: z.apex, Rrtype: mdns.TypeNS, Class: mdns.ClassINET, Ttl: uint32(zone.TTL)},
+				Ns:  mdns.Fqdn(ns),
+			})
+		}
+	}
+	return z
+}
+
+// records returns every RR in the zone but its SOA, apex first
+func (z *authority) records() []mdns.RR {
+	owners := []string{}
+	for owner := range z.names {
+		if owner != z.apex {
+			owners = append(owners, owner)
+		}
+	}
+	sort.Strings(owners)
+
+	rrs := []mdns.RR{}
+	for _, owner := range append([]string{z.apex}, owners...) {
+		for _, rr := range z.names[owner] {
+			if rr != mdns.RR(z.soa) {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return rrs
+}
+
+// answer fills in m's answer, authority and additional sections for a query
+func (z *authority) answer(m *mdns.Msg, qname string, qtype uint16) {
+	m.Authoritative = true
+	name := strings.ToLower(mdns.Fqdn(qname))
+	owner := mdns.Fqdn(qname)
+
+	for i := 0; i < maxChain; i++ {
+		if cut := z.delegation(name); cut != "" {
+			if i == 0 {
+				z.refer(m, cut)
+			}
+			return
+		}
+
+		rrs, exists := z.lookup(name)
+		if !exists {
+			m.Rcode = mdns.RcodeNameError
+			m.Ns = []mdns.RR{z.negative()}
+			return
+		}
+
+		if matching := only(rrs, qtype); len(matching) > 0 {
+			m.Answer = append(m.Answer, renamed(matching, owner)...)
+			if !(name == z.apex && qtype == mdns.TypeNS) {
+				m.Ns = only(z.names[z.apex], mdns.TypeNS)
+			}
+			m.Extra = z.additional(matching)
+			return
+		}
+
+		cname := only(rrs, mdns.TypeCNAME)
+		if len(cname) == 0 {
+			// the name exists, but hasn't any records of this type
+			m.Ns = []mdns.RR{z.negative()}
+			return
+		}
+		m.Answer = append(m.Answer, renamed(cname, owner)...)
+		owner = cname[0].(*mdns.CNAME).Target
+		name = strings.ToLower(owner)
+		if !mdns.IsSubDomain(z.apex, name) {
+			// someone else's to answer
+			return
+		}
+	}
+}
+
+// lookup returns the RRs at name, synthesizing them from a wildcard if need
+// be, and whether the name exists at all - it may exist without any RRs, if
+// there are names below it.
+func (z *authority) lookup(name string) ([]mdns.RR, bool) {
+	if rrs, has := z.names[name]; has {
+		return rrs, true
+	}
+	if z.hasDescendants(name) {
+		return nil, true
+	}
+
+	// a wildcard at the closest encloser stands in for names that don't exist
+	for off, end := mdns.NextLabel(name, 0); !end; off, end = mdns.NextLabel(name, off) {
+		encloser := name[off:]
+		if _, has := z.names[encloser]; !has && !z.hasDescendants(encloser) {
+			continue
+		}
+		if rrs, has := z.names["*."+encloser]; has {
+			return rrs, true
+		}
+		break
+	}
+	return nil, false
+}
+
+func (z *authority) hasDescendants(name string) bool {
+	for owner := range z.names {
+		if strings.HasSuffix(owner, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// delegation returns the name at or above name, below the apex, that has
+// NS records - if there is one, name belongs to another zone
+func (z *authority) delegation(name string) string {
+	cut := ""
+	for off, end := 0, false; !end; off, end = mdns.NextLabel(name, off) {
+		ancestor := name[off:]
+		if ancestor == z.apex || !mdns.IsSubDomain(z.apex, ancestor) {
+			break
+		}
+		if len(only(z.names[ancestor], mdns.TypeNS)) > 0 {
+			cut = ancestor
+		}
+	}
+	return cut
+}
+
+// refer points the client at the name servers for a delegated name
+func (z *authority) refer(m *mdns.Msg, cut string) {
+	m.Authoritative = false
+	m.Ns = only(z.names[cut], mdns.TypeNS)
+	m.Extra = z.additional(m.Ns)
+}
+
+// additional returns the addresses we have for the names rrs point at
+func (z *authority) additional(rrs []mdns.RR) []mdns.RR {
+	extra := []mdns.RR{}
+	for _, rr := range rrs {
+		target := ""
+		switch rr := rr.(type) {
+		case *mdns.NS:
+			target = rr.Ns
+		case *mdns.MX:
+			target = rr.Mx
+		case *mdns.SRV:
+			target = rr.Target
+		}
+		if target == "" {
+			continue
+		}
+		for _, addr := range z.names[strings.ToLower(target)] {
+			if t := addr.Header().Rrtype; t == mdns.TypeA || t == mdns.TypeAAAA {
+				extra = append(extra, addr)
+			}
+		}
+	}
+	return extra
+}
+
+// negative is the SOA for the authority section of an NXDOMAIN or NODATA
+// response, whose TTL is how long the absence may be cached (RFC 2308)
+func (z *authority) negative() mdns.RR {
+	soa := mdns.Copy(z.soa).(*mdns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	return soa
+}
+
+// only returns the RRs of one type, or all of them for ANY
+func only(rrs []mdns.RR, kind uint16) []mdns.RR {
+	matching := []mdns.RR{}
+	for _, rr := range rrs {
+		if kind == mdns.TypeANY || rr.Header().Rrtype == kind {
+			matching = append(matching, rr)
+		}
+	}
+	return matching
+}
+
+// renamed copies rrs with the owner name the client asked about, which
+// matters for wildcards, and preserves the case the client used
+func renamed(rrs []mdns.RR, owner string) []mdns.RR {
+	out := []mdns.RR{}
+	for _, rr := range rrs {
+		rr = mdns.Copy(rr)
+		rr.Header().Name = owner
+		out = append(out, rr)
+	}
+	return out
+}
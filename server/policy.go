@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The verbs a policy Rule can cover
+const (
+	UpdateZone   = "update-zone"
+	DeleteZone   = "delete-zone"
+	UpdateRecord = "update-record"
+	DeleteRecord = "delete-record"
+)
+
+// Rule allows or denies a set of changes. Each list is of globs, as for
+// path.Match, any one of which must match; an empty list matches anything.
+// Rules with Domains or Types only match changes to records.
+type Rule struct {
+	Name       string   `yaml:"name"`
+	Effect     string   `yaml:"effect"` // "allow" or "deny"
+	Principals []string `yaml:"principals,omitempty"`
+	Verbs      []string `yaml:"verbs,omitempty"`
+	Zones      []string `yaml:"zones,omitempty"`
+	Domains    []string `yaml:"domains,omitempty"`
+	Types      []string `yaml:"types,omitempty"`
+}
+
+// Access is a change a principal wants to make. Domain and Type are empty
+// for changes to zones.
+type Access struct {
+	Principal string
+	Verb      string
+	Zone      string
+	Domain    string
+	Type      string
+}
+
+func (a Access) String() string {
+	who := a.Principal
+	if who == "" {
+		who = "anonymous"
+	}
+	if a.Domain == "" {
+		return fmt.Sprintf("%s to %s %s", who, a.Verb, a.Zone)
+	}
+	return fmt.Sprintf("%s to %s %s %s in %s", who, a.Verb, a.Domain, a.Type, a.Zone)
+}
+
+// Denial is the error a Policy gives for an Access it doesn't allow.
+// Rule is empty if no rule matched at all.
+type Denial struct {
+	Rule   string
+	Access Access
+}
+
+func (d Denial) Error() string {
+	if d.Rule == "" {
+		return fmt.Sprintf("no rule allows %s", d.Access)
+	}
+	return fmt.Sprintf("rule %q denies %s", d.Rule, d.Access)
+}
+
+// Policy is an ordered list of Rules loaded from a file:
+//
+//	rules:
+//	- name: ci-staging
+//	  effect: allow
+//	  principals: [ci]
+//	  verbs: [update-record, delete-record]
+//	  zones: [staging.example.com]
+//	- name: ops
+//	  effect: allow
+//	  principals: [ops]
+//
+// The first Rule to match a change decides it; changes no Rule matches are denied.
+type Policy struct {
+	path  string
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+// LoadPolicy reads a Policy from path
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Reload re-reads the Policy's file. If the file can't be used, the rules
+// already loaded stay in force.
+func (p *Policy) Reload() error {
+	rules, err := readRules(p.path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rules = rules
+	return nil
+}
+
+func readRules(file string) ([]Rule, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc := struct {
+		Rules []Rule `yaml:"rules"`
+	}{}
+	dec := yaml.NewDecoder(f)
+	// a misspelt key would widen its rule to match anything
+	dec.SetStrict(true)
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	verbs := map[string]bool{UpdateZone: true, DeleteZone: true, UpdateRecord: true, DeleteRecord: true}
+	for i, r := range doc.Rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("%s: rule %d has no name", file, i+1)
+		}
+		if r.Effect != "allow" && r.Effect != "deny" {
+			return nil, fmt.Errorf("%s: rule %q: effect must be allow or deny, not %q", file, r.Name, r.Effect)
+		}
+		for _, globs := range [][]string{r.Principals, r.Verbs, r.Zones, r.Domains, r.Types} {
+			for _, g := range globs {
+				if _, err := path.Match(g, ""); err != nil {
+					return nil, fmt.Errorf("%s: rule %q: bad pattern %q", file, r.Name, g)
+				}
+			}
+		}
+		for _, v := range r.Verbs {
+			if !strings.ContainsAny(v, "*?[") && !verbs[v] {
+				return nil, fmt.Errorf("%s: rule %q: unknown verb %q", file, r.Name, v)
+			}
+		}
+	}
+	return doc.Rules, nil
+}
+
+// Check returns nil if a is allowed, or a Denial
+func (p *Policy) Check(a Access) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, r := range p.rules {
+		if !r.matches(a) {
+			continue
+		}
+		if r.Effect == "allow" {
+			return nil
+		}
+		return Denial{Rule: r.Name, Access: a}
+	}
+	return Denial{Access: a}
+}
+
+func (r Rule) matches(a Access) bool {
+	if a.Domain == "" && (len(r.Domains) > 0 || len(r.Types) > 0) {
+		return false
+	}
+	same := func(s string) string { return s }
+	return anyMatch(r.Principals, a.Principal, same) &&
+		anyMatch(r.Verbs, a.Verb, same) &&
+		anyMatch(r.Zones, a.Zone, normalName) &&
+		anyMatch(r.Domains, a.Domain, normalName) &&
+		anyMatch(r.Types, a.Type, strings.ToUpper)
+}
+
+// anyMatch reports whether s matches any of globs, once both are normalized
+func anyMatch(globs []string, s string, normal func(string) string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, g := range globs {
+		if ok, _ := path.Match(normal(g), normal(s)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func normalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// SetPolicy restricts the changes each principal may make.
+// Without it, anyone the server accepts requests from may change anything.
+func SetPolicy(p *Policy) Option {
+	return func(s *Server) {
+		s.policy = p
+	}
+}
+
+// allowed checks a change against the Server's policy on behalf of the
+// principal that made the request ctx belongs to
+func (s *Server) allowed(ctx context.Context, verb, zone, domain, kind string) error {
+	if s.policy == nil {
+		return nil
+	}
+	return s.policy.Check(Access{
+		Principal: principal(ctx),
+		Verb:      verb,
+		Zone:      zone,
+		Domain:    domain,
+		Type:      kind,
+	})
+}
+
+// allowedAny checks whether the policy allows any of verbs, returning the
+// first one's denial if none are
+func (s *Server) allowedAny(ctx context.Context, verbs []string, zone, domain, kind string) error {
+	var denied error
+	for _, verb := range verbs {
+		err := s.allowed(ctx, verb, zone, domain, kind)
+		if err == nil {
+			return nil
+		}
+		if denied == nil {
+			denied = err
+		}
+	}
+	return denied
+}
+
+// authorize answers 403 and returns false unless the policy allows a change
+func (s *Server) authorize(rw http.ResponseWriter, req *http.Request, verb, zone, domain, kind string) bool {
+	if err := s.allowed(req.Context(), verb, zone, domain, kind); err != nil {
+		fail(rw, 403, CodeForbidden, "%v", err)
+		return false
+	}
+	return true
+}
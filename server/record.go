@@ -5,7 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"github.com/nyarly/dns-manager/validate"
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
 	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
 )
 
@@ -16,8 +20,7 @@ func getRecordParams(rw http.ResponseWriter, req *http.Request) (string, string,
 	kind := query.Get("type")     // TODO handle errors here
 
 	if zone == "" || domain == "" || kind == "" {
-		rw.WriteHeader(400)
-		fmt.Fprintf(rw, "parameters for zone, domain and kind are all required")
+		fail(rw, 400, CodeBadRequest, "parameters for zone, domain and kind are all required")
 		return "", "", ""
 	}
 
@@ -32,26 +35,21 @@ func (s *Server) getRecord(rw http.ResponseWriter, req *http.Request) {
 
 	existing, err := s.storage.GetRecord(name, domain, kind)
 	if err != nil {
-		rw.WriteHeader(503)
-		fmt.Fprintf(rw, "problem checking for zone: %v", err)
+		fail(rw, 503, CodeStorage, "problem checking for record: %v", err)
+		return
 	}
 
 	if existing != nil {
-		if err := json.NewEncoder(rw).Encode(existing); err != nil {
-			rw.WriteHeader(503)
-			fmt.Fprintf(rw, "problem serializing cached zone: %v", err)
-		}
+		writeJSON(rw, existing)
 		return
 	}
 
-	ctx := req.Context()
-	zone, rz, err := s.getRecordAPI(ctx, name, domain, kind)
-	if _, err := s.storage.RecordRecord(*zone); err != nil {
-		rw.WriteHeader(503)
-		fmt.Fprintf(rw, "problem recording zone: %v", err)
+	f := s.fetchRecord(req.Context(), name, domain, kind)
+	if f.storeErr != nil {
+		fail(rw, 503, CodeStorage, "problem recording record: %v", f.storeErr)
 		return
 	}
-	proxyAPIResponse(rw, rz, zone, err)
+	proxyAPIResponse(rw, f.rz, f.record, f.err)
 }
 
 func (s *Server) updateRecord(rw http.ResponseWriter, req *http.Request) {
@@ -59,38 +57,84 @@ func (s *Server) updateRecord(rw http.ResponseWriter, req *http.Request) {
 	if name == "" {
 		return
 	}
+	if !s.authorize(rw, req, UpdateRecord, name, domain, kind) {
+		return
+	}
 
 	existing, err := s.storage.GetRecord(name, domain, kind)
 	if err != nil {
-		rw.WriteHeader(503)
-		fmt.Fprintf(rw, "problem checking for zone: %v", err)
+		fail(rw, 503, CodeStorage, "problem checking for zone: %v", err)
 		return
 	}
 
 	answers := [][]string{}
 	if err := json.NewDecoder(req.Body).Decode(&answers); err != nil {
-		rw.WriteHeader(400)
-		fmt.Fprintf(rw, "body of request ill formed: %v\n", err)
+		fail(rw, 400, CodeBadRequest, "body of request ill formed: %v", err)
+		return
+	}
+	if err := validate.Answers(kind, answers); err != nil {
+		errs, ok := err.(validate.Errors)
+		if !ok {
+			fail(rw, 400, CodeBadRequest, "answers are not valid for a %s record: %v", kind, err)
+			return
+		}
+		writeError(rw, 422, ErrorResponse{
+			Code:    CodeInvalidAnswers,
+			Message: fmt.Sprintf("answers are not valid for a %s record", kind),
+			Details: errs,
+		})
 		return
 	}
 	record := buildRecord(name, domain, kind, answers)
 
+	if ttl := req.URL.Query().Get("ttl"); ttl != "" {
+		record.TTL, err = strconv.Atoi(ttl)
+		if err != nil {
+			fail(rw, 400, CodeBadRequest, "ttl parameter must be a number of seconds: %v", err)
+			return
+		}
+	}
+
 	ctx := req.Context()
+	var before interface{} = existing
 
 	var rz *http.Response
 	if existing == nil {
 		rz, err = s.createRecordAPI(ctx, record)
+		if err == ns1.ErrRecordExists {
+			// our cache had expired or never knew about it
+			before = unknownPrior{}
+			rz, err = s.updateRecordAPI(ctx, record)
+		}
 	} else {
 		rz, err = s.updateRecordAPI(ctx, record)
 	}
-	if _, err := s.storage.RecordRecord(*record); err != nil {
-		rw.WriteHeader(503)
-		fmt.Fprintf(rw, "problem recording zone: %v", err)
+	if err == nil {
+		if _, err := s.storage.RecordRecord(*record); err != nil {
+			fail(rw, 503, CodeStorage, "problem recording zone: %v", err)
+			return
+		}
+		if err := s.summarize(name, domain, kind, record); err != nil {
+			fail(rw, 503, CodeStorage, "problem updating zone: %v", err)
+			return
+		}
+		s.audit(ctx, UpdateRecord, name, domain, kind, before, record)
 	}
 
 	proxyAPIResponse(rw, rz, record, err)
 }
 
+// summarize brings a cached zone's summary of one of its records up to
+// date after the record is written, or removes it if record is nil
+func (s *Server) summarize(zone, domain, kind string, record *dns.Record) error {
+	if record == nil {
+		_, err := s.storage.DeleteSummary(zone, domain, kind)
+		return err
+	}
+	_, err := s.storage.RecordSummary(zone, recordSummary(record))
+	return err
+}
+
 func buildRecord(name, domain, kind string, answers [][]string) *dns.Record {
 	rr := dns.NewRecord(name, domain, kind)
 	for _, a := range answers {
@@ -105,12 +149,123 @@ func (s *Server) deleteRecord(rw http.ResponseWriter, req *http.Request) {
 	if name == "" {
 		return
 	}
+	if !s.authorize(rw, req, DeleteRecord, name, domain, kind) {
+		return
+	}
+
+	existing, err := s.storage.GetRecord(name, domain, kind)
+	if err != nil {
+		fail(rw, 503, CodeStorage, "problem checking for record: %v", err)
+		return
+	}
 
 	ctx := req.Context()
 	rz, err := s.deleteRecordAPI(ctx, name, domain, kind)
+	if err == nil {
+		if _, err := s.storage.DeleteRecord(name, domain, kind); err != nil {
+			fail(rw, 503, CodeStorage, "problem forgetting record: %v", err)
+			return
+		}
+		if err := s.summarize(name, domain, kind, nil); err != nil {
+			fail(rw, 503, CodeStorage, "problem updating zone: %v", err)
+			return
+		}
+		s.audit(ctx, DeleteRecord, name, domain, kind, priorRecord(existing), nil)
+	}
 	proxyAPIResponse(rw, rz, nil, err)
 }
 
+func (s *Server) recordHistory(rw http.ResponseWriter, req *http.Request) {
+	name, domain, kind := getRecordParams(rw, req)
+	if name == "" {
+		return
+	}
+
+	history, err := s.storage.RecordHistory(name, domain, kind)
+	if err != nil {
+		fail(rw, 503, CodeStorage, "problem reading record history: %v", err)
+		return
+	}
+
+	writeJSON(rw, history)
+}
+
+func getZoneRecordsName(rw http.ResponseWriter, req *http.Request) string {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/zones/"), "/"), "/")
+
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "records" {
+		fail(rw, 404, CodeNotFound, "no such resource: %s", req.URL.Path)
+		return ""
+	}
+
+	return parts[0]
+}
+
+func (s *Server) listRecords(rw http.ResponseWriter, req *http.Request) {
+	name := getZoneRecordsName(rw, req)
+	if name == "" {
+		return
+	}
+
+	ctx := req.Context()
+	records, rz, err := s.listRecordsAPI(ctx, name)
+	if rz == nil && err != nil && !fresh(req) {
+		// NS1 is unreachable - the best we can do is what we've seen
+		cached, cerr := s.storage.ListRecords(name)
+		if cerr == nil && len(cached) > 0 {
+			stale(rw)
+			writeJSON(rw, cached)
+			return
+		}
+	}
+	proxyAPIResponse(rw, rz, records, err)
+}
+
+// summaryRecord converts the abbreviated record NS1 lists with a zone into a
+// Record. Answers are reconstructed from their short form, so metadata and
+// filters are not present.
+func summaryRecord(zone string, zr *dns.ZoneRecord) *dns.Record {
+	rr := dns.NewRecord(zone, zr.Domain, zr.Type)
+	rr.ID = zr.ID
+	rr.TTL = zr.TTL
+	rr.Link = zr.Link
+	for _, short := range zr.ShortAns {
+		rdata := strings.Fields(short)
+		if zr.Type == "TXT" || zr.Type == "SPF" {
+			rdata = []string{short}
+		}
+		rr.AddAnswer(dns.NewAnswer(rdata))
+	}
+	return rr
+}
+
+// recordSummary is the inverse of summaryRecord
+func recordSummary(record *dns.Record) dns.ZoneRecord {
+	zr := dns.ZoneRecord{
+		Domain: record.Domain,
+		ID:     record.ID,
+		Link:   record.Link,
+		TTL:    record.TTL,
+		Type:   record.Type,
+	}
+	for _, a := range record.Answers {
+		zr.ShortAns = append(zr.ShortAns, strings.Join(a.Rdata, " "))
+	}
+	return zr
+}
+
+func (s *Server) listRecordsAPI(ctx context.Context, name string) ([]*dns.Record, *http.Response, error) {
+	zone, rz, err := s.ns1Client(ctx).Zones.Get(name)
+	if err != nil {
+		return nil, rz, err
+	}
+	records := []*dns.Record{}
+	for _, zr := range zone.Records {
+		records = append(records, summaryRecord(name, zr))
+	}
+	return records, rz, err
+}
+
 func (s *Server) getRecordAPI(ctx context.Context, name, domain, kind string) (*dns.Record, *http.Response, error) {
 	zone, rz, err := s.ns1Client(ctx).Records.Get(name, domain, kind)
 	return zone, rz, err
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
+)
+
+// RateLimitError is returned when NS1 is still refusing requests for
+// exceeding its rate limit after every retry
+type RateLimitError struct {
+	Attempts int
+	// RetryAfter is how long NS1's rate limit headers suggest waiting
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("NS1 rate limit exceeded on all %d attempts; try again in %v", e.Attempts, e.RetryAfter)
+}
+
+// Retrying wraps an httpClientFn for New, so that NS1 requests are paced by
+// NS1's X-Ratelimit headers, and retried with exponential backoff and jitter
+// when they fail. Requests refused with a 429 are always retried, since NS1
+// hasn't acted on them; other failures are only retried for reads, since a
+// write may have taken effect before it failed. Every client the returned
+// function makes shares one view of the rate limit.
+func Retrying(httpClientFn func(context.Context) ns1.Doer) func(context.Context) ns1.Doer {
+	r := &retrier{
+		attempts: 5,
+		base:     250 * time.Millisecond,
+		max:      10 * time.Second,
+		sleep:    sleepContext,
+		jitter:   func(d time.Duration) time.Duration { return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) },
+		now:      time.Now,
+	}
+	return func(ctx context.Context) ns1.Doer {
+		return retryingClient{retrier: r, next: httpClientFn(ctx), ctx: ctx}
+	}
+}
+
+type retrier struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+	sleep    func(context.Context, time.Duration) error
+	jitter   func(time.Duration) time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pause is how long to wait before the next request, to stay within the rate limit
+func (r *retrier) pause() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pausedUntil.Sub(r.now())
+}
+
+// observe notes NS1's rate limit headers. Once the budget is used up, the
+// next request waits for a slot to free up: a period's worth of time
+// divided by the number of requests allowed in a period.
+func (r *retrier) observe(rz *http.Response) {
+	remaining, err := strconv.Atoi(rz.Header.Get("X-Ratelimit-Remaining"))
+	if err != nil || (remaining > 0 && rz.StatusCode != http.StatusTooManyRequests) {
+		return
+	}
+	period, err := strconv.Atoi(rz.Header.Get("X-Ratelimit-Period"))
+	if err != nil || period <= 0 {
+		period = 1
+	}
+	wait := time.Duration(period) * time.Second
+	if limit, err := strconv.Atoi(rz.Header.Get("X-Ratelimit-Limit")); err == nil && limit > 0 {
+		wait /= time.Duration(limit)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if until := r.now().Add(wait); until.After(r.pausedUntil) {
+		r.pausedUntil = until
+	}
+}
+
+// backoff is how long to wait before retry number n (counting from 0)
+func (r *retrier) backoff(n int) time.Duration {
+	d := r.base << uint(n)
+	if d > r.max || d <= 0 {
+		d = r.max
+	}
+	return r.jitter(d)
+}
+
+type retryingClient struct {
+	*retrier
+	next ns1.Doer
+	ctx  context.Context
+}
+
+func idempotent(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+func (c retryingClient) Do(req *http.Request) (*http.Response, error) {
+	for n := 0; ; n++ {
+		if wait := c.pause(); wait > 0 {
+			if err := c.sleep(c.ctx, wait); err != nil {
+				return nil, err
+			}
+		}
+
+		if n > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, fmt.Errorf("can't retry %s %s: its body can't be re-read", req.Method, req.URL.Path)
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		rz, err := c.next.Do(req)
+		if err == nil {
+			c.observe(rz)
+		}
+
+		limited := err == nil && rz.StatusCode == http.StatusTooManyRequests
+		failed := err != nil || rz.StatusCode >= 500
+		retry := limited || (failed && idempotent(req.Method))
+		if !retry {
+			return rz, err
+		}
+
+		last := n+1 >= c.attempts
+		if limited && last {
+			discard(rz)
+			wait := c.pause()
+			if wait < 0 {
+				wait = 0
+			}
+			return nil, &RateLimitError{Attempts: c.attempts, RetryAfter: wait}
+		}
+		if last {
+			return rz, err
+		}
+
+		if err == nil {
+			discard(rz)
+		}
+		if err := c.sleep(c.ctx, c.backoff(n)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// discard reads and closes a response body, so its connection can be reused
+func discard(rz *http.Response) {
+	io.Copy(ioutil.Discard, rz.Body)
+	rz.Body.Close()
+}
@@ -2,12 +2,18 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
+	mdns "github.com/miekg/dns"
 	"github.com/nyarly/dns-manager/storage"
+	"golang.org/x/sync/singleflight"
 	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
 )
 
@@ -17,8 +23,31 @@ type Server struct {
 	storage  storage.Storage
 	key      string
 	clientFn func(context.Context) ns1.Doer
+	tokens   Tokens
+	// requireTokens is set by SetTokens, even if there are no tokens
+	requireTokens bool
+	policy        *Policy
+	auditLog      *AuditFile
+	tls           *tls.Config
+	drain         time.Duration
+	metrics       *metrics
+	fetches       *singleflight.Group
+	refresh       time.Duration
+	drift         *driftLog
+
+	dnsAddress    string
+	tsigKeys      TSIGKeys
+	requireTSIG   bool
+	transferAllow []*net.IPNet
+	journal       *Journal
+	authorities   *authorities
+	dnsUpdate     bool
+	acme          *sync.Mutex
 }
 
+// Option configures optional behaviour of a Server
+type Option func(*Server)
+
 type contextInjectingClient struct {
 	http ns1.Doer
 	ctx  context.Context
@@ -41,28 +70,124 @@ func (c contextInjectingClient) Do(rq *http.Request) (*http.Response, error) {
 //   storage:      a persistence engine
 //   key:          an NS1 API Key
 //   httpClientFn: a factory function returning a properly configured http.Client to talk to NS1 with
-func New(address string, storage storage.Storage, key string, httpClientFn func(context.Context) ns1.Doer) *Server {
-	return &Server{
+//   opts:         any further Options, e.g. SetTokens or SetPolicy
+func New(address string, storage storage.Storage, key string, httpClientFn func(context.Context) ns1.Doer, opts ...Option) *Server {
+	s := &Server{
 		address:  address,
 		storage:  storage,
 		key:      key,
 		clientFn: httpClientFn,
+		drain:    30 * time.Second,
+		metrics:  newMetrics(),
+		fetches:  &singleflight.Group{},
+		drift:    &driftLog{max: 1000},
+		journal:  newJournal(),
+		acme:     &sync.Mutex{},
+
+		authorities: &authorities{},
+	}
+	s.storage = watchedStorage{
+		Storage:     instrumentedStorage{Storage: storage, metrics: s.metrics},
+		authorities: s.authorities,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
 func (s Server) ns1Client(ctx context.Context) *ns1.Client {
-	return ns1.NewClient(s.clientFn(ctx), ns1.SetAPIKey(s.key))
+	return ns1.NewClient(s.instrumented(s.clientFn(ctx)), ns1.SetAPIKey(s.key))
 }
 
-// Start commands a Server to start serving HTTP
+// instrumented times the requests doer makes to NS1. A client from Retrying
+// is instrumented beneath its retries, so that every attempt is observed
+// and the time spent backing off isn't counted.
+func (s Server) instrumented(doer ns1.Doer) ns1.Doer {
+	if retrying, ok := doer.(retryingClient); ok {
+		retrying.next = instrumentedDoer{Doer: retrying.next, metrics: s.metrics}
+		return retrying
+	}
+	return instrumentedDoer{Doer: doer, metrics: s.metrics}
+}
+
+// SetDrainTimeout sets how long Start waits for requests in flight to
+// finish once it's been told to stop. The default is 30 seconds.
+func SetDrainTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.drain = d
+	}
+}
+
+// Start commands a Server to start serving HTTP, or HTTPS if it was given SetTLS.
+// It returns an error at once if the server can't start, e.g. because the
+// address is in use. Otherwise it serves until ctx is done, then stops
+// accepting requests and waits for those in flight to finish. Requests'
+// contexts are only cancelled if they outlast the drain timeout, so that
+// changes already underway at NS1 aren't abandoned. If it was given
+// SetRefresh, the cache is refreshed in the background meanwhile, and if it
+// was given SetDNS, DNS queries are answered too.
 func (s *Server) Start(ctx context.Context) error {
+	base, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
+
+	refreshing, stopRefreshing := context.WithCancel(ctx)
+	refreshed := make(chan struct{})
+	defer func() {
+		stopRefreshing()
+		<-refreshed
+	}()
+	go func() {
+		defer close(refreshed)
+		if s.refresh > 0 {
+			s.refreshEvery(refreshing, s.refresh)
+		}
+	}()
+
+	dnsServers := []*mdns.Server{}
+	if s.dnsAddress != "" {
+		var err error
+		if dnsServers, err = s.listenDNS(); err != nil {
+			return err
+		}
+	}
+	defer shutdownDNS(dnsServers)
+
 	server := http.Server{
 		Addr:        s.address,
 		Handler:     s.buildRouter(),
-		BaseContext: s.baseContext(ctx),
+		BaseContext: s.baseContext(base),
 		ConnContext: s.connContext(),
+		TLSConfig:   s.tls,
+	}
+
+	failed := make(chan error, 1+len(dnsServers))
+	if err := startDNS(dnsServers, failed); err != nil {
+		return err
 	}
-	return server.ListenAndServe()
+	go func() {
+		if s.tls != nil {
+			failed <- server.ListenAndServeTLS("", "")
+			return
+		}
+		failed <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-failed:
+		server.Close()
+		return err
+	case <-ctx.Done():
+	}
+
+	drain, cancel := context.WithTimeout(context.Background(), s.drain)
+	defer cancel()
+	if err := server.Shutdown(drain); err != nil {
+		cancelBase()
+		server.Close()
+		return fmt.Errorf("requests still in flight after %v: %v", s.drain, err)
+	}
+	return nil
 }
 
 func (s *Server) baseContext(ctx context.Context) func(net.Listener) context.Context {
@@ -77,7 +202,7 @@ func (s *Server) connContext() func(ctx context.Context, conn net.Conn) context.
 	}
 }
 
-func (s *Server) buildRouter() *http.ServeMux {
+func (s *Server) buildRouter() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/zone", func(rw http.ResponseWriter, req *http.Request) {
 		switch req.Method {
@@ -91,6 +216,38 @@ func (s *Server) buildRouter() *http.ServeMux {
 			methodNotAllowed(rw)
 		}
 	})
+	mux.HandleFunc("/zone/export", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			s.exportZone(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
+	mux.HandleFunc("/zone/import", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			s.importZone(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
+	mux.HandleFunc("/zones", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			s.listZones(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
+	mux.HandleFunc("/zones/", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			s.listRecords(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
 	mux.HandleFunc("/record", func(rw http.ResponseWriter, req *http.Request) {
 		switch req.Method {
 		case "GET":
@@ -103,6 +260,54 @@ func (s *Server) buildRouter() *http.ServeMux {
 			methodNotAllowed(rw)
 		}
 	})
+	mux.HandleFunc("/record/history", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			s.recordHistory(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
+	mux.HandleFunc("/acme/present", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			s.acmePresent(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
+	mux.HandleFunc("/acme/cleanup", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			s.acmeCleanup(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
+	mux.HandleFunc("/audit", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			s.queryAudit(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
+	mux.HandleFunc("/drift", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			s.queryDrift(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
+	mux.HandleFunc("/metrics", func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			s.metrics.handler().ServeHTTP(rw, req)
+		default:
+			methodNotAllowed(rw)
+		}
+	})
 	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
 		switch req.Method {
 		case "GET":
@@ -111,35 +316,57 @@ func (s *Server) buildRouter() *http.ServeMux {
 			methodNotAllowed(rw)
 		}
 	})
-	return mux
+	return identify(s.metrics.instrument(mux, s.authenticate(mux)))
 }
 
-func (s *Server) indexPage(rw http.ResponseWriter, req *http.Request) {
-	fmt.Fprintln(rw, "/zone{?name} Zone manipulation")
-	fmt.Fprintln(rw, "/record{?zone,domain,type} Record manipulation")
+type requestIDKey struct{}
+
+// requestID returns the ID identify gave a request
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
 }
 
-func methodNotAllowed(rw http.ResponseWriter) {
-	rw.WriteHeader(405)
+// identify gives each request an ID - the client's X-Request-Id if it sent
+// one - and returns it in the response's X-Request-Id header
+func identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-Id")
+		if id == "" {
+			id = newRequestID()
+		}
+		rw.Header().Set("X-Request-Id", id)
+		next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), requestIDKey{}, id)))
+	})
 }
 
-func proxyAPIResponse(rw http.ResponseWriter, rz *http.Response, body interface{}, err error) {
-	if rz == nil {
-		rw.WriteHeader(503)
-	} else {
-		rw.WriteHeader(rz.StatusCode)
-	}
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (s *Server) indexPage(rw http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(rw, "/zone{?name} Zone manipulation")
+	fmt.Fprintln(rw, "/zone/export{?name,format} Zone export as a BIND master file")
+	fmt.Fprintln(rw, "/zone/import{?name} Zone import from a BIND master file")
+	fmt.Fprintln(rw, "/zones Zone listing")
+	fmt.Fprintln(rw, "/zones/{zone}/records Record listing")
+	fmt.Fprintln(rw, "/record{?zone,domain,type,ttl} Record manipulation")
+	fmt.Fprintln(rw, "/record/history{?zone,domain,type} Versions of a record seen by this server")
+	fmt.Fprintln(rw, "/audit{?zone,principal,since} Log of changes made through this server")
+	fmt.Fprintln(rw, "/drift{?zone,since} Changes found at NS1 that weren't made through this server")
+	fmt.Fprintln(rw, "/metrics Prometheus metrics")
+}
 
+func proxyAPIResponse(rw http.ResponseWriter, rz *http.Response, body interface{}, err error) {
 	if err != nil {
-		fmt.Fprintf(rw, "problem updating NS1: %v", err)
+		ns1Failure(rw, rz, err)
 		return
 	}
-
 	if rz.StatusCode != 200 || body == nil {
+		rw.WriteHeader(rz.StatusCode)
 		return
 	}
-
-	if err := json.NewEncoder(rw).Encode(body); err != nil {
-		panic(err) // XXX but we already wrote a status...
-	}
+	writeJSON(rw, body)
 }
@@ -3,18 +3,35 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dnaeon/go-vcr/cassette"
 	govcr "github.com/dnaeon/go-vcr/recorder"
+	mdns "github.com/miekg/dns"
+	"github.com/nyarly/dns-manager/ns1fake"
 	"github.com/nyarly/dns-manager/storage"
 	"github.com/nyarly/spies"
 	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
@@ -24,7 +41,7 @@ import (
 var recordMode = flag.Bool("record", false, "update VCR files")
 
 type harness struct {
-	mux     *http.ServeMux
+	mux     http.Handler
 	store   *storage.Spy
 	stopVCR func()
 }
@@ -62,6 +79,20 @@ func testHarness(t *testing.T) harness {
 	}
 }
 
+// fakeHarness is a hermetic alternative to testHarness, with NS1 played by an ns1fake.Fake
+func fakeHarness(t *testing.T, opts ...Option) (harness, *ns1fake.Fake) {
+	t.Helper()
+	fake := ns1fake.Start()
+	store := storage.NewSpy()
+	server := New("example.com:80", store, "fake", fake.ClientFn, opts...)
+
+	return harness{
+		mux:     server.buildRouter(),
+		store:   store,
+		stopVCR: fake.Close,
+	}, fake
+}
+
 func buildBody(t *testing.T, v interface{}) io.Reader {
 	t.Helper()
 	b := bytes.Buffer{}
@@ -170,6 +201,9 @@ func TestDeleteZone(t *testing.T) {
 	if len(recorder.Body.String()) > 0 {
 		t.Errorf("Body is not empty: %q", recorder.Body.String())
 	}
+	if n := len(harness.store.CallsTo("DeleteZoneRecords")); n != 1 {
+		t.Errorf("Expected the zone's cached records to be forgotten, DeleteZoneRecords was called %d times", n)
+	}
 }
 
 func TestGetRecord(t *testing.T) {
@@ -236,3 +270,2209 @@ func TestCreateRecord(t *testing.T) {
 		t.Errorf("Body doesn't include zone name: %q", recorder.Body.String())
 	}
 }
+
+func TestListZones(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness := testHarness(t)
+	defer harness.stopVCR()
+
+	req := httptest.NewRequest("GET", "/zones", nil)
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 200 {
+		t.Errorf("Expected 200 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+	zones := []*dns.Zone{}
+	if err := json.NewDecoder(recorder.Body).Decode(&zones); err != nil {
+		t.Fatalf("Body isn't a list of zones: %v", err)
+	}
+	if len(zones) != 2 {
+		t.Errorf("Expected 2 zones, got %d", len(zones))
+	}
+}
+
+func TestListCachedZones(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness := testHarness(t)
+	defer harness.stopVCR()
+
+	harness.store.MatchMethod("ListZones", spies.AnyArgs, []*dns.Zone{
+		&dns.Zone{Zone: "jdl-example.com", TTL: 999999},
+	}, nil)
+
+	req := httptest.NewRequest("GET", "/zones", nil)
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 200 {
+		t.Errorf("Expected 200 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+	if strings.Index(recorder.Body.String(), "999999") == -1 {
+		t.Errorf("Body doesn't include sentinal value: %q", recorder.Body.String())
+	}
+}
+
+func TestListStale(t *testing.T) {
+	harness, fake := fakeHarness(t)
+	fake.Close() // NS1 is unreachable
+	harness.store.MatchMethod("ListZones", spies.AnyArgs, []*dns.Zone{{Zone: "jdl-example.com"}}, nil)
+	harness.store.MatchMethod("ListRecords", spies.AnyArgs, []*dns.Record{dns.NewRecord("jdl-example.com", "www.jdl-example.com", "A")}, nil)
+
+	for _, path := range []string{"/zones", "/zones/jdl-example.com/records"} {
+		recorder := httptest.NewRecorder()
+		harness.mux.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != 200 || !strings.Contains(recorder.Body.String(), "jdl-example.com") {
+			t.Errorf("%s: expected the cached listing, got %d \n%s", path, recorder.Code, recorder.Body.String())
+		}
+		if !strings.Contains(recorder.Header().Get("Warning"), "Stale") {
+			t.Errorf("%s: expected a warning that the listing is stale, got %q", path, recorder.Header().Get("Warning"))
+		}
+
+		recorder = httptest.NewRecorder()
+		harness.mux.ServeHTTP(recorder, httptest.NewRequest("GET", path+"?fresh=true", nil))
+		if recorder.Code != 503 {
+			t.Errorf("%s: expected 503 response when a fresh listing is needed, but status was %d \n%s", path, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestListRecords(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness := testHarness(t)
+	defer harness.stopVCR()
+
+	req := httptest.NewRequest("GET", "/zones/jdl-example.com/records", nil)
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 200 {
+		t.Errorf("Expected 200 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+	records := []*dns.Record{}
+	if err := json.NewDecoder(recorder.Body).Decode(&records); err != nil {
+		t.Fatalf("Body isn't a list of records: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d", len(records))
+	}
+	mx := records[2]
+	if mx.Type != "MX" || len(mx.Answers) != 1 || len(mx.Answers[0].Rdata) != 2 {
+		t.Errorf("MX answer wasn't split into priority and host: %v", mx.Answers)
+	}
+}
+
+func TestListRecordsBadPath(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness := testHarness(t)
+	defer harness.stopVCR()
+
+	req := httptest.NewRequest("GET", "/zones/jdl-example.com/nonsense", nil)
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 404 {
+		t.Errorf("Expected 404 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+}
+
+func TestUpdateRecordExpiredFromCache(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+
+	existing := dns.NewRecord("jdl-example.com", "somewhere.jdl-example.com", "A")
+	existing.AddAnswer(dns.NewAv4Answer("1.2.3.4"))
+	fake.AddRecord(existing)
+
+	req := httptest.NewRequest("PUT", "/record", buildBody(t, [][]string{[]string{"5.6.7.8"}}))
+	req.URL.RawQuery = "zone=jdl-example.com&domain=somewhere.jdl-example.com&type=A"
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 200 {
+		t.Errorf("Expected 200 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+	if strings.Index(recorder.Body.String(), "5.6.7.8") == -1 {
+		t.Errorf("Body doesn't include new answer: %q", recorder.Body.String())
+	}
+	if len(harness.store.CallsTo("RecordRecord")) != 1 {
+		t.Errorf("Expected the updated record to be cached: %v", harness.store.Calls())
+	}
+}
+
+func TestGetZoneUpstreamFailure(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+
+	fake.Inject(ns1fake.Fault{Status: 503})
+
+	req := httptest.NewRequest("GET", "/zone", nil)
+	req.URL.RawQuery = "name=jdl-example.com"
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 503 {
+		t.Errorf("Expected 503 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+	if len(harness.store.CallsTo("RecordZone")) != 0 {
+		t.Errorf("Nothing should have been cached: %v", harness.store.Calls())
+	}
+}
+
+func TestExportZone(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+
+	mx := dns.NewRecord("jdl-example.com", "jdl-example.com", "MX")
+	mx.AddAnswer(dns.NewMXAnswer(10, "mail.jdl-example.com"))
+	fake.AddRecord(mx)
+
+	req := httptest.NewRequest("GET", "/zone/export", nil)
+	req.URL.RawQuery = "name=jdl-example.com&format=bind"
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 200 {
+		t.Errorf("Expected 200 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+	for _, expected := range []string{"\tSOA\t", "\tNS\tdns1.p01.nsone.net.", "\tMX\t10 mail.jdl-example.com."} {
+		if strings.Index(recorder.Body.String(), expected) == -1 {
+			t.Errorf("Body doesn't include %q: %q", expected, recorder.Body.String())
+		}
+	}
+}
+
+func TestExportZoneUnknownFormat(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness, _ := fakeHarness(t)
+	defer harness.stopVCR()
+
+	req := httptest.NewRequest("GET", "/zone/export", nil)
+	req.URL.RawQuery = "name=jdl-example.com&format=tinydns"
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 400 {
+		t.Errorf("Expected 400 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+}
+
+func TestImportZone(t *testing.T) {
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+
+	zonefile := "$ORIGIN jdl-example.com.\n$TTL 300\n" +
+		"www IN A 1.2.3.4\n" +
+		"www IN A 5.6.7.8\n" +
+		"@ IN MX 10 mail\n"
+
+	for _, expected := range []string{"created", "updated"} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/zone/import", strings.NewReader(zonefile))
+		req.URL.RawQuery = "name=jdl-example.com"
+		harness.mux.ServeHTTP(recorder, req)
+		rz := recorder.Result()
+
+		if rz.StatusCode != 200 {
+			t.Fatalf("Expected 200 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+		}
+		results := []ImportResult{}
+		if err := json.NewDecoder(recorder.Body).Decode(&results); err != nil {
+			t.Fatalf("Body isn't a list of results: %v", err)
+		}
+		if len(results) != 2 {
+			t.Fatalf("Expected 2 results, got %v", results)
+		}
+		for _, r := range results {
+			if r.Action != expected {
+				t.Errorf("Expected %s, got %#v", expected, r)
+			}
+		}
+	}
+
+	client := ns1.NewClient(fake.ClientFn(context.Background()))
+	www, _, err := client.Records.Get("jdl-example.com", "www.jdl-example.com", "A")
+	if err != nil {
+		t.Fatalf("Imported record isn't at NS1: %v", err)
+	}
+	if len(www.Answers) != 2 {
+		t.Errorf("Expected both answers to be imported: %v", www.Answers)
+	}
+}
+
+func TestImportZoneMalformed(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness, _ := fakeHarness(t)
+	defer harness.stopVCR()
+
+	req := httptest.NewRequest("POST", "/zone/import", strings.NewReader("www IN A nonsense\n"))
+	req.URL.RawQuery = "name=jdl-example.com"
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 400 {
+		t.Errorf("Expected 400 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+}
+
+func TestImportZoneOutside(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+	fake.AddZone("jdl-example.com")
+
+	zonefile := "www IN A 1.2.3.4\n$ORIGIN other-example.com.\nwww IN A 5.6.7.8\n"
+	req := httptest.NewRequest("POST", "/zone/import", strings.NewReader(zonefile))
+	req.URL.RawQuery = "name=jdl-example.com"
+	harness.mux.ServeHTTP(recorder, req)
+
+	if recorder.Code != 400 || !strings.Contains(recorder.Body.String(), "line 3") {
+		t.Errorf("Expected 400 response naming the line, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+	for _, r := range fake.Requests() {
+		if !strings.HasPrefix(r, "GET ") {
+			t.Errorf("Expected nothing to be imported, but NS1 got %s", r)
+		}
+	}
+}
+
+func TestCreateRecordWithTTL(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+	fake.AddZone("jdl-example.com")
+
+	req := httptest.NewRequest("PUT", "/record", buildBody(t, [][]string{[]string{"1.2.3.4"}}))
+	req.URL.RawQuery = "zone=jdl-example.com&domain=somewhere.jdl-example.com&type=A&ttl=120"
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 200 {
+		t.Fatalf("Expected 200 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+	record := dns.Record{}
+	if err := json.NewDecoder(recorder.Body).Decode(&record); err != nil {
+		t.Fatalf("Body isn't a record: %v", err)
+	}
+	if record.TTL != 120 {
+		t.Errorf("Expected TTL of 120, got %d", record.TTL)
+	}
+}
+
+func TestUpdateRecordInvalidAnswers(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+
+	req := httptest.NewRequest("PUT", "/record", buildBody(t, [][]string{[]string{"mail.jdl-example.com"}}))
+	req.URL.RawQuery = "zone=jdl-example.com&domain=jdl-example.com&type=MX"
+	harness.mux.ServeHTTP(recorder, req)
+	rz := recorder.Result()
+
+	if rz.StatusCode != 422 {
+		t.Errorf("Expected 422 response, but status was %s \n%s", rz.Status, recorder.Body.String())
+	}
+	if strings.Index(recorder.Body.String(), "priority") == -1 {
+		t.Errorf("Body doesn't describe the missing field: %q", recorder.Body.String())
+	}
+	if len(fake.Requests()) != 0 {
+		t.Errorf("Invalid record shouldn't reach NS1: %v", fake.Requests())
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	sum := sha256.Sum256([]byte("dashboard-secret"))
+	tokens := Tokens{
+		{Name: "alice", Token: "alice-secret"},
+		{Name: "dashboard", SHA256: hex.EncodeToString(sum[:]), ReadOnly: true},
+	}
+
+	cases := []struct {
+		method, auth string
+		status       int
+	}{
+		{"GET", "", 401},
+		{"GET", "Basic YWxpY2U6c2VjcmV0", 401},
+		{"GET", "Bearer wrong", 401},
+		{"GET", "Bearer alice-secret", 200},
+		{"GET", "Bearer dashboard-secret", 200},
+		{"PUT", "Bearer dashboard-secret", 403},
+		{"PUT", "Bearer alice-secret", 200},
+	}
+
+	for _, c := range cases {
+		harness, fake := fakeHarness(t, SetTokens(tokens))
+		fake.AddZone("jdl-example.com")
+		recorder := httptest.NewRecorder()
+
+		req := httptest.NewRequest(c.method, "/zone?name=jdl-example.com", nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		harness.mux.ServeHTTP(recorder, req)
+		harness.stopVCR()
+
+		if recorder.Code != c.status {
+			t.Errorf("%s with %q: expected %d, got %d \n%s", c.method, c.auth, c.status, recorder.Code, recorder.Body.String())
+		}
+		if c.status == 401 && recorder.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s with %q: 401 without a WWW-Authenticate challenge", c.method, c.auth)
+		}
+		if c.status != 200 && len(fake.Requests()) != 0 {
+			t.Errorf("%s with %q: rejected request reached NS1: %v", c.method, c.auth, fake.Requests())
+		}
+	}
+}
+
+func TestNoTokens(t *testing.T) {
+	harness, fake := fakeHarness(t, SetTokens(nil))
+	defer harness.stopVCR()
+	fake.AddZone("jdl-example.com")
+
+	recorder := httptest.NewRecorder()
+	harness.mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/zone?name=jdl-example.com", nil))
+	if recorder.Code != 401 {
+		t.Errorf("Expected 401 with no tokens configured, got %d \n%s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestLoadTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tokens.yaml")
+	good := "tokens:\n- name: alice\n  token: s3cret\n- name: bob\n  sha256: " + strings.Repeat("ab", 32) + "\n  readonly: true\n"
+	if err := ioutil.WriteFile(path, []byte(good), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := LoadTokens(path)
+	if err != nil {
+		t.Fatalf("Loading tokens: %v", err)
+	}
+	if len(tokens) != 2 || !tokens[1].ReadOnly {
+		t.Errorf("Unexpected tokens: %#v", tokens)
+	}
+	if tok, ok := tokens.find("s3cret"); !ok || tok.Name != "alice" {
+		t.Errorf("Expected to find alice's token, got %#v, %v", tok, ok)
+	}
+
+	for _, bad := range []string{
+		"tokens:\n- token: nameless\n",
+		"tokens:\n- name: alice\n",
+		"tokens:\n- name: alice\n  token: a\n- name: alice\n  token: b\n",
+		"tokens:\n- name: alice\n  sha256: nothex\n",
+		"token:\n- name: alice\n  token: s3cret\n",
+		"tokens:\n- name: alice\n  tokn: s3cret\n",
+		"tokens:\n",
+	} {
+		if err := ioutil.WriteFile(path, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTokens(path); err == nil {
+			t.Errorf("Expected an error loading %q", bad)
+		}
+	}
+}
+
+func writePolicy(t *testing.T, dir, rules string) string {
+	t.Helper()
+	path := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testPolicy = `
+rules:
+- name: no-zone-deletes
+  effect: deny
+  verbs: [delete-zone]
+  principals: ["*"]
+- name: ci-staging
+  effect: allow
+  principals: [ci]
+  verbs: [update-record, delete-record]
+  zones: [jdl-example.com]
+  domains: ["*.staging.jdl-example.com"]
+  types: [a, CNAME]
+`
+
+func TestPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policy, err := LoadPolicy(writePolicy(t, dir, testPolicy))
+	if err != nil {
+		t.Fatalf("Loading policy: %v", err)
+	}
+	tokens := Tokens{{Name: "ci", Token: "ci-secret"}, {Name: "ops", Token: "ops-secret"}}
+
+	cases := []struct {
+		token, method, query string
+		status               int
+		body                 string
+	}{
+		{"ci-secret", "PUT", "zone=jdl-example.com&domain=www.staging.jdl-example.com&type=A", 200, ""},
+		{"ci-secret", "PUT", "zone=jdl-example.com&domain=www.jdl-example.com&type=A", 403, "no rule allows ci to update-record www.jdl-example.com A"},
+		{"ci-secret", "PUT", "zone=jdl-example.com&domain=mx.staging.jdl-example.com&type=MX", 403, "no rule allows"},
+		{"ops-secret", "PUT", "zone=jdl-example.com&domain=www.staging.jdl-example.com&type=A", 403, "no rule allows ops"},
+	}
+
+	for _, c := range cases {
+		harness, fake := fakeHarness(t, SetTokens(tokens), SetPolicy(policy))
+		fake.AddZone("jdl-example.com")
+		recorder := httptest.NewRecorder()
+
+		answers := [][]string{{"1.2.3.4"}}
+		if strings.Contains(c.query, "MX") {
+			answers = [][]string{{"10", "mail.jdl-example.com"}}
+		}
+		req := httptest.NewRequest(c.method, "/record?"+c.query, buildBody(t, answers))
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		harness.mux.ServeHTTP(recorder, req)
+		harness.stopVCR()
+
+		if recorder.Code != c.status {
+			t.Errorf("%s %s: expected %d, got %d \n%s", c.token, c.query, c.status, recorder.Code, recorder.Body.String())
+		}
+		if !strings.Contains(recorder.Body.String(), c.body) {
+			t.Errorf("%s %s: expected body to include %q, got %q", c.token, c.query, c.body, recorder.Body.String())
+		}
+		if c.status == 403 && len(fake.Requests()) != 0 {
+			t.Errorf("%s %s: denied request reached NS1: %v", c.token, c.query, fake.Requests())
+		}
+	}
+
+	harness, _ := fakeHarness(t, SetTokens(tokens), SetPolicy(policy))
+	defer harness.stopVCR()
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest("DELETE", "/zone?name=jdl-example.com", nil)
+	req.Header.Set("Authorization", "Bearer ops-secret")
+	harness.mux.ServeHTTP(recorder, req)
+	denial := ErrorResponse{}
+	json.NewDecoder(recorder.Body).Decode(&denial)
+	if recorder.Code != 403 || denial.Code != CodeForbidden || !strings.Contains(denial.Message, `rule "no-zone-deletes" denies ops`) {
+		t.Errorf("Expected no-zone-deletes to deny, got %d %#v", recorder.Code, denial)
+	}
+}
+
+func TestPolicyReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writePolicy(t, dir, testPolicy)
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("Loading policy: %v", err)
+	}
+	access := Access{Principal: "ops", Verb: UpdateZone, Zone: "jdl-example.com"}
+	if policy.Check(access) == nil {
+		t.Fatalf("Expected ops to be denied before reload")
+	}
+
+	writePolicy(t, dir, testPolicy+"- name: ops\n  effect: allow\n  principals: [ops]\n")
+	if err := policy.Reload(); err != nil {
+		t.Fatalf("Reloading policy: %v", err)
+	}
+	if err := policy.Check(access); err != nil {
+		t.Errorf("Expected ops to be allowed after reload: %v", err)
+	}
+
+	for _, broken := range []string{
+		"rules:\n- name: broken\n  effect: maybe\n",
+		"rules:\n- name: misspelt\n  effect: allow\n  principal: [ops]\n",
+	} {
+		writePolicy(t, dir, broken)
+		if err := policy.Reload(); err == nil {
+			t.Errorf("Expected an error reloading %q", broken)
+		}
+	}
+	if err := policy.Check(access); err != nil {
+		t.Errorf("Expected the previous rules to stay in force: %v", err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	auditLog, err := OpenAuditFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	store, err := storage.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	tokens := Tokens{{Name: "alice", Token: "alice-secret"}}
+	mux := New("example.com:80", store, "fake", fake.ClientFn, SetTokens(tokens), SetAuditLog(auditLog)).buildRouter()
+	fake.AddZone("jdl-example.com")
+	fake.AddZone("other-example.com")
+
+	sent := 0
+	send := func(method, path string, body io.Reader) *httptest.ResponseRecorder {
+		sent++
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Authorization", "Bearer alice-secret")
+		req.Header.Set("X-Request-Id", fmt.Sprintf("req-%d", sent))
+		mux.ServeHTTP(recorder, req)
+		if recorder.Code != 200 {
+			t.Fatalf("%s %s: expected 200, got %d \n%s", method, path, recorder.Code, recorder.Body.String())
+		}
+		return recorder
+	}
+
+	record := "/record?zone=jdl-example.com&domain=www.jdl-example.com&type=A"
+	send("PUT", record, buildBody(t, [][]string{{"1.2.3.4"}}))
+	send("PUT", record, buildBody(t, [][]string{{"5.6.7.8"}}))
+	send("DELETE", record, nil)
+	send("PUT", "/record?zone=other-example.com&domain=www.other-example.com&type=A", buildBody(t, [][]string{{"1.2.3.4"}}))
+
+	rz := send("GET", "/audit?zone=jdl-example.com", nil)
+	entries := []AuditEntry{}
+	if err := json.NewDecoder(rz.Body).Decode(&entries); err != nil {
+		t.Fatalf("Body isn't audit entries: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries for jdl-example.com, got %d: %#v", len(entries), entries)
+	}
+
+	answers := func(raw json.RawMessage) string {
+		if raw == nil {
+			return "none"
+		}
+		r := dns.Record{}
+		if err := json.Unmarshal(raw, &r); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(r.Answers)
+	}
+	expected := []struct{ verb, before, after string }{
+		{UpdateRecord, "none", "[1.2.3.4]"},
+		{UpdateRecord, "[1.2.3.4]", "[5.6.7.8]"},
+		{DeleteRecord, "[5.6.7.8]", "none"},
+	}
+	for i, e := range expected {
+		got := entries[i]
+		if got.Verb != e.verb || got.Principal != "alice" || got.Domain != "www.jdl-example.com" {
+			t.Errorf("Entry %d: unexpected %#v", i, got)
+		}
+		if b, a := answers(got.Before), answers(got.After); b != e.before || a != e.after {
+			t.Errorf("Entry %d: expected %s -> %s, got %s -> %s", i, e.before, e.after, b, a)
+		}
+		if id := fmt.Sprintf("req-%d", i+1); got.RequestID != id {
+			t.Errorf("Entry %d: expected request ID %q, got %q", i, id, got.RequestID)
+		}
+	}
+
+	// records made at NS1 directly, which the server has never seen
+	for _, domain := range []string{"direct.jdl-example.com", "gone.jdl-example.com"} {
+		r := dns.NewRecord("jdl-example.com", domain, "A")
+		r.AddAnswer(dns.NewAnswer([]string{"9.9.9.9"}))
+		fake.AddRecord(r)
+	}
+	seen := len(fake.Requests())
+	send("PUT", "/record?zone=jdl-example.com&domain=direct.jdl-example.com&type=A", buildBody(t, [][]string{{"1.2.3.4"}}))
+	send("DELETE", "/record?zone=jdl-example.com&domain=gone.jdl-example.com&type=A", nil)
+	for _, r := range fake.Requests()[seen:] {
+		if strings.HasPrefix(r, "GET ") {
+			t.Errorf("Expected no reads from NS1 to audit a change, got %v", fake.Requests()[seen:])
+			break
+		}
+	}
+
+	rz = send("GET", "/audit?zone=jdl-example.com", nil)
+	entries = []AuditEntry{}
+	if err := json.NewDecoder(rz.Body).Decode(&entries); err != nil {
+		t.Fatalf("Body isn't audit entries: %v", err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("Expected 5 entries for jdl-example.com, got %d: %#v", len(entries), entries)
+	}
+	for i, e := range entries {
+		if unknown := i >= 3; e.PriorUnknown != unknown || (unknown && e.Before != nil) {
+			t.Errorf("Entry %d: expected the prior state to be unknown: %v, got %#v", i, unknown, e)
+		}
+	}
+
+	rz = send("GET", "/audit?since="+time.Now().Add(time.Hour).Format(time.RFC3339), nil)
+	entries = []AuditEntry{}
+	if err := json.NewDecoder(rz.Body).Decode(&entries); err != nil {
+		t.Fatalf("Body isn't audit entries: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no entries from the future, got %d", len(entries))
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	harness, _ := fakeHarness(t)
+	defer harness.stopVCR()
+
+	recorder := httptest.NewRecorder()
+	harness.mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Header().Get("X-Request-Id") == "" {
+		t.Errorf("Expected a generated X-Request-Id")
+	}
+
+	recorder = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-Id", "abc123")
+	harness.mux.ServeHTTP(recorder, req)
+	if id := recorder.Header().Get("X-Request-Id"); id != "abc123" {
+		t.Errorf("Expected the client's request ID back, got %q", id)
+	}
+}
+
+func TestRecordHistory(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	harness, _ := fakeHarness(t)
+	defer harness.stopVCR()
+
+	record := dns.NewRecord("jdl-example.com", "www.jdl-example.com", "CNAME")
+	record.AddAnswer(dns.NewAnswer([]string{"lb1.jdl-example.com"}))
+	harness.store.MatchMethod("RecordHistory", spies.AnyArgs, []storage.RecordVersion{
+		{Version: 1, RecordedAt: time.Now(), Record: record},
+	}, nil)
+
+	req := httptest.NewRequest("GET", "/record/history?zone=jdl-example.com&domain=www.jdl-example.com&type=CNAME", nil)
+	harness.mux.ServeHTTP(recorder, req)
+
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+	history := []storage.RecordVersion{}
+	if err := json.NewDecoder(recorder.Body).Decode(&history); err != nil {
+		t.Fatalf("Body isn't a record history: %v", err)
+	}
+	if len(history) != 1 || history[0].Record.Answers[0].String() != "lb1.jdl-example.com" {
+		t.Errorf("Unexpected history: %#v", history)
+	}
+}
+
+// writeCert creates a certificate for name, signed by parent (or self-signed
+// if parent is nil), and writes it and its key as PEM files in dir
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	writeCert(t, dir, "stranger", nil, nil)
+
+	config, err := LoadTLS(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("Loading TLS config: %v", err)
+	}
+
+	harness, _ := fakeHarness(t)
+	defer harness.stopVCR()
+	srv := httptest.NewUnstartedServer(harness.mux)
+	srv.TLS = config
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots, err := LoadCertPool(filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatalf("Loading CA: %v", err)
+	}
+	get := func(certName string) error {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if certName != "" {
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, certName+".pem"), filepath.Join(dir, certName+"-key.pem"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientConfig.Certificates = []tls.Certificate{cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		rz, err := client.Get(srv.URL + "/")
+		if err != nil {
+			return err
+		}
+		rz.Body.Close()
+		if rz.StatusCode != 200 {
+			return fmt.Errorf("status %s", rz.Status)
+		}
+		return nil
+	}
+
+	if err := get("client"); err != nil {
+		t.Errorf("Expected a client with a CA-signed certificate to be served: %v", err)
+	}
+	if err := get(""); err == nil {
+		t.Errorf("Expected a client without a certificate to be refused")
+	}
+	if err := get("stranger"); err == nil {
+		t.Errorf("Expected a client with a self-signed certificate to be refused")
+	}
+}
+
+func TestStartAddressInUse(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	server := New(taken.Addr().String(), storage.NewSpy(), "fake", fake.ClientFn)
+
+	done := make(chan error, 1)
+	go func() { done <- server.Start(context.Background()) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Expected an error starting on an address in use")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Start didn't give up on an address in use")
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	fake.SetLatency(300 * time.Millisecond)
+	store := storage.NewSpy()
+	server := New(addr, store, "fake", fake.ClientFn, SetDrainTimeout(5*time.Second))
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Server never started listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	result := make(chan int, 1)
+	go func() {
+		rz, err := http.Get("http://" + addr + "/zone?name=jdl-example.com")
+		if err != nil {
+			t.Errorf("In-flight request failed: %v", err)
+			result <- 0
+			return
+		}
+		rz.Body.Close()
+		result <- rz.StatusCode
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	if status := <-result; status != 200 {
+		t.Errorf("Expected the in-flight request to finish with 200, got %d", status)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Errorf("Server still listening after shutdown")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+	fake.AddZone("jdl-example.com")
+
+	for _, name := range []string{"jdl-example.com", "missing-example.com"} {
+		recorder := httptest.NewRecorder()
+		harness.mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/zone?name="+name, nil))
+	}
+
+	recorder := httptest.NewRecorder()
+	harness.mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`dns_manager_http_requests_total{method="GET",route="/zone",status="200"} 1`,
+		`dns_manager_http_requests_total{method="GET",route="/zone",status="404"} 1`,
+		`dns_manager_http_request_duration_seconds_count{method="GET",route="/zone",status="200"} 1`,
+		`dns_manager_cache_lookups_total{kind="zone",result="miss"} 2`,
+		`dns_manager_ns1_request_duration_seconds_count{endpoint="/v1/zones/:zone",method="GET",status="200"} 1`,
+		`dns_manager_ns1_errors_total{endpoint="/v1/zones/:zone",status="404"} 1`,
+		`dns_manager_storage_operation_duration_seconds_count{operation="GetZone"} 2`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Metrics don't include %s", line)
+		}
+	}
+}
+
+func TestRetryMetrics(t *testing.T) {
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	fake.Inject(ns1fake.Fault{Method: "GET", Status: 429, Times: 2})
+
+	slept := []time.Duration{}
+	r := testRetrier(&slept)
+	server := New("example.com:80", storage.NewSpy(), "fake", func(ctx context.Context) ns1.Doer {
+		return retryingClient{retrier: r, next: fake.ClientFn(ctx), ctx: ctx}
+	})
+	mux := server.buildRouter()
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/zone?name=jdl-example.com", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response once the retries succeeded, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`dns_manager_ns1_request_duration_seconds_count{endpoint="/v1/zones/:zone",method="GET",status="429"} 2`,
+		`dns_manager_ns1_request_duration_seconds_count{endpoint="/v1/zones/:zone",method="GET",status="200"} 1`,
+		`dns_manager_ns1_errors_total{endpoint="/v1/zones/:zone",status="429"} 2`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Metrics don't include %s", line)
+		}
+	}
+}
+
+func TestNS1Endpoint(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/v1/zones":             "/v1/zones",
+		"/v1/zones/example.com": "/v1/zones/:zone",
+		"/v1/zones/example.com/www.example.com/A": "/v1/zones/:zone/:domain/:type",
+		"/v1/account/apikeys":                     "/v1/account/apikeys",
+	} {
+		if got := ns1Endpoint(path); got != expected {
+			t.Errorf("ns1Endpoint(%q): expected %q, got %q", path, expected, got)
+		}
+	}
+}
+
+// testRetrier is a retrier that records how long it would have slept, rather than sleeping
+func testRetrier(slept *[]time.Duration) *retrier {
+	return &retrier{
+		attempts: 5,
+		base:     100 * time.Millisecond,
+		max:      time.Second,
+		sleep: func(_ context.Context, d time.Duration) error {
+			*slept = append(*slept, d)
+			return nil
+		},
+		jitter: func(d time.Duration) time.Duration { return d },
+		now:    time.Now,
+	}
+}
+
+func TestRetrying(t *testing.T) {
+	cases := []struct {
+		name     string
+		fault    ns1fake.Fault
+		call     func(*ns1.Client) error
+		requests int
+		failed   bool
+	}{
+		{
+			name:     "read rate limited",
+			fault:    ns1fake.Fault{Method: "GET", Status: 429, Times: 2},
+			call:     func(c *ns1.Client) error { _, _, err := c.Zones.Get("jdl-example.com"); return err },
+			requests: 3,
+		},
+		{
+			name:     "write rate limited",
+			fault:    ns1fake.Fault{Method: "PUT", Status: 429, Times: 2},
+			call:     func(c *ns1.Client) error { _, err := c.Zones.Create(dns.NewZone("new-example.com")); return err },
+			requests: 3,
+		},
+		{
+			name:     "read server error",
+			fault:    ns1fake.Fault{Method: "GET", Status: 503, Times: 1},
+			call:     func(c *ns1.Client) error { _, _, err := c.Zones.Get("jdl-example.com"); return err },
+			requests: 2,
+		},
+		{
+			name:     "write server error",
+			fault:    ns1fake.Fault{Method: "PUT", Status: 503, Times: 1},
+			call:     func(c *ns1.Client) error { _, err := c.Zones.Create(dns.NewZone("new-example.com")); return err },
+			requests: 1,
+			failed:   true,
+		},
+		{
+			name:     "persistent server error",
+			fault:    ns1fake.Fault{Method: "GET", Status: 503},
+			call:     func(c *ns1.Client) error { _, _, err := c.Zones.Get("jdl-example.com"); return err },
+			requests: 5,
+			failed:   true,
+		},
+	}
+
+	for _, c := range cases {
+		fake := ns1fake.Start()
+		fake.AddZone("jdl-example.com")
+		fake.Inject(c.fault)
+
+		slept := []time.Duration{}
+		ctx := context.Background()
+		doer := retryingClient{retrier: testRetrier(&slept), next: fake.ClientFn(ctx), ctx: ctx}
+		err := c.call(ns1.NewClient(doer, ns1.SetAPIKey("fake")))
+		fake.Close()
+
+		if (err != nil) != c.failed {
+			t.Errorf("%s: expected failure %v, got %v", c.name, c.failed, err)
+		}
+		if n := len(fake.Requests()); n != c.requests {
+			t.Errorf("%s: expected %d requests to NS1, got %d: %v", c.name, c.requests, n, fake.Requests())
+		}
+		if c.fault.Status == 429 {
+			// the fake allows 900 requests per 300s, so a slot frees up every third of a second
+			paced := false
+			for _, d := range slept {
+				if d > 300*time.Millisecond && d <= 334*time.Millisecond {
+					paced = true
+				}
+			}
+			if !paced {
+				t.Errorf("%s: expected to wait for the rate limit, slept %v", c.name, slept)
+			}
+		}
+	}
+}
+
+func TestRateLimitExhausted(t *testing.T) {
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	fake.Inject(ns1fake.Fault{Status: 429})
+
+	slept := []time.Duration{}
+	r := testRetrier(&slept)
+	server := New("example.com:80", storage.NewSpy(), "fake", func(ctx context.Context) ns1.Doer {
+		return retryingClient{retrier: r, next: fake.ClientFn(ctx), ctx: ctx}
+	})
+
+	recorder := httptest.NewRecorder()
+	server.buildRouter().ServeHTTP(recorder, httptest.NewRequest("GET", "/zone?name=jdl-example.com", nil))
+
+	if recorder.Code != 429 {
+		t.Errorf("Expected 429 response, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+	if recorder.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+	if !strings.Contains(recorder.Body.String(), "rate limit exceeded on all 5 attempts") {
+		t.Errorf("Body doesn't explain the rate limit: %q", recorder.Body.String())
+	}
+	if n := len(fake.Requests()); n != 5 {
+		t.Errorf("Expected 5 attempts, got %d", n)
+	}
+}
+
+func TestCoalescedMisses(t *testing.T) {
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+	fake.AddZone("jdl-example.com")
+	record := dns.NewRecord("jdl-example.com", "www.jdl-example.com", "A")
+	record.AddAnswer(dns.NewAnswer([]string{"1.2.3.4"}))
+	fake.AddRecord(record)
+	fake.SetLatency(200 * time.Millisecond)
+
+	const clients = 20
+	statuses := make(chan int, clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/record?zone=jdl-example.com&domain=www.jdl-example.com&type=A", nil)
+			harness.mux.ServeHTTP(recorder, req)
+			if !strings.Contains(recorder.Body.String(), "1.2.3.4") {
+				t.Errorf("Body doesn't include the answer: %q", recorder.Body.String())
+			}
+			statuses <- recorder.Code
+		}()
+	}
+	for i := 0; i < clients; i++ {
+		if status := <-statuses; status != 200 {
+			t.Errorf("Expected 200 response, got %d", status)
+		}
+	}
+
+	if n := len(fake.Requests()); n != 1 {
+		t.Errorf("Expected concurrent misses to share one NS1 request, got %d: %v", n, fake.Requests())
+	}
+	if n := len(harness.store.CallsTo("RecordRecord")); n != 1 {
+		t.Errorf("Expected concurrent misses to share one cache write, got %d", n)
+	}
+}
+
+func TestCoalescedMissAbandoned(t *testing.T) {
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+	fake.AddZone("jdl-example.com")
+	fake.SetLatency(200 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan int)
+	go func() {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/zone?name=jdl-example.com", nil).WithContext(ctx)
+		harness.mux.ServeHTTP(recorder, req)
+		first <- recorder.Code
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	second := make(chan *httptest.ResponseRecorder)
+	go func() {
+		recorder := httptest.NewRecorder()
+		harness.mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/zone?name=jdl-example.com", nil))
+		second <- recorder
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-first
+
+	recorder := <-second
+	if recorder.Code != 200 {
+		t.Errorf("Expected the request still waiting to get 200, got %d \n%s", recorder.Code, recorder.Body.String())
+	}
+	if n := len(fake.Requests()); n != 1 {
+		t.Errorf("Expected the requests to share one NS1 request, got %d: %v", n, fake.Requests())
+	}
+}
+
+func TestRecordWritesKeepZoneCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summaries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	mail := dns.NewRecord("jdl-example.com", "mail.jdl-example.com", "A")
+	mail.AddAnswer(dns.NewAnswer([]string{"5.6.7.8"}))
+	fake.AddRecord(mail)
+	mux := New("example.com:80", store, "fake", fake.ClientFn).buildRouter()
+
+	for _, c := range []struct{ method, path string }{
+		{"GET", "/zone?name=jdl-example.com"},
+		{"PUT", "/record?zone=jdl-example.com&domain=www.jdl-example.com&type=A"},
+		{"DELETE", "/record?zone=jdl-example.com&domain=mail.jdl-example.com&type=A"},
+	} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest(c.method, c.path, buildBody(t, [][]string{{"1.2.3.4"}})))
+		if recorder.Code != 200 {
+			t.Fatalf("Expected 200 response to %s %s, but status was %d \n%s", c.method, c.path, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	zone, err := store.GetZone("jdl-example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone == nil {
+		t.Fatalf("Expected the zone to stay cached through record writes")
+	}
+	summaries := map[string]string{}
+	for _, zr := range zone.Records {
+		summaries[zr.Domain+"/"+zr.Type] = strings.Join(zr.ShortAns, " ")
+	}
+	if summaries["www.jdl-example.com/A"] != "1.2.3.4" {
+		t.Errorf("Expected the cached zone to summarize the new www record, got %v", summaries)
+	}
+	if _, ok := summaries["mail.jdl-example.com/A"]; ok {
+		t.Errorf("Expected the cached zone to forget the deleted mail record, got %v", summaries)
+	}
+}
+
+func TestDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	for domain, ip := range map[string]string{"www": "1.2.3.4", "mail": "5.6.7.8"} {
+		record := dns.NewRecord("jdl-example.com", domain+".jdl-example.com", "A")
+		record.AddAnswer(dns.NewAnswer([]string{ip}))
+		fake.AddRecord(record)
+	}
+	server := New("example.com:80", store, "fake", fake.ClientFn)
+	mux := server.buildRouter()
+
+	for _, path := range []string{
+		"/record?zone=jdl-example.com&domain=www.jdl-example.com&type=A",
+		"/record?zone=jdl-example.com&domain=mail.jdl-example.com&type=A",
+		"/zone?name=jdl-example.com",
+	} {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != 200 {
+			t.Fatalf("Expected 200 response to %s, but status was %d \n%s", path, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	// someone edits the zone in the portal
+	changed := dns.NewRecord("jdl-example.com", "www.jdl-example.com", "A")
+	changed.AddAnswer(dns.NewAnswer([]string{"9.9.9.9"}))
+	fake.AddRecord(changed)
+	fake.RemoveRecord("jdl-example.com", "mail.jdl-example.com", "A")
+	added := dns.NewRecord("jdl-example.com", "ftp.jdl-example.com", "A")
+	added.AddAnswer(dns.NewAnswer([]string{"1.1.1.1"}))
+	fake.AddRecord(added)
+
+	if err := server.refreshAll(context.Background()); err != nil {
+		t.Fatalf("err from refreshAll: %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/drift?zone=jdl-example.com", nil))
+	drifts := []Drift{}
+	if err := json.NewDecoder(recorder.Body).Decode(&drifts); err != nil {
+		t.Fatalf("Body isn't a list of drifts: %v", err)
+	}
+	found := map[string]string{}
+	for _, d := range drifts {
+		found[d.Domain] = d.Change
+	}
+	expected := map[string]string{
+		"www.jdl-example.com":  Changed,
+		"mail.jdl-example.com": Deleted,
+		"ftp.jdl-example.com":  Added,
+	}
+	if len(drifts) != len(expected) {
+		t.Errorf("Expected %d drifts, got %#v", len(expected), drifts)
+	}
+	for domain, change := range expected {
+		if found[domain] != change {
+			t.Errorf("Expected %s to be %s, got %q", domain, change, found[domain])
+		}
+	}
+
+	record, err := store.GetRecord("jdl-example.com", "www.jdl-example.com", "A")
+	if err != nil || record == nil || record.Answers[0].String() != "9.9.9.9" {
+		t.Errorf("Expected the cache to have the changed record, got %v, %v", record, err)
+	}
+	if record, _ := store.GetRecord("jdl-example.com", "mail.jdl-example.com", "A"); record != nil {
+		t.Errorf("Expected the deleted record to be dropped from the cache, got %v", record)
+	}
+
+	if err := server.refreshAll(context.Background()); err != nil {
+		t.Fatalf("err from refreshAll: %v", err)
+	}
+	if n := len(server.drift.query("", time.Time{})); n != len(expected) {
+		t.Errorf("Expected no further drift once refreshed, got %d drifts in all", n)
+	}
+
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `dns_manager_drift_total{change="changed"} 1`) {
+		t.Errorf("Metrics don't count the drift:\n%s", recorder.Body.String())
+	}
+}
+
+func TestDriftRecordFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	domains := []string{"bad.jdl-example.com", "www.jdl-example.com", "mail.jdl-example.com"}
+	for _, domain := range domains {
+		record := dns.NewRecord("jdl-example.com", domain, "A")
+		record.AddAnswer(dns.NewAnswer([]string{"1.2.3.4"}))
+		fake.AddRecord(record)
+	}
+	server := New("example.com:80", store, "fake", fake.ClientFn)
+	mux := server.buildRouter()
+
+	// the failing record is cached, and so refreshed, first
+	for _, domain := range domains {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/record?zone=jdl-example.com&domain="+domain+"&type=A", nil))
+		if recorder.Code != 200 {
+			t.Fatalf("Expected 200 response caching %s, but status was %d \n%s", domain, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	for _, domain := range domains {
+		changed := dns.NewRecord("jdl-example.com", domain, "A")
+		changed.AddAnswer(dns.NewAnswer([]string{"9.9.9.9"}))
+		fake.AddRecord(changed)
+	}
+	fake.Inject(ns1fake.Fault{Method: "GET", Path: "/v1/zones/jdl-example.com/bad.jdl-example.com", Status: 503})
+
+	err = server.refreshAll(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "bad.jdl-example.com") {
+		t.Errorf("Expected the failing record to be reported, got %v", err)
+	}
+
+	for _, domain := range domains[1:] {
+		record, err := store.GetRecord("jdl-example.com", domain, "A")
+		if err != nil || record == nil || record.Answers[0].String() != "9.9.9.9" {
+			t.Errorf("Expected %s to be refreshed after the failure, got %v, %v", domain, record, err)
+		}
+	}
+	found := map[string]string{}
+	for _, d := range server.drift.query("jdl-example.com", time.Time{}) {
+		found[d.Domain] = d.Change
+	}
+	expected := map[string]string{"www.jdl-example.com": Changed, "mail.jdl-example.com": Changed}
+	if fmt.Sprint(found) != fmt.Sprint(expected) {
+		t.Errorf("Expected drift for the records that could be refreshed, got %v", found)
+	}
+}
+
+func TestDriftExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.New(filepath.Join(dir, "cache"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	record := dns.NewRecord("jdl-example.com", "www.jdl-example.com", "A")
+	record.AddAnswer(dns.NewAnswer([]string{"1.2.3.4"}))
+	fake.AddRecord(record)
+	server := New("example.com:80", store, "fake", fake.ClientFn)
+	mux := server.buildRouter()
+
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/record?zone=jdl-example.com&domain=www.jdl-example.com&type=A", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+
+	// the refresh interval is longer than the cache's TTL
+	time.Sleep(200 * time.Millisecond)
+	changed := dns.NewRecord("jdl-example.com", "www.jdl-example.com", "A")
+	changed.AddAnswer(dns.NewAnswer([]string{"9.9.9.9"}))
+	fake.AddRecord(changed)
+
+	if err := server.refreshAll(context.Background()); err != nil {
+		t.Fatalf("err from refreshAll: %v", err)
+	}
+	drifts := server.drift.query("", time.Time{})
+	if len(drifts) != 1 || drifts[0].Change != Changed {
+		t.Errorf("Expected the expired record's change to be reported, got %#v", drifts)
+	}
+	cached, err := store.GetRecord("jdl-example.com", "www.jdl-example.com", "A")
+	if err != nil || cached == nil || cached.Answers[0].String() != "9.9.9.9" {
+		t.Errorf("Expected the refresh to re-cache the changed record, got %v, %v", cached, err)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	harness, fake := fakeHarness(t)
+	defer harness.stopVCR()
+	fake.AddZone("jdl-example.com")
+	fake.Inject(ns1fake.Fault{Path: "/v1/zones/down-example.com", Status: 503})
+
+	cases := []struct {
+		method, path string
+		status       int
+		code         string
+		ns1Status    int
+	}{
+		{"GET", "/zone", 400, CodeBadRequest, 0},
+		{"POST", "/zone?name=jdl-example.com", 405, CodeMethodNotAllowed, 0},
+		{"GET", "/zone?name=missing-example.com", 404, CodeNotFound, 404},
+		{"GET", "/record?zone=jdl-example.com&domain=www.jdl-example.com&type=A", 404, CodeNotFound, 404},
+		{"GET", "/zone?name=down-example.com", 503, CodeNS1Unavailable, 503},
+		{"PUT", "/record?zone=jdl-example.com&domain=jdl-example.com&type=MX", 422, CodeInvalidAnswers, 0},
+	}
+	for _, c := range cases {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(c.method, c.path, buildBody(t, [][]string{{"mail.jdl-example.com"}}))
+		req.Header.Set("X-Request-Id", "req-errors")
+		harness.mux.ServeHTTP(recorder, req)
+
+		e := ErrorResponse{}
+		if err := json.NewDecoder(recorder.Body).Decode(&e); err != nil {
+			t.Errorf("%s %s: body isn't an error response: %v", c.method, c.path, err)
+			continue
+		}
+		if recorder.Code != c.status || e.Code != c.code || e.NS1Status != c.ns1Status {
+			t.Errorf("%s %s: expected %d %s (NS1 %d), got %d %#v", c.method, c.path, c.status, c.code, c.ns1Status, recorder.Code, e)
+		}
+		if e.RequestID != "req-errors" {
+			t.Errorf("%s %s: expected the request ID in the error, got %q", c.method, c.path, e.RequestID)
+		}
+	}
+}
+
+func TestDNS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	for _, r := range []struct {
+		domain, kind string
+		answers      [][]string
+	}{
+		{"www.jdl-example.com", "A", [][]string{{"1.2.3.4"}}},
+		{"mail.jdl-example.com", "A", [][]string{{"5.6.7.8"}}},
+		{"jdl-example.com", "MX", [][]string{{"10", "mail.jdl-example.com"}}},
+		{"lb.jdl-example.com", "CNAME", [][]string{{"www.jdl-example.com"}}},
+		{"*.wild.jdl-example.com", "A", [][]string{{"9.9.9.9"}}},
+		{"sub.jdl-example.com", "NS", [][]string{{"ns.sub.jdl-example.com"}}},
+		{"ns.sub.jdl-example.com", "A", [][]string{{"10.0.0.53"}}},
+		{"a.b.jdl-example.com", "TXT", [][]string{{"deep"}}},
+	} {
+		record := dns.NewRecord("jdl-example.com", r.domain, r.kind)
+		for _, a := range r.answers {
+			record.AddAnswer(dns.NewAnswer(a))
+		}
+		fake.AddRecord(record)
+	}
+
+	free, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsAddr := free.LocalAddr().String()
+	free.Close()
+
+	server := New("127.0.0.1:0", store, "fake", fake.ClientFn, SetDNS(dnsAddr))
+	recorder := httptest.NewRecorder()
+	server.buildRouter().ServeHTTP(recorder, httptest.NewRequest("GET", "/zone?name=jdl-example.com", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response caching the zone, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+	// from here on, answers come from the cache alone
+	fake.Inject(ns1fake.Fault{Status: 503})
+
+	cases := []struct {
+		name      string
+		qtype     uint16
+		rcode     int
+		aa        bool
+		answer    []string
+		authority uint16
+	}{
+		{"www.jdl-example.com.", mdns.TypeA, mdns.RcodeSuccess, true, []string{"1.2.3.4"}, mdns.TypeNS},
+		{"WWW.jdl-example.com.", mdns.TypeA, mdns.RcodeSuccess, true, []string{"1.2.3.4"}, mdns.TypeNS},
+		{"jdl-example.com.", mdns.TypeMX, mdns.RcodeSuccess, true, []string{"mail.jdl-example.com."}, mdns.TypeNS},
+		{"jdl-example.com.", mdns.TypeSOA, mdns.RcodeSuccess, true, []string{"dns1.p01.nsone.net."}, mdns.TypeNS},
+		{"lb.jdl-example.com.", mdns.TypeA, mdns.RcodeSuccess, true, []string{"www.jdl-example.com.", "1.2.3.4"}, mdns.TypeNS},
+		{"anything.wild.jdl-example.com.", mdns.TypeA, mdns.RcodeSuccess, true, []string{"9.9.9.9"}, mdns.TypeNS},
+		{"www.jdl-example.com.", mdns.TypeAAAA, mdns.RcodeSuccess, true, nil, mdns.TypeSOA},
+		{"b.jdl-example.com.", mdns.TypeA, mdns.RcodeSuccess, true, nil, mdns.TypeSOA},
+		{"nope.jdl-example.com.", mdns.TypeA, mdns.RcodeNameError, true, nil, mdns.TypeSOA},
+		{"host.sub.jdl-example.com.", mdns.TypeA, mdns.RcodeSuccess, false, nil, mdns.TypeNS},
+		{"www.elsewhere.com.", mdns.TypeA, mdns.RcodeRefused, false, nil, 0},
+	}
+	for _, c := range cases {
+		req := new(mdns.Msg).SetQuestion(c.name, c.qtype)
+		m := server.answerDNS(req)
+		label := fmt.Sprintf("%s %s", c.name, mdns.TypeToString[c.qtype])
+
+		if m.Rcode != c.rcode || m.Authoritative != c.aa {
+			t.Errorf("%s: expected %s (aa %v), got %s (aa %v)", label, mdns.RcodeToString[c.rcode], c.aa, mdns.RcodeToString[m.Rcode], m.Authoritative)
+		}
+		if len(m.Answer) != len(c.answer) {
+			t.Errorf("%s: expected answers %v, got %v", label, c.answer, m.Answer)
+		}
+		for i := 0; i < len(m.Answer) && i < len(c.answer); i++ {
+			if !strings.Contains(m.Answer[i].String(), c.answer[i]) {
+				t.Errorf("%s: expected answer %d to include %q, got %v", label, i, c.answer[i], m.Answer[i])
+			}
+			if i == 0 && m.Answer[0].Header().Name != c.name {
+				t.Errorf("%s: expected the answer to be for the name asked about, got %v", label, m.Answer[0])
+			}
+		}
+		if c.authority != 0 && (len(m.Ns) == 0 || m.Ns[0].Header().Rrtype != c.authority) {
+			t.Errorf("%s: expected %s in the authority section, got %v", label, mdns.TypeToString[c.authority], m.Ns)
+		}
+	}
+
+	req := new(mdns.Msg).SetQuestion("jdl-example.com.", mdns.TypeMX)
+	if m := server.answerDNS(req); len(m.Extra) != 1 || !strings.Contains(m.Extra[0].String(), "5.6.7.8") {
+		t.Errorf("Expected the mail server's address as additional data, got %v", m.Extra)
+	}
+	req = new(mdns.Msg).SetQuestion("host.sub.jdl-example.com.", mdns.TypeA)
+	if m := server.answerDNS(req); len(m.Extra) != 1 || !strings.Contains(m.Extra[0].String(), "10.0.0.53") {
+		t.Errorf("Expected glue for the delegation, got %v", m.Extra)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	defer func() {
+		stop()
+		if err := <-done; err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+	}()
+
+	client := &mdns.Client{}
+	for i := 0; ; i++ {
+		m, _, err := client.Exchange(new(mdns.Msg).SetQuestion("www.jdl-example.com.", mdns.TypeA), dnsAddr)
+		if err == nil {
+			if len(m.Answer) != 1 || !strings.Contains(m.Answer[0].String(), "1.2.3.4") {
+				t.Errorf("Expected an answer over UDP, got %v", m)
+			}
+			break
+		}
+		if i > 100 {
+			t.Fatalf("DNS server never answered: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDNSCache(t *testing.T) {
+	zone := dns.NewZone("jdl-example.com")
+	for i := 0; i < 1000; i++ {
+		zone.Records = append(zone.Records, &dns.ZoneRecord{
+			Domain:   fmt.Sprintf("host%d.jdl-example.com", i),
+			Type:     "A",
+			TTL:      300,
+			ShortAns: []string{fmt.Sprintf("10.0.%d.%d", i/256, i%256)},
+		})
+	}
+	www := dns.NewRecord("jdl-example.com", "host0.jdl-example.com", "A")
+	www.AddAnswer(dns.NewAnswer([]string{"1.2.3.4"}))
+
+	store := storage.NewSpy()
+	store.MatchMethod("ListZones", spies.AnyArgs, []*dns.Zone{zone}, nil)
+	store.MatchMethod("ListRecords", spies.AnyArgs, []*dns.Record{www}, nil)
+	fake := ns1fake.Start()
+	defer fake.Close()
+	server := New("127.0.0.1:0", store, "fake", fake.ClientFn)
+
+	query := func(name string, rcode int, answer string) {
+		t.Helper()
+		m := server.answerDNS(new(mdns.Msg).SetQuestion(name, mdns.TypeA))
+		if m.Rcode != rcode || (answer != "" && (len(m.Answer) != 1 || !strings.Contains(m.Answer[0].String(), answer))) {
+			t.Errorf("%s: expected %s %s, got %v", name, mdns.RcodeToString[rcode], answer, m)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		query("host0.jdl-example.com.", mdns.RcodeSuccess, "1.2.3.4")
+		query("host999.jdl-example.com.", mdns.RcodeSuccess, "10.0.3.231")
+		query(fmt.Sprintf("random%d.elsewhere.com.", i), mdns.RcodeRefused, "")
+	}
+	if n := len(store.CallsTo("ListZones")); n != 1 {
+		t.Errorf("Expected the zones to be listed once, got %d", n)
+	}
+	if n := len(store.CallsTo("ListRecords")); n != 1 {
+		t.Errorf("Expected the zone's records to be listed once, got %d", n)
+	}
+	if n := len(store.CallsTo("GetZone")) + len(store.CallsTo("GetRecord")); n != 0 {
+		t.Errorf("Expected no other storage reads, got %d", n)
+	}
+	if n := len(fake.Requests()); n != 0 {
+		t.Errorf("Expected queries never to reach NS1, got %v", fake.Requests())
+	}
+
+	// any change to the cache means building the zone again
+	server.storage.RecordRecord(*www)
+	query("host0.jdl-example.com.", mdns.RcodeSuccess, "1.2.3.4")
+	if n := len(store.CallsTo("ListRecords")); n != 2 {
+		t.Errorf("Expected the zone to be built again after a write, got %d listings", n)
+	}
+}
+
+// remoteWriter is a ResponseWriter for a client at addr, whose message's
+// signature had the given status
+type remoteWriter struct {
+	mdns.ResponseWriter
+	addr       net.Addr
+	tsigStatus error
+}
+
+func (w remoteWriter) RemoteAddr() net.Addr { return w.addr }
+func (w remoteWriter) TsigStatus() error   { return w.tsigStatus }
+
+func TestTransferAllowed(t *testing.T) {
+	allow, err := ParseNetworks([]string{"192.0.2.1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseNetworks([]string{"secondary.example.com"}); err == nil {
+		t.Errorf("Expected an error parsing a host name as a network")
+	}
+
+	open := New("127.0.0.1:0", nil, "fake", nil, SetTransfer(allow))
+	signed := New("127.0.0.1:0", nil, "fake", nil, SetTransfer(allow), SetTSIGKeys(TSIGKeys{{Name: "xfr.", Algorithm: "hmac-sha256", Secret: "c2VjcmV0"}}))
+	keyless := New("127.0.0.1:0", nil, "fake", nil, SetTransfer(allow), SetTSIGKeys(nil))
+	unsignedReq := new(mdns.Msg).SetAxfr("jdl-example.com.")
+	signedReq := new(mdns.Msg).SetAxfr("jdl-example.com.")
+	signedReq.SetTsig("xfr.", mdns.HmacSHA256, 300, time.Now().Unix())
+
+	cases := []struct {
+		server  *Server
+		ip      string
+		req     *mdns.Msg
+		status  error
+		allowed bool
+	}{
+		{open, "192.0.2.1", unsignedReq, nil, true},
+		{open, "10.1.2.3", unsignedReq, nil, true},
+		{open, "192.0.2.2", unsignedReq, nil, false},
+		{signed, "192.0.2.1", unsignedReq, nil, false},
+		{signed, "192.0.2.1", signedReq, nil, true},
+		{signed, "192.0.2.1", signedReq, mdns.ErrSig, false},
+		{signed, "192.0.2.2", signedReq, nil, false},
+		{keyless, "192.0.2.1", unsignedReq, nil, false},
+	}
+	for i, c := range cases {
+		w := remoteWriter{addr: &net.TCPAddr{IP: net.ParseIP(c.ip), Port: 53}, tsigStatus: c.status}
+		if allowed := c.server.transferAllowed(w, c.req); allowed != c.allowed {
+			t.Errorf("Case %d: expected a transfer to %s to be allowed %v, got %v", i, c.ip, c.allowed, allowed)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	record := dns.NewRecord("jdl-example.com", "www.jdl-example.com", "A")
+	record.AddAnswer(dns.NewAnswer([]string{"1.2.3.4"}))
+	fake.AddRecord(record)
+
+	keyPath := filepath.Join(dir, "tsig.yaml")
+	if err := ioutil.WriteFile(keyPath, []byte("keys:\n- name: xfr\n  secret: c2VjcmV0\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := LoadTSIGKeys(keyPath)
+	if err != nil {
+		t.Fatalf("Loading TSIG keys: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Name != "xfr." || keys[0].Algorithm != "hmac-sha256" {
+		t.Errorf("Unexpected TSIG keys: %#v", keys)
+	}
+	for _, bad := range []string{
+		"keys:\n- secret: c2VjcmV0\n",
+		"keys:\n- name: xfr\n  secret: not base64!\n",
+		"keys:\n- name: xfr\n  algorithm: rot13\n  secret: c2VjcmV0\n",
+		"keys:\n- name: xfr\n  secret: c2VjcmV0\n- name: XFR.\n  secret: c2VjcmV0\n",
+		"keys:\n- name: xfr\n  secrt: c2VjcmV0\n",
+		"key:\n- name: xfr\n  secret: c2VjcmV0\n",
+	} {
+		if err := ioutil.WriteFile(keyPath, []byte(bad), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadTSIGKeys(keyPath); err == nil {
+			t.Errorf("Expected an error loading %q", bad)
+		}
+	}
+
+	free, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsAddr := free.LocalAddr().String()
+	free.Close()
+	allow, err := ParseNetworks([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New("127.0.0.1:0", store, "fake", fake.ClientFn, SetDNS(dnsAddr), SetTransfer(allow), SetTSIGKeys(keys))
+	mux := server.buildRouter()
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/zone?name=jdl-example.com", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response caching the zone, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	defer func() {
+		stop()
+		if err := <-done; err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+	}()
+
+	secrets := map[string]string{"xfr.": "c2VjcmV0"}
+	transfer := func(req *mdns.Msg) ([]mdns.RR, error) {
+		tr := &mdns.Transfer{TsigSecret: secrets}
+		var ch chan *mdns.Envelope
+		var err error
+		for i := 0; ; i++ {
+			if ch, err = tr.In(req, dnsAddr); err == nil || i > 100 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rrs := []mdns.RR{}
+		for env := range ch {
+			if env.Error != nil {
+				return nil, env.Error
+			}
+			rrs = append(rrs, env.RR...)
+		}
+		return rrs, nil
+	}
+	signed := func(req *mdns.Msg) *mdns.Msg {
+		return req.SetTsig("xfr.", mdns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	if _, err := transfer(new(mdns.Msg).SetAxfr("jdl-example.com.")); err == nil {
+		t.Errorf("Expected an unsigned transfer to be refused")
+	}
+
+	rrs, err := transfer(signed(new(mdns.Msg).SetAxfr("jdl-example.com.")))
+	if err != nil {
+		t.Fatalf("Transferring the zone: %v", err)
+	}
+	if len(rrs) < 3 || rrs[0].Header().Rrtype != mdns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != mdns.TypeSOA {
+		t.Fatalf("Expected the zone between SOAs, got %v", rrs)
+	}
+	if !strings.Contains(fmt.Sprint(rrs), "1.2.3.4") {
+		t.Errorf("Expected the zone's records, got %v", rrs)
+	}
+	serial := rrs[0].(*mdns.SOA).Serial
+
+	req := httptest.NewRequest("PUT", "/record", buildBody(t, [][]string{{"5.6.7.8"}}))
+	req.URL.RawQuery = "zone=jdl-example.com&domain=new.jdl-example.com&type=A"
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response creating a record, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+
+	rrs, err = transfer(signed(new(mdns.Msg).SetIxfr("jdl-example.com.", serial, ".", ".")))
+	if err != nil {
+		t.Fatalf("Transferring changes to the zone: %v", err)
+	}
+	// the new SOA, then the old one with nothing deleted, the new one with what was added, and the new one again
+	if len(rrs) != 5 {
+		t.Fatalf("Expected an incremental transfer, got %v", rrs)
+	}
+	latest := rrs[0].(*mdns.SOA).Serial
+	if !serialAfter(latest, serial) || rrs[1].(*mdns.SOA).Serial != serial || rrs[2].(*mdns.SOA).Serial != latest {
+		t.Errorf("Expected the serial to move on from %d, got %v", serial, rrs)
+	}
+	if !strings.Contains(rrs[3].String(), "5.6.7.8") {
+		t.Errorf("Expected the new record to have been added, got %v", rrs[3])
+	}
+
+	rrs, err = transfer(signed(new(mdns.Msg).SetIxfr("jdl-example.com.", latest, ".", ".")))
+	if err != nil {
+		t.Fatalf("Transferring an unchanged zone: %v", err)
+	}
+	if len(rrs) != 1 || rrs[0].(*mdns.SOA).Serial != latest {
+		t.Errorf("Expected just the SOA for a secondary that's up to date, got %v", rrs)
+	}
+
+	m, _, err := (&mdns.Client{TsigSecret: secrets}).Exchange(signed(new(mdns.Msg).SetQuestion("jdl-example.com.", mdns.TypeSOA)), dnsAddr)
+	if err != nil {
+		t.Fatalf("Asking for the SOA: %v", err)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].(*mdns.SOA).Serial != latest {
+		t.Errorf("Expected the SOA to carry the latest serial, got %v", m.Answer)
+	}
+}
+
+func TestJournalRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	record := dns.NewRecord("jdl-example.com", "www.jdl-example.com", "A")
+	record.AddAnswer(dns.NewAnswer([]string{"1.2.3.4"}))
+	fake.AddRecord(record)
+
+	journalPath := filepath.Join(dir, "cache.journal")
+	start := func() *Server {
+		journal, err := LoadJournal(journalPath)
+		if err != nil {
+			t.Fatalf("Loading the journal: %v", err)
+		}
+		return New("127.0.0.1:0", store, "fake", fake.ClientFn, SetJournal(journal))
+	}
+	serial := func(server *Server) (*authority, uint32) {
+		z, err := server.authorityFor("jdl-example.com")
+		if err != nil || z == nil {
+			t.Fatalf("Expected the zone to be served, got %v, %v", z, err)
+		}
+		return z, z.soa.Serial
+	}
+
+	server := start()
+	mux := server.buildRouter()
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/zone?name=jdl-example.com", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response caching the zone, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+	_, first := serial(server)
+
+	req := httptest.NewRequest("PUT", "/record", buildBody(t, [][]string{{"5.6.7.8"}}))
+	req.URL.RawQuery = "zone=jdl-example.com&domain=new.jdl-example.com&type=A"
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response creating a record, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+	_, second := serial(server)
+	if !serialAfter(second, first) {
+		t.Fatalf("Expected the serial to move on from %d, got %d", first, second)
+	}
+
+	restarted := start()
+	z, latest := serial(restarted)
+	if latest != second {
+		t.Errorf("Expected the serial to carry on from %d after a restart, got %d", second, latest)
+	}
+	rrs := restarted.ixfr(z, first)[0]
+	if len(rrs) != 5 || !strings.Contains(rrs[3].String(), "5.6.7.8") {
+		t.Errorf("Expected the change from before the restart to be sent incrementally, got %v", rrs)
+	}
+
+	if err := ioutil.WriteFile(journalPath, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadJournal(journalPath); err == nil {
+		t.Errorf("Expected an error loading a corrupt journal")
+	}
+}
+
+func TestDNSUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "update")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.New(filepath.Join(dir, "cache"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	for domain, ip := range map[string]string{"www.jdl-example.com": "1.2.3.4", "mail.jdl-example.com": "5.6.7.8"} {
+		record := dns.NewRecord("jdl-example.com", domain, "A")
+		record.AddAnswer(dns.NewAnswer([]string{ip}))
+		fake.AddRecord(record)
+	}
+
+	free, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsAddr := free.LocalAddr().String()
+	free.Close()
+
+	keys := TSIGKeys{{Name: "dhcp.", Algorithm: "hmac-sha256", Secret: "c2VjcmV0"}}
+	server := New("127.0.0.1:0", store, "fake", fake.ClientFn, SetDNS(dnsAddr), SetTSIGKeys(keys), SetDNSUpdate())
+	recorder := httptest.NewRecorder()
+	server.buildRouter().ServeHTTP(recorder, httptest.NewRequest("GET", "/zone?name=jdl-example.com", nil))
+	if recorder.Code != 200 {
+		t.Fatalf("Expected 200 response caching the zone, but status was %d \n%s", recorder.Code, recorder.Body.String())
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	defer func() {
+		stop()
+		if err := <-done; err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+	}()
+
+	client := &mdns.Client{TsigSecret: map[string]string{"dhcp.": "c2VjcmV0"}}
+	exchange := func(m *mdns.Msg, sign bool) *mdns.Msg {
+		t.Helper()
+		if sign {
+			m.SetTsig("dhcp.", mdns.HmacSHA256, 300, time.Now().Unix())
+		}
+		var rz *mdns.Msg
+		var err error
+		for i := 0; i < 100; i++ {
+			if rz, _, err = client.Exchange(m, dnsAddr); err == nil {
+				return rz
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("DNS server never answered: %v", err)
+		return nil
+	}
+	rr := func(s string) mdns.RR {
+		t.Helper()
+		rr, err := mdns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rr
+	}
+	update := func() *mdns.Msg { return new(mdns.Msg).SetUpdate("jdl-example.com.") }
+
+	m := update()
+	m.Insert([]mdns.RR{rr("new.jdl-example.com. 300 IN A 9.9.9.9")})
+	if rz := exchange(m, false); rz.Rcode != mdns.RcodeRefused {
+		t.Errorf("Expected an unsigned update to be refused, got %s", mdns.RcodeToString[rz.Rcode])
+	}
+
+	m = update()
+	m.NameNotUsed([]mdns.RR{rr("www.jdl-example.com. 0 IN A 0.0.0.0")})
+	m.Insert([]mdns.RR{rr("new.jdl-example.com. 300 IN A 9.9.9.9")})
+	if rz := exchange(m, true); rz.Rcode != mdns.RcodeYXDomain {
+		t.Errorf("Expected a failed prerequisite to stop the update, got %s", mdns.RcodeToString[rz.Rcode])
+	}
+	if _, _, err := server.getRecordAPI(ctx, "jdl-example.com", "new.jdl-example.com", "A"); err != ns1.ErrRecordMissing {
+		t.Errorf("Expected nothing to have been added, got %v", err)
+	}
+
+	m = update()
+	m.RRsetUsed([]mdns.RR{rr("www.jdl-example.com. 0 IN A 0.0.0.0")})
+	m.Insert([]mdns.RR{rr("new.jdl-example.com. 300 IN A 9.9.9.9")})
+	m.Remove([]mdns.RR{rr("www.jdl-example.com. 0 IN A 1.2.3.4")})
+	m.RemoveRRset([]mdns.RR{rr("mail.jdl-example.com. 0 IN A 0.0.0.0")})
+	rz := exchange(m, true)
+	if rz.Rcode != mdns.RcodeSuccess {
+		t.Fatalf("Expected the update to succeed, got %s", mdns.RcodeToString[rz.Rcode])
+	}
+	if rz.IsTsig() == nil {
+		t.Errorf("Expected the response to be signed")
+	}
+	record, _, err := server.getRecordAPI(ctx, "jdl-example.com", "new.jdl-example.com", "A")
+	if err != nil || record.TTL != 300 || len(record.Answers) != 1 || record.Answers[0].Rdata[0] != "9.9.9.9" {
+		t.Errorf("Expected the new record at NS1, got %v, %v", record, err)
+	}
+	for _, domain := range []string{"www.jdl-example.com", "mail.jdl-example.com"} {
+		if _, _, err := server.getRecordAPI(ctx, "jdl-example.com", domain, "A"); err != ns1.ErrRecordMissing {
+			t.Errorf("Expected %s to have been deleted, got %v", domain, err)
+		}
+	}
+
+	m = update()
+	m.Used([]mdns.RR{rr("new.jdl-example.com. 0 IN A 9.9.9.9")})
+	m.Insert([]mdns.RR{rr("new.jdl-example.com. 600 IN A 9.9.9.10")})
+	if rz := exchange(m, true); rz.Rcode != mdns.RcodeSuccess {
+		t.Fatalf("Expected adding to an RRset to succeed, got %s", mdns.RcodeToString[rz.Rcode])
+	}
+	answer := exchange(new(mdns.Msg).SetQuestion("new.jdl-example.com.", mdns.TypeA), false)
+	if len(answer.Answer) != 2 || answer.Answer[0].Header().Ttl != 600 {
+		t.Errorf("Expected both addresses to be served, got %v", answer.Answer)
+	}
+
+	m = update()
+	m.Insert([]mdns.RR{rr("elsewhere.com. 300 IN A 9.9.9.9")})
+	if rz := exchange(m, true); rz.Rcode != mdns.RcodeNotZone {
+		t.Errorf("Expected an update outside the zone to be refused, got %s", mdns.RcodeToString[rz.Rcode])
+	}
+}
+
+func TestACME(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy, err := LoadPolicy(writePolicy(t, dir, `
+rules:
+- name: acme-challenges
+  effect: allow
+  principals: [certbot]
+  verbs: [update-record, delete-record]
+  domains: ["_acme-challenge.*"]
+  types: [TXT]
+`))
+	if err != nil {
+		t.Fatalf("Loading policy: %v", err)
+	}
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	server := New("example.com:80", storage.NewSpy(), "fake", fake.ClientFn,
+		SetTokens(Tokens{{Name: "certbot", Token: "certbot-secret"}}), SetPolicy(policy))
+	mux := server.buildRouter()
+
+	post := func(path string, challenge ACMEChallenge) (int, ACMEChallenge) {
+		t.Helper()
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, buildBody(t, challenge))
+		// as lego's httpreq sends it
+		req.SetBasicAuth("lego", "certbot-secret")
+		mux.ServeHTTP(recorder, req)
+		rz := ACMEChallenge{}
+		json.NewDecoder(recorder.Body).Decode(&rz)
+		return recorder.Code, rz
+	}
+	answers := func(fqdn string) []string {
+		t.Helper()
+		record, _, err := server.getRecordAPI(context.Background(), "jdl-example.com", fqdn, "TXT")
+		if err == ns1.ErrRecordMissing {
+			return nil
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := []string{}
+		for _, a := range record.Answers {
+			values = append(values, a.Rdata[0])
+		}
+		return values
+	}
+	const name = "_acme-challenge.jdl-example.com"
+
+	for _, value := range []string{"first", "second", "first"} {
+		if status, _ := post("/acme/present", ACMEChallenge{FQDN: name + ".", Value: value}); status != 200 {
+			t.Errorf("Expected presenting %q to succeed, got %d", value, status)
+		}
+	}
+	if got := answers(name); fmt.Sprint(got) != "[first second]" {
+		t.Errorf("Expected both challenges' answers, once each, got %v", got)
+	}
+
+	sum := sha256.Sum256([]byte("token.thumbprint"))
+	status, raw := post("/acme/present", ACMEChallenge{Domain: "*.www.jdl-example.com", Token: "token", KeyAuth: "token.thumbprint"})
+	if status != 200 || raw.FQDN != "_acme-challenge.www.jdl-example.com" || raw.Value != base64.RawURLEncoding.EncodeToString(sum[:]) {
+		t.Errorf("Expected a RAW mode challenge to be presented, got %d %#v", status, raw)
+	}
+
+	if status, _ := post("/acme/present", ACMEChallenge{FQDN: "www.jdl-example.com", Value: "hijack"}); status != 400 {
+		t.Errorf("Expected a name other than _acme-challenge to be refused, got %d", status)
+	}
+	if status, _ := post("/acme/present", ACMEChallenge{FQDN: "_acme-challenge.elsewhere.com", Value: "first"}); status != 404 {
+		t.Errorf("Expected a name in no zone to be not found, got %d", status)
+	}
+
+	if status, _ := post("/acme/cleanup", ACMEChallenge{FQDN: name, Value: "first"}); status != 200 {
+		t.Errorf("Expected cleaning up to succeed, got %d", status)
+	}
+	if got := answers(name); fmt.Sprint(got) != "[second]" {
+		t.Errorf("Expected the other challenge's answer to be kept, got %v", got)
+	}
+	for i := 0; i < 2; i++ {
+		if status, _ := post("/acme/cleanup", ACMEChallenge{FQDN: name, Value: "second"}); status != 200 {
+			t.Errorf("Expected cleaning up to succeed, got %d", status)
+		}
+	}
+	if got := answers(name); got != nil {
+		t.Errorf("Expected the record to be deleted with its last answer, got %v", got)
+	}
+}
+
+func TestACMEZoneDiscovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy, err := LoadPolicy(writePolicy(t, dir, `
+rules:
+- name: certbot
+  effect: allow
+  principals: [certbot]
+  zones: [jdl-example.com]
+- name: ops
+  effect: allow
+  principals: [ops]
+`))
+	if err != nil {
+		t.Fatalf("Loading policy: %v", err)
+	}
+
+	fake := ns1fake.Start()
+	defer fake.Close()
+	fake.AddZone("jdl-example.com")
+	fake.AddZone("other-example.com")
+	server := New("example.com:80", storage.NewSpy(), "fake", fake.ClientFn,
+		SetTokens(Tokens{{Name: "certbot", Token: "certbot-secret"}, {Name: "ops", Token: "ops-secret"}}), SetPolicy(policy))
+	mux := server.buildRouter()
+
+	// present returns the status and the zones NS1 was asked about
+	present := func(token, fqdn string) (int, []string) {
+		t.Helper()
+		before := len(fake.Requests())
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/acme/present", buildBody(t, ACMEChallenge{FQDN: fqdn, Value: "value"}))
+		req.Header.Set("Authorization", "Bearer "+token)
+		mux.ServeHTTP(recorder, req)
+
+		probed := []string{}
+		for _, r := range fake.Requests()[before:] {
+			parts := strings.Split(strings.TrimPrefix(r, "GET /v1/zones/"), "/")
+			if strings.HasPrefix(r, "GET ") && len(parts) == 1 {
+				probed = append(probed, parts[0])
+			}
+		}
+		return recorder.Code, probed
+	}
+
+	for _, fqdn := range []string{"_acme-challenge.www.other-example.com", "_acme-challenge.www.missing-example.com"} {
+		status, probed := present("certbot-secret", fqdn)
+		if status != 403 {
+			t.Errorf("%s: expected a zone the token can't change to be forbidden, whether or not it exists, got %d", fqdn, status)
+		}
+		if len(probed) > 0 {
+			t.Errorf("%s: expected NS1 not to be asked about zones the token can't change, got %v", fqdn, probed)
+		}
+	}
+
+	status, probed := present("certbot-secret", "_acme-challenge.www.jdl-example.com")
+	if status != 200 || fmt.Sprint(probed) != "[jdl-example.com]" {
+		t.Errorf("Expected only the token's own zone to be looked up, got %d %v", status, probed)
+	}
+
+	status, probed = present("ops-secret", "_acme-challenge.www.other-example.com")
+	if status != 200 || fmt.Sprint(probed) != "[www.other-example.com other-example.com]" {
+		t.Errorf("Expected zones to be looked for from the challenged name up, got %d %v", status, probed)
+	}
+	if status, _ := present("ops-secret", "_acme-challenge.www.missing-example.com"); status != 404 {
+		t.Errorf("Expected a name in no zone to be not found, got %d", status)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+)
+
+// transferChunk is how many RRs are sent in each message of a zone transfer
+const transferChunk = 100
+
+// SetTransfer lets DNS clients at the addresses in allow transfer cached
+// zones (AXFR and IXFR), e.g. to act as secondaries. If the server was also
+// given SetTSIGKeys, transfer requests must be signed with one of the keys.
+func SetTransfer(allow []*net.IPNet) Option {
+	return func(s *Server) {
+		s.transferAllow = allow
+	}
+}
+
+// ParseNetworks parses IP addresses and CIDR blocks, e.g. for SetTransfer
+func ParseNetworks(specs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, spec := range specs {
+		if !strings.Contains(spec, "/") {
+			ip := net.ParseIP(spec)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is neither an IP address nor a CIDR block", spec)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// serialAfter compares serials as RFC 1982 says to, allowing for wrapping
+func serialAfter(a, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// transferAllowed checks a transfer request's source address, and its
+// signature if we have TSIG keys
+func (s *Server) transferAllowed(w mdns.ResponseWriter, req *mdns.Msg) bool {
+	var ip net.IP
+	switch addr := w.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+
+	listed := false
+	for _, network := range s.transferAllow {
+		listed = listed || network.Contains(ip)
+	}
+	if !listed {
+		return false
+	}
+	if !s.requireTSIG {
+		return true
+	}
+	signer, err := s.tsigKeys.signer(w, req)
+	return err == nil && signer != ""
+}
+
+// serveTransfer answers AXFR and IXFR requests, returning the response code
+func (s *Server) serveTransfer(w mdns.ResponseWriter, req *mdns.Msg) int {
+	refuse := func(rcode int) int {
+		w.WriteMsg(new(mdns.Msg).SetRcode(req, rcode))
+		return rcode
+	}
+
+	q := req.Question[0]
+	_, udp := w.RemoteAddr().(*net.UDPAddr)
+	if !s.transferAllowed(w, req) || (udp && q.Qtype == mdns.TypeAXFR) {
+		return refuse(mdns.RcodeRefused)
+	}
+
+	z, err := s.authorityFor(q.Name)
+	if err != nil {
+		return refuse(mdns.RcodeServerFailure)
+	}
+	if z == nil || z.apex != strings.ToLower(mdns.Fqdn(q.Name)) {
+		return refuse(mdns.RcodeNotAuth)
+	}
+
+	var envelopes [][]mdns.RR
+	switch q.Qtype {
+	case mdns.TypeAXFR:
+		envelopes = z.axfr()
+	case mdns.TypeIXFR:
+		if len(req.Ns) == 0 {
+			return refuse(mdns.RcodeFormatError)
+		}
+		soa, ok := req.Ns[0].(*mdns.SOA)
+		if !ok {
+			return refuse(mdns.RcodeFormatError)
+		}
+		envelopes = s.ixfr(z, soa.Serial)
+		if udp && len(envelopes[0]) > 1 {
+			// RFC 1995: the client should try again over TCP
+			envelopes = [][]mdns.RR{{z.soa}}
+		}
+	}
+
+	ch := make(chan *mdns.Envelope)
+	go func() {
+		defer close(ch)
+		for _, rrs := range envelopes {
+			ch <- &mdns.Envelope{RR: rrs}
+		}
+	}()
+	transfer := &mdns.Transfer{}
+	if err := transfer.Out(w, req, ch); err != nil {
+		for range ch {
+		}
+	}
+	return mdns.RcodeSuccess
+}
+
+// axfr is the whole zone, between copies of its SOA
+func (z *authority) axfr() [][]mdns.RR {
+	rrs := append([]mdns.RR{z.soa}, z.records()...)
+	return chunked(append(rrs, z.soa))
+}
+
+// ixfr is what changed since a secondary's serial, or the whole zone if the
+// journal doesn't reach back that far
+func (s *Server) ixfr(z *authority, serial uint32) [][]mdns.RR {
+	if !serialAfter(z.soa.Serial, serial) {
+		return [][]mdns.RR{{z.soa}}
+	}
+	changes, ok := s.journal.between(z.apex, serial, z.soa.Serial)
+	if !ok {
+		return z.axfr()
+	}
+
+	rrs := []mdns.RR{z.soa}
+	for _, c := range changes {
+		deleted, err := parseRRs(c.Deleted)
+		if err != nil {
+			return z.axfr()
+		}
+		added, err := parseRRs(c.Added)
+		if err != nil {
+			return z.axfr()
+		}
+		from := mdns.Copy(z.soa).(*mdns.SOA)
+		from.Serial = c.From
+		to := mdns.Copy(z.soa).(*mdns.SOA)
+		to.Serial = c.To
+		rrs = append(rrs, from)
+		rrs = append(rrs, deleted...)
+		rrs = append(rrs, to)
+		rrs = append(rrs, added...)
+	}
+	return chunked(append(rrs, z.soa))
+}
+
+func chunked(rrs []mdns.RR) [][]mdns.RR {
+	chunks := [][]mdns.RR{}
+	for len(rrs) > transferChunk {
+		chunks = append(chunks, rrs[:transferChunk])
+		rrs = rrs[transferChunk:]
+	}
+	return append(chunks, rrs)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// TSIGKey is a shared secret DNS clients sign their messages with (RFC 8945)
+type TSIGKey struct {
+	Name string `yaml:"name"`
+	// Algorithm is e.g. hmac-sha256 (the default) or hmac-sha512
+	Algorithm string `yaml:"algorithm,omitempty"`
+	// Secret is base64, as generated by e.g. tsig-keygen
+	Secret string `yaml:"secret"`
+}
+
+// TSIGKeys are the keys the DNS server accepts signatures from
+type TSIGKeys []TSIGKey
+
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    mdns.HmacMD5,
+	"hmac-sha1":   mdns.HmacSHA1,
+	"hmac-sha256": mdns.HmacSHA256,
+	"hmac-sha512": mdns.HmacSHA512,
+}
+
+// LoadTSIGKeys reads a TSIG key file:
+//
+//	keys:
+//	- name: secondaries
+//	  algorithm: hmac-sha256
+//	  secret: 3q2+7w==...
+func LoadTSIGKeys(path string) (TSIGKeys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	file := struct {
+		Keys TSIGKeys `yaml:"keys"`
+	}{}
+	dec := yaml.NewDecoder(f)
+	dec.SetStrict(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(file.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+
+	names := map[string]bool{}
+	for i := range file.Keys {
+		k := &file.Keys[i]
+		if k.Name == "" {
+			return nil, fmt.Errorf("%s: key %d has no name", path, i+1)
+		}
+		k.Name = strings.ToLower(mdns.Fqdn(k.Name))
+		if names[k.Name] {
+			return nil, fmt.Errorf("%s: %s is named twice", path, k.Name)
+		}
+		names[k.Name] = true
+
+		if k.Algorithm == "" {
+			k.Algorithm = "hmac-sha256"
+		}
+		if _, known := tsigAlgorithms[strings.ToLower(k.Algorithm)]; !known {
+			return nil, fmt.Errorf("%s: %s has unknown algorithm %q", path, k.Name, k.Algorithm)
+		}
+		if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil || k.Secret == "" {
+			return nil, fmt.Errorf("%s: %s's secret is not base64", path, k.Name)
+		}
+	}
+	return file.Keys, nil
+}
+
+// SetTSIGKeys makes the DNS server accept messages signed with keys, and
+// sign its answers to them. Zone transfers must then be signed, even if
+// keys is empty.
+func SetTSIGKeys(keys TSIGKeys) Option {
+	return func(s *Server) {
+		s.tsigKeys = keys
+		s.requireTSIG = true
+	}
+}
+
+// secrets are the keys in the form mdns.Server wants them
+func (ks TSIGKeys) secrets() map[string]string {
+	secrets := map[string]string{}
+	for _, k := range ks {
+		secrets[k.Name] = k.Secret
+	}
+	return secrets
+}
+
+// signer returns the name of the key a message was signed with, "" if it
+// wasn't signed, or an error if its signature didn't verify. w has already
+// checked the signature against the key's secret.
+func (ks TSIGKeys) signer(w mdns.ResponseWriter, req *mdns.Msg) (string, error) {
+	tsig := req.IsTsig()
+	if tsig == nil {
+		return "", nil
+	}
+	if err := w.TsigStatus(); err != nil {
+		return "", err
+	}
+	name := strings.ToLower(tsig.Hdr.Name)
+	for _, k := range ks {
+		if k.Name == name && tsigAlgorithms[strings.ToLower(k.Algorithm)] == strings.ToLower(tsig.Algorithm) {
+			return name, nil
+		}
+	}
+	return "", mdns.ErrKeyAlg
+}
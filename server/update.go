@@ -0,0 +1,369 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+	"github.com/nyarly/dns-manager/validate"
+	"github.com/nyarly/dns-manager/zonefile"
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
+)
+
+// SetDNSUpdate makes the DNS server accept dynamic updates (RFC 2136) to
+// cached zones, signed with one of the keys given to SetTSIGKeys. They're
+// written through to NS1 as the HTTP API's changes are, with the key's name
+// as the principal the policy and audit log see. The SOA and the zone's own
+// NS records are left alone, since NS1 manages those.
+func SetDNSUpdate() Option {
+	return func(s *Server) {
+		s.dnsUpdate = true
+	}
+}
+
+// acceptDNS is mdns.DefaultMsgAcceptFunc, but lets updates through if we
+// take them: they have more RRs in each section than queries do.
+func (s *Server) acceptDNS(dh mdns.Header) mdns.MsgAcceptAction {
+	response := dh.Bits&(1<<15) != 0
+	opcode := int(dh.Bits>>11) & 0xF
+	if s.dnsUpdate && !response && opcode == mdns.OpcodeUpdate {
+		return mdns.MsgAccept
+	}
+	return mdns.DefaultMsgAcceptFunc(dh)
+}
+
+// rrset is the RRs of one type at a name, before and after an update
+type rrset struct {
+	owner         string
+	kind          uint16
+	ttl           uint32
+	before, after []mdns.RR
+}
+
+func (set *rrset) changed() bool {
+	if len(set.before) != len(set.after) || (len(set.before) > 0 && set.ttl != set.before[0].Header().Ttl) {
+		return true
+	}
+	for _, rr := range set.after {
+		if !containsRR(set.before, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveUpdate applies an update to a zone, returning the response
+func (s *Server) serveUpdate(w mdns.ResponseWriter, req *mdns.Msg) *mdns.Msg {
+	m := new(mdns.Msg)
+	signer, err := s.tsigKeys.signer(w, req)
+	if err != nil || signer == "" {
+		return m.SetRcode(req, mdns.RcodeRefused)
+	}
+	if len(req.Question) != 1 || req.Question[0].Qtype != mdns.TypeSOA || req.Question[0].Qclass != mdns.ClassINET {
+		return m.SetRcode(req, mdns.RcodeFormatError)
+	}
+
+	ctx := context.WithValue(context.Background(), principalKey{}, strings.TrimSuffix(signer, "."))
+	ctx = context.WithValue(ctx, requestIDKey{}, newRequestID())
+	z, err := s.authorityFor(req.Question[0].Name)
+	if err != nil {
+		return m.SetRcode(req, mdns.RcodeServerFailure)
+	}
+	if z == nil || z.apex != strings.ToLower(mdns.Fqdn(req.Question[0].Name)) {
+		return m.SetRcode(req, mdns.RcodeNotAuth)
+	}
+
+	if rcode := z.prerequisites(req.Answer); rcode != mdns.RcodeSuccess {
+		return m.SetRcode(req, rcode)
+	}
+	sets, rcode := z.update(req.Ns)
+	if rcode != mdns.RcodeSuccess {
+		return m.SetRcode(req, rcode)
+	}
+	return m.SetRcode(req, s.applyUpdate(ctx, strings.TrimSuffix(z.apex, "."), sets))
+}
+
+// prerequisites checks an update's prerequisite section (RFC 2136 3.2)
+func (z *authority) prerequisites(prereqs []mdns.RR) int {
+	// RRs with values are checked against whole RRsets, once they're all in
+	wanted := map[string]*rrset{}
+	for _, rr := range prereqs {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		if !mdns.IsSubDomain(z.apex, owner) {
+			return mdns.RcodeNotZone
+		}
+		present := z.names[owner]
+		if h.Rrtype != mdns.TypeANY {
+			present = only(present, h.Rrtype)
+		}
+
+		switch h.Class {
+		case mdns.ClassANY:
+			if h.Ttl != 0 || h.Rdlength != 0 {
+				return mdns.RcodeFormatError
+			}
+			if len(present) == 0 && h.Rrtype == mdns.TypeANY {
+				return mdns.RcodeNameError
+			}
+			if len(present) == 0 {
+				return mdns.RcodeNXRrset
+			}
+		case mdns.ClassNONE:
+			if h.Ttl != 0 || h.Rdlength != 0 {
+				return mdns.RcodeFormatError
+			}
+			if len(present) > 0 && h.Rrtype == mdns.TypeANY {
+				return mdns.RcodeYXDomain
+			}
+			if len(present) > 0 {
+				return mdns.RcodeYXRrset
+			}
+		case mdns.ClassINET:
+			if h.Ttl != 0 || h.Rrtype == mdns.TypeANY {
+				return mdns.RcodeFormatError
+			}
+			key := owner + "/" + mdns.TypeToString[h.Rrtype]
+			if wanted[key] == nil {
+				wanted[key] = &rrset{before: present}
+			}
+			if !containsRR(wanted[key].after, rr) {
+				wanted[key].after = append(wanted[key].after, rr)
+			}
+		default:
+			return mdns.RcodeFormatError
+		}
+	}
+
+	for _, set := range wanted {
+		if len(set.before) != len(set.after) {
+			return mdns.RcodeNXRrset
+		}
+		for _, rr := range set.after {
+			if !containsRR(set.before, rr) {
+				return mdns.RcodeNXRrset
+			}
+		}
+	}
+	return mdns.RcodeSuccess
+}
+
+// update works out what an update section (RFC 2136 3.4) does to each RRset
+// it touches
+func (z *authority) update(updates []mdns.RR) ([]*rrset, int) {
+	sets := map[string]*rrset{}
+	get := func(owner string, kind uint16) *rrset {
+		key := owner + "/" + mdns.TypeToString[kind]
+		if sets[key] == nil {
+			present := only(z.names[owner], kind)
+			set := &rrset{owner: owner, kind: kind, before: present, after: append([]mdns.RR{}, present...)}
+			if len(present) > 0 {
+				set.ttl = present[0].Header().Ttl
+			}
+			sets[key] = set
+		}
+		return sets[key]
+	}
+
+	// check them all before working through any of them
+	for _, rr := range updates {
+		h := rr.Header()
+		if !mdns.IsSubDomain(z.apex, strings.ToLower(h.Name)) {
+			return nil, mdns.RcodeNotZone
+		}
+		meta := h.Rrtype == mdns.TypeAXFR || h.Rrtype == mdns.TypeIXFR || h.Rrtype == mdns.TypeMAILA || h.Rrtype == mdns.TypeMAILB
+		switch h.Class {
+		case mdns.ClassINET:
+			if meta || h.Rrtype == mdns.TypeANY || h.Rdlength == 0 {
+				return nil, mdns.RcodeFormatError
+			}
+		case mdns.ClassANY:
+			if meta || h.Ttl != 0 || h.Rdlength != 0 {
+				return nil, mdns.RcodeFormatError
+			}
+		case mdns.ClassNONE:
+			if meta || h.Rrtype == mdns.TypeANY || h.Ttl != 0 {
+				return nil, mdns.RcodeFormatError
+			}
+		default:
+			return nil, mdns.RcodeFormatError
+		}
+	}
+
+	for _, rr := range updates {
+		h := rr.Header()
+		owner := strings.ToLower(h.Name)
+		if h.Rrtype == mdns.TypeSOA || (owner == z.apex && h.Rrtype == mdns.TypeNS) {
+			continue
+		}
+
+		switch {
+		case h.Class == mdns.ClassINET:
+			// a CNAME can't share its name with other data (RFC 2136 3.4.2.2)
+			others := false
+			for _, present := range z.names[owner] {
+				others = others || present.Header().Rrtype != mdns.TypeCNAME
+			}
+			cname := len(only(z.names[owner], mdns.TypeCNAME)) > 0
+			for _, set := range sets {
+				if set.owner == owner && len(set.after) > 0 {
+					cname = cname || set.kind == mdns.TypeCNAME
+					others = others || set.kind != mdns.TypeCNAME
+				}
+			}
+			if (h.Rrtype == mdns.TypeCNAME && others) || (h.Rrtype != mdns.TypeCNAME && cname) {
+				continue
+			}
+
+			set := get(owner, h.Rrtype)
+			if h.Rrtype == mdns.TypeCNAME {
+				set.after = nil
+			}
+			set.ttl = h.Ttl
+			if !containsRR(set.after, rr) {
+				rr = mdns.Copy(rr)
+				rr.Header().Name = owner
+				set.after = append(set.after, rr)
+			}
+		case h.Class == mdns.ClassANY && h.Rrtype == mdns.TypeANY:
+			for _, present := range z.names[owner] {
+				if kind := present.Header().Rrtype; kind != mdns.TypeSOA && !(owner == z.apex && kind == mdns.TypeNS) {
+					get(owner, kind).after = nil
+				}
+			}
+			for _, set := range sets {
+				if set.owner == owner {
+					set.after = nil
+				}
+			}
+		case h.Class == mdns.ClassANY:
+			get(owner, h.Rrtype).after = nil
+		case h.Class == mdns.ClassNONE:
+			set := get(owner, h.Rrtype)
+			kept := []mdns.RR{}
+			for _, present := range set.after {
+				if !sameRR(present, rr) {
+					kept = append(kept, present)
+				}
+			}
+			set.after = kept
+		}
+	}
+
+	changed := []*rrset{}
+	for _, set := range sets {
+		if set.changed() {
+			changed = append(changed, set)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		if changed[i].owner != changed[j].owner {
+			return changed[i].owner < changed[j].owner
+		}
+		return changed[i].kind < changed[j].kind
+	})
+	return changed, mdns.RcodeSuccess
+}
+
+// applyUpdate writes changed RRsets to NS1 and the cache, returning the
+// response code. Every change is checked against the policy first, but NS1
+// can't apply them all at once, so if one fails those before it stand.
+func (s *Server) applyUpdate(ctx context.Context, zone string, sets []*rrset) int {
+	for _, set := range sets {
+		verb := UpdateRecord
+		if len(set.after) == 0 {
+			verb = DeleteRecord
+		}
+		if err := s.allowed(ctx, verb, zone, strings.TrimSuffix(set.owner, "."), mdns.TypeToString[set.kind]); err != nil {
+			return mdns.RcodeRefused
+		}
+		if verb == UpdateRecord && validate.Answers(mdns.TypeToString[set.kind], answersOf(set.after)) != nil {
+			return mdns.RcodeRefused
+		}
+	}
+
+	for _, set := range sets {
+		domain, kind := strings.TrimSuffix(set.owner, "."), mdns.TypeToString[set.kind]
+		if err := s.updateRRset(ctx, zone, domain, kind, set); err != nil {
+			log.Printf("problem applying DNS update to %s %s in %s (request %s): %v", kind, domain, zone, requestID(ctx), err)
+			return mdns.RcodeServerFailure
+		}
+	}
+	return mdns.RcodeSuccess
+}
+
+// updateRRset writes one RRset's change as the HTTP API's handlers do
+func (s *Server) updateRRset(ctx context.Context, zone, domain, kind string, set *rrset) error {
+	existing, err := s.storage.GetRecord(zone, domain, kind)
+	if err != nil {
+		return err
+	}
+
+	if len(set.after) == 0 {
+		_, err := s.deleteRecordAPI(ctx, zone, domain, kind)
+		if err != nil && err != ns1.ErrRecordMissing {
+			return err
+		}
+		if _, err := s.storage.DeleteRecord(zone, domain, kind); err != nil {
+			return err
+		}
+		if err := s.summarize(zone, domain, kind, nil); err != nil {
+			return err
+		}
+		s.audit(ctx, DeleteRecord, zone, domain, kind, priorRecord(existing), nil)
+		return nil
+	}
+
+	record := buildRecord(zone, domain, kind, answersOf(set.after))
+	record.TTL = int(set.ttl)
+	before := priorRecord(existing)
+	if len(set.before) == 0 {
+		_, err = s.createRecordAPI(ctx, record)
+		if err == nil {
+			before = nil
+		}
+		if err == ns1.ErrRecordExists {
+			_, err = s.updateRecordAPI(ctx, record)
+		}
+	} else {
+		_, err = s.updateRecordAPI(ctx, record)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := s.storage.RecordRecord(*record); err != nil {
+		return err
+	}
+	if err := s.summarize(zone, domain, kind, record); err != nil {
+		return err
+	}
+	s.audit(ctx, UpdateRecord, zone, domain, kind, before, record)
+	return nil
+}
+
+func answersOf(rrs []mdns.RR) [][]string {
+	answers := [][]string{}
+	for _, rr := range rrs {
+		answers = append(answers, zonefile.FromRR(rr))
+	}
+	return answers
+}
+
+// sameRR compares RRs' names, types and data, but not their classes or TTLs,
+// which differ between updates and the RRs they refer to
+func sameRR(a, b mdns.RR) bool {
+	a, b = mdns.Copy(a), mdns.Copy(b)
+	a.Header().Class, b.Header().Class = mdns.ClassINET, mdns.ClassINET
+	return mdns.IsDuplicate(a, b)
+}
+
+func containsRR(rrs []mdns.RR, rr mdns.RR) bool {
+	for _, present := range rrs {
+		if sameRR(present, rr) {
+			return true
+		}
+	}
+	return false
+}
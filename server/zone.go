@@ -1,11 +1,14 @@
 package server
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
 	"net/http"
+	"strconv"
 
+	"github.com/nyarly/dns-manager/validate"
+	"github.com/nyarly/dns-manager/zonefile"
+	ns1 "gopkg.in/ns1/ns1-go.v2/rest"
 	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
 )
 
@@ -14,8 +17,7 @@ func getZoneName(rw http.ResponseWriter, req *http.Request) string {
 	zone := query.Get("name") // TODO handle errors here
 
 	if zone == "" {
-		rw.WriteHeader(400)
-		fmt.Fprintf(rw, "name parameter is required")
+		fail(rw, 400, CodeBadRequest, "name parameter is required")
 	}
 
 	return zone
@@ -29,25 +31,21 @@ func (s *Server) getZone(rw http.ResponseWriter, req *http.Request) {
 
 	existing, err := s.storage.GetZone(name)
 	if err != nil {
-		rw.WriteHeader(503)
-		fmt.Fprintf(rw, "problem checking for zone: %v", err)
+		fail(rw, 503, CodeStorage, "problem checking for zone: %v", err)
+		return
 	}
 
 	if existing != nil {
-		if err := json.NewEncoder(rw).Encode(existing); err != nil {
-			rw.WriteHeader(503)
-			fmt.Fprintf(rw, "problem serializing cached zone: %v", err)
-		}
+		writeJSON(rw, existing)
 		return
 	}
 
-	ctx := req.Context()
-	zone, rz, err := s.getZoneAPI(ctx, name)
-	if _, err := s.storage.RecordZone(*zone); err != nil {
-		rw.WriteHeader(503)
-		fmt.Fprintf(rw, "problem recording zone: %v", err)
+	f := s.fetchZone(req.Context(), name)
+	if f.storeErr != nil {
+		fail(rw, 503, CodeStorage, "problem recording zone: %v", f.storeErr)
+		return
 	}
-	proxyAPIResponse(rw, rz, zone, err)
+	proxyAPIResponse(rw, f.rz, f.zone, f.err)
 }
 
 func (s *Server) updateZone(rw http.ResponseWriter, req *http.Request) {
@@ -55,25 +53,37 @@ func (s *Server) updateZone(rw http.ResponseWriter, req *http.Request) {
 	if name == "" {
 		return
 	}
+	if !s.authorize(rw, req, UpdateZone, name, "", "") {
+		return
+	}
 
 	existing, err := s.storage.GetZone(name)
 	if err != nil {
-		rw.WriteHeader(503)
-		fmt.Fprintf(rw, "problem checking for zone: %v", err)
+		fail(rw, 503, CodeStorage, "problem checking for zone: %v", err)
+		return
 	}
 
 	ctx := req.Context()
+	var before interface{} = existing
 
 	var rz *http.Response
 	var zone *dns.Zone
 	if existing == nil {
 		zone, rz, err = s.createZoneAPI(ctx, name)
+		if err == ns1.ErrZoneExists {
+			// our cache had expired or never knew about it
+			before = unknownPrior{}
+			zone, rz, err = s.updateZoneAPI(ctx, name)
+		}
 	} else {
 		zone, rz, err = s.updateZoneAPI(ctx, name)
 	}
-	if _, err := s.storage.RecordZone(*zone); err != nil {
-		rw.WriteHeader(503)
-		fmt.Fprintf(rw, "problem recording zone: %v", err)
+	if err == nil {
+		if _, err := s.storage.RecordZone(*zone); err != nil {
+			fail(rw, 503, CodeStorage, "problem recording zone: %v", err)
+			return
+		}
+		s.audit(ctx, UpdateZone, name, "", "", before, zone)
 	}
 
 	proxyAPIResponse(rw, rz, zone, err)
@@ -84,12 +94,235 @@ func (s *Server) deleteZone(rw http.ResponseWriter, req *http.Request) {
 	if name == "" {
 		return
 	}
+	if !s.authorize(rw, req, DeleteZone, name, "", "") {
+		return
+	}
+
+	existing, err := s.storage.GetZone(name)
+	if err != nil {
+		fail(rw, 503, CodeStorage, "problem checking for zone: %v", err)
+		return
+	}
 
 	ctx := req.Context()
 	rz, err := s.deleteZoneAPI(ctx, name)
+	if err == nil {
+		if _, err := s.storage.DeleteZone(name); err != nil {
+			fail(rw, 503, CodeStorage, "problem forgetting zone: %v", err)
+			return
+		}
+		if _, err := s.storage.DeleteZoneRecords(name); err != nil {
+			fail(rw, 503, CodeStorage, "problem forgetting zone's records: %v", err)
+			return
+		}
+		s.audit(ctx, DeleteZone, name, "", "", priorZone(existing), nil)
+	}
 	proxyAPIResponse(rw, rz, nil, err)
 }
 
+func (s *Server) exportZone(rw http.ResponseWriter, req *http.Request) {
+	name := getZoneName(rw, req)
+	if name == "" {
+		return
+	}
+
+	format := req.URL.Query().Get("format")
+	if format != "" && format != "bind" {
+		fail(rw, 400, CodeBadRequest, "unknown export format %q: only bind is supported", format)
+		return
+	}
+
+	zone, err := s.storage.GetZone(name)
+	if err != nil {
+		fail(rw, 503, CodeStorage, "problem checking for zone: %v", err)
+		return
+	}
+
+	if zone == nil {
+		var rz *http.Response
+		zone, rz, err = s.getZoneAPI(req.Context(), name)
+		if err != nil {
+			proxyAPIResponse(rw, rz, nil, err)
+			return
+		}
+		if _, err := s.storage.RecordZone(*zone); err != nil {
+			fail(rw, 503, CodeStorage, "problem recording zone: %v", err)
+			return
+		}
+	}
+
+	records, err := s.zoneRecords(zone)
+	if err != nil {
+		fail(rw, 503, CodeStorage, "problem checking for record: %v", err)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err := zonefile.Write(buf, zone, records); err != nil {
+		fail(rw, 500, CodeInternal, "problem exporting zone: %v", err)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/dns")
+	buf.WriteTo(rw)
+}
+
+// zoneRecords lists a zone's records. The summaries NS1 lists with a zone
+// are enough, but cached records are more complete, so they're preferred.
+func (s *Server) zoneRecords(zone *dns.Zone) ([]*dns.Record, error) {
+	cached, err := s.storage.ListRecords(zone.Zone)
+	if err != nil {
+		return nil, err
+	}
+	full := map[string]*dns.Record{}
+	for _, r := range cached {
+		full[r.Domain+"/"+r.Type] = r
+	}
+
+	records := []*dns.Record{}
+	for _, zr := range zone.Records {
+		record := full[zr.Domain+"/"+zr.Type]
+		if record == nil {
+			record = summaryRecord(zone.Zone, zr)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// ImportResult reports what happened to one record during a zone import
+type ImportResult struct {
+	Domain string `json:"domain"`
+	Type   string `json:"type"`
+	// Action is one of "created", "updated" or "failed"
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (s *Server) importZone(rw http.ResponseWriter, req *http.Request) {
+	name := getZoneName(rw, req)
+	if name == "" {
+		return
+	}
+
+	records, err := zonefile.Read(req.Body, name)
+	if err != nil {
+		fail(rw, 400, CodeBadRequest, "body of request ill formed: %v", err)
+		return
+	}
+
+	ctx := req.Context()
+	if _, rz, err := s.getZoneAPI(ctx, name); err == ns1.ErrZoneMissing {
+		if !s.authorize(rw, req, UpdateZone, name, "", "") {
+			return
+		}
+		zone, rz, err := s.createZoneAPI(ctx, name)
+		if err != nil {
+			proxyAPIResponse(rw, rz, nil, err)
+			return
+		}
+		if _, err := s.storage.RecordZone(*zone); err != nil {
+			fail(rw, 503, CodeStorage, "problem recording zone: %v", err)
+			return
+		}
+		s.audit(ctx, UpdateZone, name, "", "", nil, zone)
+	} else if err != nil {
+		proxyAPIResponse(rw, rz, nil, err)
+		return
+	}
+
+	results := []ImportResult{}
+	for _, record := range records {
+		results = append(results, s.importRecord(ctx, record))
+	}
+	writeJSON(rw, results)
+}
+
+func (s *Server) importRecord(ctx context.Context, record *dns.Record) ImportResult {
+	result := ImportResult{Domain: record.Domain, Type: record.Type}
+	fail := func(err error) ImportResult {
+		result.Action = "failed"
+		result.Error = err.Error()
+		return result
+	}
+
+	if err := s.allowed(ctx, UpdateRecord, record.Zone, record.Domain, record.Type); err != nil {
+		return fail(err)
+	}
+
+	answers := [][]string{}
+	for _, a := range record.Answers {
+		answers = append(answers, a.Rdata)
+	}
+	if err := validate.Answers(record.Type, answers); err != nil {
+		return fail(err)
+	}
+
+	existing, err := s.storage.GetRecord(record.Zone, record.Domain, record.Type)
+	if err != nil {
+		return fail(err)
+	}
+	var before interface{} = existing
+
+	if existing == nil {
+		result.Action = "created"
+		_, err = s.createRecordAPI(ctx, record)
+		if err == ns1.ErrRecordExists {
+			result.Action = "updated"
+			before = unknownPrior{}
+			_, err = s.updateRecordAPI(ctx, record)
+		}
+	} else {
+		result.Action = "updated"
+		_, err = s.updateRecordAPI(ctx, record)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if _, err := s.storage.RecordRecord(*record); err != nil {
+		return fail(err)
+	}
+	if err := s.summarize(record.Zone, record.Domain, record.Type, record); err != nil {
+		return fail(err)
+	}
+	s.audit(ctx, UpdateRecord, record.Zone, record.Domain, record.Type, before, record)
+	return result
+}
+
+func (s *Server) listZones(rw http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	zones, rz, err := s.listZonesAPI(ctx)
+	if rz == nil && err != nil && !fresh(req) {
+		// NS1 is unreachable - the best we can do is what we've seen
+		cached, cerr := s.storage.ListZones()
+		if cerr == nil && len(cached) > 0 {
+			stale(rw)
+			writeJSON(rw, cached)
+			return
+		}
+	}
+	proxyAPIResponse(rw, rz, zones, err)
+}
+
+// fresh is whether a listing must come from NS1, rather than falling back
+// to the cache when NS1 can't be reached - e.g. for a plan, which would
+// otherwise be made against whatever part of NS1's state we've seen
+func fresh(req *http.Request) bool {
+	f, _ := strconv.ParseBool(req.URL.Query().Get("fresh"))
+	return f
+}
+
+// stale marks a response that came from the cache because NS1 couldn't be
+// reached (RFC 7234's "Response is Stale" warning)
+func stale(rw http.ResponseWriter) {
+	rw.Header().Set("Warning", `110 dns-manager "Response is Stale"`)
+}
+
+func (s *Server) listZonesAPI(ctx context.Context) ([]*dns.Zone, *http.Response, error) {
+	zones, rz, err := s.ns1Client(ctx).Zones.List()
+	return zones, rz, err
+}
+
 func (s *Server) getZoneAPI(ctx context.Context, name string) (*dns.Zone, *http.Response, error) {
 	zone, rz, err := s.ns1Client(ctx).Zones.Get(name)
 	return zone, rz, err
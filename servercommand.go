@@ -3,8 +3,13 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/nyarly/dns-manager/ns1fake"
 	"github.com/nyarly/dns-manager/server"
 	"github.com/nyarly/dns-manager/storage"
 	"github.com/spf13/cobra"
@@ -16,6 +21,8 @@ var serverCmd = &cobra.Command{
   Long: "Starts an HTTP server to handle requests to manipulate the NS1 DNS service.\n" +
     "  Note: you must set an NS1_APIKEY environment with a key obtained from https://my.nsone.net/#/account/settings",
 	RunE:  serverFn,
+	// errors from a running server aren't usage errors
+	SilenceUsage: true,
 }
 
 func serverFn(cmd *cobra.Command, args []string) error {
@@ -27,17 +34,208 @@ func serverFn(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	storage := storage.New(storePath)
+	cacheTTL, err := cmd.Flags().GetDuration("cache-ttl")
+	if err != nil {
+		return err
+	}
+	driver, err := cmd.Flags().GetString("store-driver")
+	if err != nil {
+		return err
+	}
+
+	var store storage.Storage
+	switch driver {
+	case "text":
+		store, err = storage.New(storePath, cacheTTL)
+		if err != nil {
+			return err
+		}
+	case "bolt":
+		store, err = storage.NewBolt(storePath, cacheTTL)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown store driver %q: expected text or bolt", driver)
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Printf("problem closing store: %v", err)
+		}
+	}()
+
+	endpoint, err := cmd.Flags().GetString("ns1-endpoint")
+	if err != nil {
+		return err
+	}
+
+	clientFn := server.Retrying(server.LiveClient)
+	if endpoint != "" {
+		clientFn = server.Retrying(ns1fake.ClientFor(endpoint))
+	}
+
 	key, present := os.LookupEnv("NS1_APIKEY")
-	if !present {
+	if !present && endpoint == "" {
 		return errors.New("NS1_APIKEY environment variable is required to be set")
 	}
 
-	server.New(
+	opts := []server.Option{}
+	tokensPath, err := cmd.Flags().GetString("tokens")
+	if err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("tokens") {
+		tokens, err := server.LoadTokens(tokensPath)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, server.SetTokens(tokens))
+	}
+
+	policyPath, err := cmd.Flags().GetString("policy")
+	if err != nil {
+		return err
+	}
+	if policyPath != "" {
+		policy, err := server.LoadPolicy(policyPath)
+		if err != nil {
+			return err
+		}
+		reloadOnHangup(policy)
+		opts = append(opts, server.SetPolicy(policy))
+	}
+
+	auditPath, err := cmd.Flags().GetString("audit-log")
+	if err != nil {
+		return err
+	}
+	if auditPath != "" {
+		auditLog, err := server.OpenAuditFile(auditPath)
+		if err != nil {
+			return err
+		}
+		defer auditLog.Close()
+		opts = append(opts, server.SetAuditLog(auditLog))
+	}
+
+	tlsCert, err := cmd.Flags().GetString("tls-cert")
+	if err != nil {
+		return err
+	}
+	tlsKey, err := cmd.Flags().GetString("tls-key")
+	if err != nil {
+		return err
+	}
+	clientCA, err := cmd.Flags().GetString("tls-client-ca")
+	if err != nil {
+		return err
+	}
+	if tlsCert != "" || tlsKey != "" {
+		config, err := server.LoadTLS(tlsCert, tlsKey, clientCA)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, server.SetTLS(config))
+	} else if clientCA != "" {
+		return errors.New("--tls-client-ca needs --tls-cert and --tls-key")
+	}
+
+	drain, err := cmd.Flags().GetDuration("drain-timeout")
+	if err != nil {
+		return err
+	}
+	opts = append(opts, server.SetDrainTimeout(drain))
+
+	refresh, err := cmd.Flags().GetDuration("refresh-interval")
+	if err != nil {
+		return err
+	}
+	opts = append(opts, server.SetRefresh(refresh))
+
+	dnsListen, err := cmd.Flags().GetString("dns-listen")
+	if err != nil {
+		return err
+	}
+	if dnsListen != "" {
+		journal, err := server.LoadJournal(storePath + ".journal")
+		if err != nil {
+			return fmt.Errorf("problem loading DNS journal: %v", err)
+		}
+		opts = append(opts, server.SetDNS(dnsListen), server.SetJournal(journal))
+	}
+
+	transferAllow, err := cmd.Flags().GetStringSlice("transfer-allow")
+	if err != nil {
+		return err
+	}
+	if len(transferAllow) > 0 {
+		allow, err := server.ParseNetworks(transferAllow)
+		if err != nil {
+			return fmt.Errorf("--transfer-allow: %v", err)
+		}
+		opts = append(opts, server.SetTransfer(allow))
+	}
+
+	tsigPath, err := cmd.Flags().GetString("tsig-keys")
+	if err != nil {
+		return err
+	}
+	if tsigPath != "" {
+		keys, err := server.LoadTSIGKeys(tsigPath)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, server.SetTSIGKeys(keys))
+	}
+
+	dnsUpdate, err := cmd.Flags().GetBool("dns-update")
+	if err != nil {
+		return err
+	}
+	if dnsUpdate {
+		if dnsListen == "" || tsigPath == "" {
+			return errors.New("--dns-update needs --dns-listen and --tsig-keys")
+		}
+		opts = append(opts, server.SetDNSUpdate())
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	stopOnSignal(stop)
+
+	return server.New(
 		listen,
-		storage,
+		store,
 		key,
-		server.LiveClient,
-	).Start(context.Background())
-	return nil
+		clientFn,
+		opts...,
+	).Start(ctx)
+}
+
+// stopOnSignal calls stop when the process is interrupted or terminated.
+// A second signal kills the process outright.
+func stopOnSignal(stop func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		log.Printf("%v: finishing requests in flight, then stopping", sig)
+		stop()
+	}()
+}
+
+// reloadOnHangup re-reads the policy file whenever the process gets a SIGHUP
+func reloadOnHangup(policy *server.Policy) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := policy.Reload(); err != nil {
+				log.Printf("keeping previous policy: %v", err)
+				continue
+			}
+			log.Print("policy reloaded")
+		}
+	}()
 }
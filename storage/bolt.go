@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+var (
+	zonesBucket   = []byte("zones")
+	recordsBucket = []byte("records")
+	historyBucket = []byte("history")
+)
+
+// boltDB keeps zones in a single bucket keyed by name, and records in a
+// bucket per zone keyed by domain and type, so that no operation has to
+// touch more than the entries it's concerned with. Record history is kept
+// the same way as records, in a bucket of its own.
+type boltDB struct {
+	freshness
+	db *bolt.DB
+}
+
+type boltZone struct {
+	Zone      *dns.Zone
+	FetchedAt time.Time
+}
+
+type boltRecord struct {
+	Record    *dns.Record
+	FetchedAt time.Time
+}
+
+// NewBolt constructs a Storage backed by a bbolt database at the given path.
+// Entries older than maxAge are treated as absent; a maxAge of 0 means entries never expire.
+func NewBolt(path string, maxAge time.Duration) (Storage, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{zonesBucket, recordsBucket, historyBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltDB{db: db, freshness: freshness{maxAge: maxAge, now: time.Now}}, nil
+}
+
+func (b boltDB) Close() error {
+	return b.db.Close()
+}
+
+func recordSubkey(domain, kind string) []byte {
+	return []byte(domain + "/" + kind)
+}
+
+func (b boltDB) GetZone(name string) (*dns.Zone, error) {
+	var zone *dns.Zone
+	err := b.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(zonesBucket).Get([]byte(name))
+		if data == nil {
+			return nil
+		}
+		entry := boltZone{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		if !b.expired(entry.FetchedAt) {
+			zone = entry.Zone
+		}
+		return nil
+	})
+	return zone, err
+}
+
+func (b boltDB) RecordZone(zone dns.Zone) (bool, error) {
+	found := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(zonesBucket)
+		key := []byte(zone.Zone)
+		found = bucket.Get(key) != nil
+
+		data, err := json.Marshal(boltZone{Zone: &zone, FetchedAt: b.now()})
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	return found, err
+}
+
+func (b boltDB) DeleteZone(name string) (bool, error) {
+	found := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(zonesBucket)
+		key := []byte(name)
+		found = bucket.Get(key) != nil
+		if !found {
+			return nil
+		}
+		return bucket.Delete(key)
+	})
+	return found, err
+}
+
+func (b boltDB) ListZones() ([]*dns.Zone, error) {
+	return b.listZones(false)
+}
+
+func (b boltDB) ListAllZones() ([]*dns.Zone, error) {
+	return b.listZones(true)
+}
+
+func (b boltDB) listZones(expired bool) ([]*dns.Zone, error) {
+	zones := []*dns.Zone{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(zonesBucket).ForEach(func(_, data []byte) error {
+			entry := boltZone{}
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			if expired || !b.expired(entry.FetchedAt) {
+				zones = append(zones, entry.Zone)
+			}
+			return nil
+		})
+	})
+	return zones, err
+}
+
+func (b boltDB) RecordSummary(zone string, summary dns.ZoneRecord) (bool, error) {
+	return b.updateSummary(zone, summary.Domain, summary.Type, &summary)
+}
+
+func (b boltDB) DeleteSummary(zone, domain, kind string) (bool, error) {
+	return b.updateSummary(zone, domain, kind, nil)
+}
+
+// updateSummary is RecordSummary, or DeleteSummary if summary is nil
+func (b boltDB) updateSummary(zone, domain, kind string, summary *dns.ZoneRecord) (bool, error) {
+	found := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(zonesBucket)
+		key := []byte(zone)
+		data := bucket.Get(key)
+		if data == nil {
+			return nil
+		}
+		entry := boltZone{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+
+		var had bool
+		entry.Zone.Records, had = replaceSummary(entry.Zone.Records, domain, kind, summary)
+		found = had || summary != nil
+		if !found {
+			return nil
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	return found, err
+}
+
+func (b boltDB) GetRecord(zone, domain, kind string) (*dns.Record, error) {
+	var record *dns.Record
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(recordsBucket).Bucket([]byte(zone))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get(recordSubkey(domain, kind))
+		if data == nil {
+			return nil
+		}
+		entry := boltRecord{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		if !b.expired(entry.FetchedAt) {
+			record = entry.Record
+		}
+		return nil
+	})
+	return record, err
+}
+
+func (b boltDB) RecordRecord(record dns.Record) (bool, error) {
+	found := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(recordsBucket).CreateBucketIfNotExists([]byte(record.Zone))
+		if err != nil {
+			return err
+		}
+		key := recordSubkey(record.Domain, record.Type)
+		found = bucket.Get(key) != nil
+
+		now := b.now()
+		data, err := json.Marshal(boltRecord{Record: &record, FetchedAt: now})
+		if err != nil {
+			return err
+		}
+		if err := bucket.Put(key, data); err != nil {
+			return err
+		}
+
+		history, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(record.Zone))
+		if err != nil {
+			return err
+		}
+		versions := []RecordVersion{}
+		if data := history.Get(key); data != nil {
+			if err := json.Unmarshal(data, &versions); err != nil {
+				return err
+			}
+		}
+		data, err = json.Marshal(addVersion(versions, record, now))
+		if err != nil {
+			return err
+		}
+		return history.Put(key, data)
+	})
+	return found, err
+}
+
+func (b boltDB) DeleteRecord(zone, domain, kind string) (bool, error) {
+	found := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(recordsBucket).Bucket([]byte(zone))
+		if bucket == nil {
+			return nil
+		}
+		key := recordSubkey(domain, kind)
+		found = bucket.Get(key) != nil
+		if !found {
+			return nil
+		}
+		return bucket.Delete(key)
+	})
+	return found, err
+}
+
+func (b boltDB) ListRecords(zone string) ([]*dns.Record, error) {
+	return b.listRecords(zone, false)
+}
+
+func (b boltDB) ListAllRecords(zone string) ([]*dns.Record, error) {
+	return b.listRecords(zone, true)
+}
+
+func (b boltDB) listRecords(zone string, expired bool) ([]*dns.Record, error) {
+	records := []*dns.Record{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(recordsBucket).Bucket([]byte(zone))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(_, data []byte) error {
+			entry := boltRecord{}
+			if err := json.Unmarshal(data, &entry); err != nil {
+				return err
+			}
+			if expired || !b.expired(entry.FetchedAt) {
+				records = append(records, entry.Record)
+			}
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (b boltDB) DeleteZoneRecords(zone string) (bool, error) {
+	found := false
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		records := tx.Bucket(recordsBucket)
+		bucket := records.Bucket([]byte(zone))
+		if bucket == nil {
+			return nil
+		}
+		first, _ := bucket.Cursor().First()
+		found = first != nil
+		return records.DeleteBucket([]byte(zone))
+	})
+	return found, err
+}
+
+func (b boltDB) RecordHistory(zone, domain, kind string) ([]RecordVersion, error) {
+	versions := []RecordVersion{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket([]byte(zone))
+		if bucket == nil {
+			return nil
+		}
+		data := bucket.Get(recordSubkey(domain, kind))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &versions)
+	})
+	return versions, err
+}
@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+func setupBolt(t *testing.T) (Storage, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Creating tempdir: %v", err)
+	}
+
+	store, err := NewBolt(filepath.Join(dir, "storage.db"), 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Opening bolt storage: %v", err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltZones(t *testing.T) {
+	store, cleanup := setupBolt(t)
+	defer cleanup()
+
+	zone, err := store.GetZone("example.com")
+	if err != nil {
+		t.Fatalf("err from GetZone: %v", err)
+	}
+	if zone != nil {
+		t.Fatalf("GetZone returned a zone from empty storage: %v", zone)
+	}
+
+	present, err := store.RecordZone(*dns.NewZone("example.com"))
+	if err != nil {
+		t.Fatalf("err from RecordZone: %v", err)
+	}
+	if present {
+		t.Fatalf("RecordZone returned 'present' after storing zone in empty store")
+	}
+	present, err = store.RecordZone(*dns.NewZone("example.com"))
+	if err != nil {
+		t.Fatalf("err from RecordZone: %v", err)
+	}
+	if !present {
+		t.Fatalf("RecordZone returned 'not present' after re-storing zone")
+	}
+	store.RecordZone(*dns.NewZone("example.org"))
+
+	zone, err = store.GetZone("example.com")
+	if err != nil {
+		t.Fatalf("err from GetZone: %v", err)
+	}
+	if zone == nil || zone.Zone != "example.com" {
+		t.Fatalf("GetZone returned %v after storing zone", zone)
+	}
+
+	zones, err := store.ListZones()
+	if err != nil {
+		t.Fatalf("err from ListZones: %v", err)
+	}
+	if len(zones) != 2 {
+		t.Fatalf("ListZones returned %d zones after storing 2", len(zones))
+	}
+
+	present, err = store.DeleteZone("example.com")
+	if err != nil {
+		t.Fatalf("err from DeleteZone: %v", err)
+	}
+	if !present {
+		t.Fatalf("DeleteZone returned 'not present' after deleting zone")
+	}
+	zone, err = store.GetZone("example.com")
+	if err != nil {
+		t.Fatalf("err from GetZone: %v", err)
+	}
+	if zone != nil {
+		t.Fatalf("GetZone returned a deleted zone: %v", zone)
+	}
+}
+
+func TestBoltRecords(t *testing.T) {
+	store, cleanup := setupBolt(t)
+	defer cleanup()
+
+	record, err := store.GetRecord("example.com", "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("err from GetRecord: %v", err)
+	}
+	if record != nil {
+		t.Fatalf("GetRecord returned a record from empty storage: %v", record)
+	}
+
+	www := dns.NewRecord("example.com", "www.example.com", "A")
+	www.AddAnswer(dns.NewAv4Answer("1.2.3.4"))
+	present, err := store.RecordRecord(*www)
+	if err != nil {
+		t.Fatalf("err from RecordRecord: %v", err)
+	}
+	if present {
+		t.Fatalf("RecordRecord returned 'present' after storing record in empty store")
+	}
+	store.RecordRecord(*dns.NewRecord("example.com", "example.com", "MX"))
+	store.RecordRecord(*dns.NewRecord("example.org", "www.example.org", "A"))
+
+	record, err = store.GetRecord("example.com", "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("err from GetRecord: %v", err)
+	}
+	if record == nil || len(record.Answers) != 1 || record.Answers[0].Rdata[0] != "1.2.3.4" {
+		t.Fatalf("GetRecord returned %v after storing record", record)
+	}
+
+	records, err := store.ListRecords("example.com")
+	if err != nil {
+		t.Fatalf("err from ListRecords: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("ListRecords returned %d records, expected 2", len(records))
+	}
+
+	present, err = store.DeleteRecord("example.com", "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("err from DeleteRecord: %v", err)
+	}
+	if !present {
+		t.Fatalf("DeleteRecord returned 'not present' after deleting record")
+	}
+	present, err = store.DeleteRecord("example.net", "www.example.net", "A")
+	if err != nil {
+		t.Fatalf("err from DeleteRecord: %v", err)
+	}
+	if present {
+		t.Fatalf("DeleteRecord returned 'present' for a record never stored")
+	}
+}
+
+func TestBoltDeleteZoneRecords(t *testing.T) {
+	store, cleanup := setupBolt(t)
+	defer cleanup()
+	checkDeleteZoneRecords(t, store)
+}
+
+func TestBoltSummaries(t *testing.T) {
+	store, cleanup := setupBolt(t)
+	defer cleanup()
+	checkSummaries(t, store)
+}
+
+func TestBoltRecordHistory(t *testing.T) {
+	store, cleanup := setupBolt(t)
+	defer cleanup()
+
+	checkHistory(t, store)
+}
+
+func TestBoltRecordHistoryCap(t *testing.T) {
+	store, cleanup := setupBolt(t)
+	defer cleanup()
+
+	checkHistoryCap(t, store)
+}
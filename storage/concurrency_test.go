@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+func TestConcurrentWrites(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+
+	const writers, each = 8, 25
+	wg := sync.WaitGroup{}
+	errs := make(chan error, writers*each*2)
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			zone := fmt.Sprintf("zone%d.example.com", w)
+			if _, err := store.RecordZone(*dns.NewZone(zone)); err != nil {
+				errs <- err
+			}
+			for i := 0; i < each; i++ {
+				domain := fmt.Sprintf("host%d.%s", i, zone)
+				if _, err := store.RecordRecord(*dns.NewRecord(zone, domain, "A")); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+
+	// readers must never see a half-written file
+	done := make(chan struct{})
+	readers := sync.WaitGroup{}
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := store.ListZones(); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Error during concurrent use: %v", err)
+	}
+
+	zones, err := store.ListZones()
+	if err != nil {
+		t.Fatalf("err from ListZones: %v", err)
+	}
+	if len(zones) != writers {
+		t.Errorf("Expected %d zones, got %d: updates were lost", writers, len(zones))
+	}
+	for w := 0; w < writers; w++ {
+		records, err := store.ListRecords(fmt.Sprintf("zone%d.example.com", w))
+		if err != nil {
+			t.Fatalf("err from ListRecords: %v", err)
+		}
+		if len(records) != each {
+			t.Errorf("Expected %d records in zone%d, got %d: updates were lost", each, w, len(records))
+		}
+	}
+}
+
+func TestStorageLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage")
+
+	store, err := New(path, 0)
+	if err != nil {
+		t.Fatalf("Opening storage: %v", err)
+	}
+	if _, err := New(path, 0); err == nil {
+		t.Errorf("Expected storage in use to be refused")
+	}
+
+	store.RecordZone(*dns.NewZone("example.com"))
+	if err := store.Close(); err != nil {
+		t.Fatalf("err from Close: %v", err)
+	}
+
+	store, err = New(path, 0)
+	if err != nil {
+		t.Fatalf("Expected storage to be available once closed: %v", err)
+	}
+	defer store.Close()
+	zone, err := store.GetZone("example.com")
+	if err != nil || zone == nil {
+		t.Errorf("Expected the zone to survive reopening, got %v, %v", zone, err)
+	}
+
+	leftovers, err := filepath.Glob(path + ".tmp*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftovers) != 0 {
+		t.Errorf("Temporary files left behind: %v", leftovers)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package storage
+
+import "os"
+
+// lockFile opens the file at path without locking it: advisory locks are
+// only taken on unix systems.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -34,6 +34,32 @@ func (spy *Spy) DeleteZone(name string) (bool, error) {
 	return res.Bool(0), res.Error(1)
 }
 
+// ListZones implements Storage on Spy
+func (spy *Spy) ListZones() ([]*dns.Zone, error) {
+	res := spy.Called()
+	var empty []*dns.Zone
+	return res.GetOr(0, empty).([]*dns.Zone), res.Error(1)
+}
+
+// RecordSummary implements Storage on Spy
+func (spy *Spy) RecordSummary(zone string, summary dns.ZoneRecord) (bool, error) {
+	res := spy.Called(zone, summary)
+	return res.Bool(0), res.Error(1)
+}
+
+// DeleteSummary implements Storage on Spy
+func (spy *Spy) DeleteSummary(zone, domain, kind string) (bool, error) {
+	res := spy.Called(zone, domain, kind)
+	return res.Bool(0), res.Error(1)
+}
+
+// ListAllZones implements Storage on Spy
+func (spy *Spy) ListAllZones() ([]*dns.Zone, error) {
+	res := spy.Called()
+	var empty []*dns.Zone
+	return res.GetOr(0, empty).([]*dns.Zone), res.Error(1)
+}
+
 // GetRecord implements Storage on Spy
 func (spy *Spy) GetRecord(zone, domain, kind string) (*dns.Record, error) {
 	res := spy.Called(zone, domain, kind)
@@ -52,3 +78,36 @@ func (spy *Spy) DeleteRecord(zone, domain, kind string) (bool, error) {
 	res := spy.Called(zone, domain, kind)
 	return res.Bool(0), res.Error(1)
 }
+
+// ListRecords implements Storage on Spy
+func (spy *Spy) ListRecords(zone string) ([]*dns.Record, error) {
+	res := spy.Called(zone)
+	var empty []*dns.Record
+	return res.GetOr(0, empty).([]*dns.Record), res.Error(1)
+}
+
+// ListAllRecords implements Storage on Spy
+func (spy *Spy) ListAllRecords(zone string) ([]*dns.Record, error) {
+	res := spy.Called(zone)
+	var empty []*dns.Record
+	return res.GetOr(0, empty).([]*dns.Record), res.Error(1)
+}
+
+// DeleteZoneRecords implements Storage on Spy
+func (spy *Spy) DeleteZoneRecords(zone string) (bool, error) {
+	res := spy.Called(zone)
+	return res.Bool(0), res.Error(1)
+}
+
+// RecordHistory implements Storage on Spy
+func (spy *Spy) RecordHistory(zone, domain, kind string) ([]RecordVersion, error) {
+	res := spy.Called(zone, domain, kind)
+	var empty []RecordVersion
+	return res.GetOr(0, empty).([]RecordVersion), res.Error(1)
+}
+
+// Close implements Storage on Spy
+func (spy *Spy) Close() error {
+	res := spy.Called()
+	return res.Error(0)
+}
@@ -5,7 +5,10 @@ import (
 	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
 )
@@ -18,6 +21,15 @@ type Storage interface {
 	RecordZone(dns.Zone) (bool, error)
 	// DeleteZone removes a zone from storage
 	DeleteZone(string) (bool, error)
+	// ListZones retreives every zone in the store
+	ListZones() ([]*dns.Zone, error)
+	// ListAllZones is ListZones, including zones that have expired
+	ListAllZones() ([]*dns.Zone, error)
+	// RecordSummary persists a record's summary in its stored zone, without changing when the
+	//   zone was fetched. Returns true if the zone was persisted
+	RecordSummary(string, dns.ZoneRecord) (bool, error)
+	// DeleteSummary removes a record's summary from its stored zone by name. Returns true if it was there
+	DeleteSummary(string, string, string) (bool, error)
 	// GetRecord retreives a record from the store by name
 	GetRecord(string, string, string) (*dns.Record, error)
 	// RecordRecord persists a record. Returns true if the record was already persisted
@@ -25,21 +37,154 @@ type Storage interface {
 	RecordRecord(dns.Record) (bool, error)
 	// DeleteRecord removes a record from storage by name
 	DeleteRecord(string, string, string) (bool, error)
+	// ListRecords retreives every record in the store under a zone
+	ListRecords(string) ([]*dns.Record, error)
+	// ListAllRecords is ListRecords, including records that have expired
+	ListAllRecords(string) ([]*dns.Record, error)
+	// DeleteZoneRecords removes every record under a zone from storage. Returns true if there were any
+	DeleteZoneRecords(string) (bool, error)
+	// RecordHistory retreives the versions of a record that have been persisted, oldest first -
+	//   the most recent 50 of them. History outlives both expiry and DeleteRecord.
+	RecordHistory(string, string, string) ([]RecordVersion, error)
+	// Close flushes anything outstanding and releases the store
+	Close() error
 }
 
+// RecordVersion is one state a record has been persisted in
+type RecordVersion struct {
+	Version    int
+	RecordedAt time.Time
+	Record     *dns.Record
+}
+
+// maxVersions is how many versions of each record are kept. Older ones are
+// dropped, so that history doesn't grow without limit; versions keep their
+// numbers, so the oldest kept needn't be version 1.
+const maxVersions = 50
+
+// addVersion appends record to history, unless it's the same as the latest
+// version, dropping the oldest versions beyond maxVersions
+func addVersion(history []RecordVersion, record dns.Record, at time.Time) []RecordVersion {
+	version := 1
+	if len(history) > 0 {
+		latest := history[len(history)-1]
+		if SameRecord(latest.Record, &record) {
+			return history
+		}
+		version = latest.Version + 1
+	}
+	history = append(history, RecordVersion{
+		Version:    version,
+		RecordedAt: at,
+		Record:     &record,
+	})
+	if over := len(history) - maxVersions; over > 0 {
+		history = append([]RecordVersion{}, history[over:]...)
+	}
+	return history
+}
+
+// SameRecord compares the answers and TTLs of records, ignoring their
+// metadata. A TTL of 0 means NS1's default, so it matches any TTL.
+func SameRecord(a, b *dns.Record) bool {
+	if a.TTL != 0 && b.TTL != 0 && a.TTL != b.TTL {
+		return false
+	}
+	if len(a.Answers) != len(b.Answers) {
+		return false
+	}
+	for i := range a.Answers {
+		if strings.Join(a.Answers[i].Rdata, " ") != strings.Join(b.Answers[i].Rdata, " ") {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceSummary replaces the summary of a zone's record by domain and
+// type, or removes it if summary is nil, returning whether it was there
+func replaceSummary(summaries []*dns.ZoneRecord, domain, kind string, summary *dns.ZoneRecord) ([]*dns.ZoneRecord, bool) {
+	for i, zr := range summaries {
+		if zr.Domain == domain && zr.Type == kind {
+			if summary == nil {
+				return append(summaries[:i:i], summaries[i+1:]...), true
+			}
+			summaries[i] = summary
+			return summaries, true
+		}
+	}
+	if summary != nil {
+		summaries = append(summaries, summary)
+	}
+	return summaries, false
+}
+
+// freshness decides whether an entry persisted at some time should still be trusted
+type freshness struct {
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+func (f freshness) expired(fetched time.Time) bool {
+	return f.maxAge != 0 && f.now().Sub(fetched) > f.maxAge
+}
+
+// textFile keeps everything in one JSON file. Mutations are serialized
+// in-process by mu, and a lock on a file beside it keeps other processes
+// away. The file is replaced whole on each change, so it's never seen
+// half-written.
 type textFile struct {
+	freshness
 	path string
+	mu   *sync.RWMutex
+	lock *os.File
 }
 
 // Stored is the format for the textFile persistence layer
 type Stored struct {
 	Zones   []dns.Zone
 	Records []dns.Record
+	// FetchedAt holds the time each zone and record was last persisted,
+	// keyed by zoneKey and recordKey respectively
+	FetchedAt map[string]time.Time
+	// History holds every version of each record, keyed by recordKey
+	History map[string][]RecordVersion
+}
+
+// New constructs an on-disk Storage at the given path, locking it against
+// use by other processes until it's closed.
+// Entries older than maxAge are treated as absent; a maxAge of 0 means entries never expire.
+func New(path string, maxAge time.Duration) (Storage, error) {
+	lock, err := lockFile(path + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	return &textFile{
+		path:      path,
+		freshness: freshness{maxAge: maxAge, now: time.Now},
+		mu:        &sync.RWMutex{},
+		lock:      lock,
+	}, nil
+}
+
+func zoneKey(name string) string {
+	return name
+}
+
+func recordKey(zone, domain, kind string) string {
+	return strings.Join([]string{zone, domain, kind}, "/")
 }
 
-// New constructs an on-disk Storage at the given path
-func New(path string) Storage {
-	return &textFile{path: path}
+func (tf textFile) stale(stored *Stored, key string) bool {
+	// entries without a timestamp predate expiry, and are as old as can be
+	return tf.expired(stored.FetchedAt[key])
+}
+
+func (tf textFile) touch(stored *Stored, key string) {
+	if stored.FetchedAt == nil {
+		stored.FetchedAt = map[string]time.Time{}
+	}
+	stored.FetchedAt[key] = tf.now()
 }
 
 func (tf textFile) load() (*Stored, error) {
@@ -61,17 +206,41 @@ func (tf textFile) load() (*Stored, error) {
 	return &stored, nil
 }
 
+// store writes a temporary file and renames it over the real one, so a crash
+// part way through leaves the previous contents intact
 func (tf textFile) store(stored *Stored) error {
-	f, err := os.Create(tf.path)
+	f, err := ioutil.TempFile(filepath.Dir(tf.path), filepath.Base(tf.path)+".tmp")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	return enc.Encode(stored)
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+
+	if err := json.NewEncoder(f).Encode(stored); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), tf.path)
+}
+
+// Close releases the lock on the file; a textFile is written out after every change
+func (tf textFile) Close() error {
+	if tf.lock == nil {
+		return nil
+	}
+	return tf.lock.Close()
 }
 
 func (tf textFile) GetZone(name string) (*dns.Zone, error) {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
 	stored, err := tf.load()
 	if err != nil {
 		return nil, err
@@ -81,6 +250,9 @@ func (tf textFile) GetZone(name string) (*dns.Zone, error) {
 
 	for _, z := range zones {
 		if name == z.Zone {
+			if tf.stale(stored, zoneKey(name)) {
+				return nil, nil
+			}
 			return &z, nil
 		}
 	}
@@ -89,6 +261,9 @@ func (tf textFile) GetZone(name string) (*dns.Zone, error) {
 }
 
 func (tf textFile) RecordZone(zone dns.Zone) (bool, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
 	stored, err := tf.load()
 	if err != nil {
 		return false, err
@@ -109,11 +284,15 @@ func (tf textFile) RecordZone(zone dns.Zone) (bool, error) {
 	}
 
 	stored.Zones = zones
+	tf.touch(stored, zoneKey(zone.Zone))
 	err = tf.store(stored)
 	return found, err
 }
 
 func (tf textFile) DeleteZone(name string) (bool, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
 	stored, err := tf.load()
 	if err != nil {
 		return false, err
@@ -136,11 +315,83 @@ func (tf textFile) DeleteZone(name string) (bool, error) {
 	}
 
 	stored.Zones = zones
+	delete(stored.FetchedAt, zoneKey(name))
 	err = tf.store(stored)
 	return found, err
 }
 
+func (tf textFile) ListZones() ([]*dns.Zone, error) {
+	return tf.listZones(false)
+}
+
+func (tf textFile) ListAllZones() ([]*dns.Zone, error) {
+	return tf.listZones(true)
+}
+
+func (tf textFile) listZones(expired bool) ([]*dns.Zone, error) {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
+	stored, err := tf.load()
+	if err != nil {
+		return nil, err
+	}
+
+	zones := []*dns.Zone{}
+	for i, z := range stored.Zones {
+		if !expired && tf.stale(stored, zoneKey(z.Zone)) {
+			continue
+		}
+		zones = append(zones, &stored.Zones[i])
+	}
+
+	return zones, nil
+}
+
+func (tf textFile) RecordSummary(zone string, summary dns.ZoneRecord) (bool, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	stored, err := tf.load()
+	if err != nil {
+		return false, err
+	}
+
+	for i, z := range stored.Zones {
+		if z.Zone == zone {
+			stored.Zones[i].Records, _ = replaceSummary(z.Records, summary.Domain, summary.Type, &summary)
+			return true, tf.store(stored)
+		}
+	}
+	return false, nil
+}
+
+func (tf textFile) DeleteSummary(zone, domain, kind string) (bool, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	stored, err := tf.load()
+	if err != nil {
+		return false, err
+	}
+
+	for i, z := range stored.Zones {
+		if z.Zone == zone {
+			summaries, found := replaceSummary(z.Records, domain, kind, nil)
+			if !found {
+				return false, nil
+			}
+			stored.Zones[i].Records = summaries
+			return true, tf.store(stored)
+		}
+	}
+	return false, nil
+}
+
 func (tf textFile) GetRecord(zone, domain, kind string) (*dns.Record, error) {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
 	stored, err := tf.load()
 	if err != nil {
 		return nil, err
@@ -150,6 +401,9 @@ func (tf textFile) GetRecord(zone, domain, kind string) (*dns.Record, error) {
 
 	for _, r := range records {
 		if r.Zone == zone && r.Domain == domain && r.Type == kind {
+			if tf.stale(stored, recordKey(zone, domain, kind)) {
+				return nil, nil
+			}
 			return &r, nil
 		}
 	}
@@ -158,6 +412,9 @@ func (tf textFile) GetRecord(zone, domain, kind string) (*dns.Record, error) {
 }
 
 func (tf textFile) RecordRecord(record dns.Record) (bool, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
 	stored, err := tf.load()
 	if err != nil {
 		return false, err
@@ -177,11 +434,20 @@ func (tf textFile) RecordRecord(record dns.Record) (bool, error) {
 		records = append(records, record)
 	}
 	stored.Records = records
+	key := recordKey(record.Zone, record.Domain, record.Type)
+	tf.touch(stored, key)
+	if stored.History == nil {
+		stored.History = map[string][]RecordVersion{}
+	}
+	stored.History[key] = addVersion(stored.History[key], record, tf.now())
 	err = tf.store(stored)
 	return found, err
 }
 
 func (tf textFile) DeleteRecord(zone, domain, kind string) (bool, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
 	stored, err := tf.load()
 	if err != nil {
 		return false, err
@@ -203,6 +469,75 @@ func (tf textFile) DeleteRecord(zone, domain, kind string) (bool, error) {
 		return false, nil
 	}
 	stored.Records = records
+	delete(stored.FetchedAt, recordKey(zone, domain, kind))
 	err = tf.store(stored)
 	return found, err
 }
+
+func (tf textFile) ListRecords(zone string) ([]*dns.Record, error) {
+	return tf.listRecords(zone, false)
+}
+
+func (tf textFile) ListAllRecords(zone string) ([]*dns.Record, error) {
+	return tf.listRecords(zone, true)
+}
+
+func (tf textFile) listRecords(zone string, expired bool) ([]*dns.Record, error) {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
+	stored, err := tf.load()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*dns.Record{}
+	for i, r := range stored.Records {
+		if r.Zone == zone && (expired || !tf.stale(stored, recordKey(r.Zone, r.Domain, r.Type))) {
+			records = append(records, &stored.Records[i])
+		}
+	}
+
+	return records, nil
+}
+
+func (tf textFile) DeleteZoneRecords(zone string) (bool, error) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	stored, err := tf.load()
+	if err != nil {
+		return false, err
+	}
+
+	kept := []dns.Record{}
+	for _, r := range stored.Records {
+		if r.Zone == zone {
+			delete(stored.FetchedAt, recordKey(r.Zone, r.Domain, r.Type))
+			continue
+		}
+		kept = append(kept, r)
+	}
+	if len(kept) == len(stored.Records) {
+		return false, nil
+	}
+	stored.Records = kept
+	err = tf.store(stored)
+	return true, err
+}
+
+func (tf textFile) RecordHistory(zone, domain, kind string) ([]RecordVersion, error) {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+
+	stored, err := tf.load()
+	if err != nil {
+		return nil, err
+	}
+
+	history := stored.History[recordKey(zone, domain, kind)]
+	if history == nil {
+		history = []RecordVersion{}
+	}
+	return history, nil
+}
@@ -4,7 +4,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
 )
@@ -17,9 +19,14 @@ func setup(t *testing.T) (Storage, func()) {
 	}
 
 	storePath := filepath.Join(dir, "storage")
-	store := New(storePath)
+	store, err := New(storePath, 0)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Opening storage: %v", err)
+	}
 	return store, func() {
-		defer os.RemoveAll(dir)
+		store.Close()
+		os.RemoveAll(dir)
 	}
 }
 
@@ -148,3 +155,304 @@ func TestDeleteRecord(t *testing.T) {
 		t.Fatalf("DeleteRecord returned 'not present' after deleting record")
 	}
 }
+
+func TestDeleteZoneRecords(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	checkDeleteZoneRecords(t, store)
+}
+
+// checkDeleteZoneRecords checks that DeleteZoneRecords removes a zone's
+// records, and only its records
+func checkDeleteZoneRecords(t *testing.T, store Storage) {
+	t.Helper()
+	store.RecordZone(*dns.NewZone("example.com"))
+	store.RecordRecord(*dns.NewRecord("example.com", "www.example.com", "A"))
+	store.RecordRecord(*dns.NewRecord("example.com", "example.com", "MX"))
+	store.RecordRecord(*dns.NewRecord("example.org", "www.example.org", "A"))
+
+	present, err := store.DeleteZoneRecords("example.com")
+	if err != nil {
+		t.Fatalf("err from DeleteZoneRecords: %v", err)
+	}
+	if !present {
+		t.Fatalf("DeleteZoneRecords returned 'not present' after deleting records")
+	}
+	if records, _ := store.ListRecords("example.com"); len(records) != 0 {
+		t.Errorf("ListRecords returned %d records after DeleteZoneRecords", len(records))
+	}
+	if record, _ := store.GetRecord("example.com", "www.example.com", "A"); record != nil {
+		t.Errorf("GetRecord returned %v after DeleteZoneRecords", record)
+	}
+	if records, _ := store.ListRecords("example.org"); len(records) != 1 {
+		t.Errorf("DeleteZoneRecords touched another zone's records: %v", records)
+	}
+	if zone, _ := store.GetZone("example.com"); zone == nil {
+		t.Errorf("DeleteZoneRecords removed the zone itself")
+	}
+	if history, _ := store.RecordHistory("example.com", "www.example.com", "A"); len(history) != 1 {
+		t.Errorf("Expected history to outlive DeleteZoneRecords, got %v", history)
+	}
+
+	present, err = store.DeleteZoneRecords("example.com")
+	if err != nil {
+		t.Fatalf("err from DeleteZoneRecords: %v", err)
+	}
+	if present {
+		t.Fatalf("DeleteZoneRecords returned 'present' for a zone with no records")
+	}
+}
+
+func TestSummaries(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+	checkSummaries(t, store)
+}
+
+// checkSummaries checks that RecordSummary and DeleteSummary keep a stored
+// zone's record summaries up to date
+func checkSummaries(t *testing.T, store Storage) {
+	t.Helper()
+	www := dns.ZoneRecord{Domain: "www.example.com", Type: "A", ShortAns: []string{"1.2.3.4"}}
+	present, err := store.RecordSummary("example.com", www)
+	if err != nil {
+		t.Fatalf("err from RecordSummary: %v", err)
+	}
+	if present {
+		t.Fatalf("RecordSummary returned 'present' for a zone never stored")
+	}
+
+	zone := dns.NewZone("example.com")
+	zone.Records = []*dns.ZoneRecord{{Domain: "example.com", Type: "MX", ShortAns: []string{"10 mail.example.com"}}}
+	store.RecordZone(*zone)
+
+	if present, err = store.RecordSummary("example.com", www); err != nil || !present {
+		t.Fatalf("RecordSummary returned %v, %v for a stored zone", present, err)
+	}
+	www.ShortAns = []string{"5.6.7.8"}
+	store.RecordSummary("example.com", www)
+
+	stored, err := store.GetZone("example.com")
+	if err != nil {
+		t.Fatalf("err from GetZone: %v", err)
+	}
+	if len(stored.Records) != 2 || stored.Records[1].ShortAns[0] != "5.6.7.8" {
+		t.Fatalf("Expected the MX summary and the latest A summary, got %v", stored.Records)
+	}
+
+	if present, err = store.DeleteSummary("example.com", "example.com", "MX"); err != nil || !present {
+		t.Fatalf("DeleteSummary returned %v, %v for a stored summary", present, err)
+	}
+	if present, err = store.DeleteSummary("example.com", "example.com", "MX"); err != nil || present {
+		t.Fatalf("DeleteSummary returned %v, %v for a summary already deleted", present, err)
+	}
+	stored, _ = store.GetZone("example.com")
+	if len(stored.Records) != 1 || stored.Records[0].Type != "A" {
+		t.Errorf("Expected just the A summary, got %v", stored.Records)
+	}
+}
+
+func TestListZones(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+
+	zones, err := store.ListZones()
+	if err != nil {
+		t.Fatalf("err from ListZones: %v", err)
+	}
+	if len(zones) != 0 {
+		t.Fatalf("ListZones returned zones from empty storage: %v", zones)
+	}
+
+	store.RecordZone(*dns.NewZone("example.com"))
+	store.RecordZone(*dns.NewZone("example.org"))
+
+	zones, err = store.ListZones()
+	if err != nil {
+		t.Fatalf("err from ListZones: %v", err)
+	}
+	if len(zones) != 2 {
+		t.Fatalf("ListZones returned %d zones after storing 2", len(zones))
+	}
+}
+
+func TestListRecords(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+
+	store.RecordRecord(*dns.NewRecord("example.com", "www.example.com", "a"))
+	store.RecordRecord(*dns.NewRecord("example.com", "mail.example.com", "mx"))
+	store.RecordRecord(*dns.NewRecord("example.org", "www.example.org", "a"))
+
+	records, err := store.ListRecords("example.com")
+	if err != nil {
+		t.Fatalf("err from ListRecords: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("ListRecords returned %d records, expected 2", len(records))
+	}
+	for _, r := range records {
+		if r.Zone != "example.com" {
+			t.Errorf("ListRecords returned a record from another zone: %v", r)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Creating tempdir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	store := &textFile{
+		path: filepath.Join(dir, "storage"),
+		mu:   &sync.RWMutex{},
+		freshness: freshness{
+			maxAge: time.Minute,
+			now:    func() time.Time { return now },
+		},
+	}
+
+	store.RecordZone(*dns.NewZone("example.com"))
+	store.RecordRecord(*dns.NewRecord("example.com", "www.example.com", "a"))
+
+	now = now.Add(30 * time.Second)
+	zone, err := store.GetZone("example.com")
+	if err != nil {
+		t.Fatalf("err from GetZone: %v", err)
+	}
+	if zone == nil {
+		t.Fatalf("GetZone returned nil before entry expired")
+	}
+
+	now = now.Add(time.Minute)
+	zone, err = store.GetZone("example.com")
+	if err != nil {
+		t.Fatalf("err from GetZone: %v", err)
+	}
+	if zone != nil {
+		t.Fatalf("GetZone returned an expired zone: %v", zone)
+	}
+	record, err := store.GetRecord("example.com", "www.example.com", "a")
+	if err != nil {
+		t.Fatalf("err from GetRecord: %v", err)
+	}
+	if record != nil {
+		t.Fatalf("GetRecord returned an expired record: %v", record)
+	}
+	if zones, _ := store.ListZones(); len(zones) != 0 {
+		t.Fatalf("ListZones returned expired zones: %v", zones)
+	}
+	if zones, _ := store.ListAllZones(); len(zones) != 1 {
+		t.Fatalf("ListAllZones returned %d zones, expected the expired one", len(zones))
+	}
+	if records, _ := store.ListRecords("example.com"); len(records) != 0 {
+		t.Fatalf("ListRecords returned expired records: %v", records)
+	}
+	if records, _ := store.ListAllRecords("example.com"); len(records) != 1 {
+		t.Fatalf("ListAllRecords returned %d records, expected the expired one", len(records))
+	}
+
+	present, err := store.RecordZone(*dns.NewZone("example.com"))
+	if err != nil {
+		t.Fatalf("err from RecordZone: %v", err)
+	}
+	if !present {
+		t.Fatalf("RecordZone returned 'not present' when refreshing an expired zone")
+	}
+	zone, err = store.GetZone("example.com")
+	if err != nil {
+		t.Fatalf("err from GetZone: %v", err)
+	}
+	if zone == nil {
+		t.Fatalf("GetZone returned nil after refreshing zone")
+	}
+}
+
+func answered(zone, domain, kind string, ttl int, answers ...string) dns.Record {
+	record := dns.NewRecord(zone, domain, kind)
+	record.TTL = ttl
+	for _, a := range answers {
+		record.AddAnswer(dns.NewAnswer([]string{a}))
+	}
+	return *record
+}
+
+// checkHistory exercises RecordHistory on any Storage
+func checkHistory(t *testing.T, store Storage) {
+	t.Helper()
+
+	history, err := store.RecordHistory("example.com", "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("err from RecordHistory: %v", err)
+	}
+	if len(history) != 0 {
+		t.Fatalf("RecordHistory returned versions from empty storage: %v", history)
+	}
+
+	store.RecordRecord(answered("example.com", "www.example.com", "A", 300, "1.2.3.4"))
+	store.RecordRecord(answered("example.com", "www.example.com", "A", 0, "1.2.3.4"))
+	store.RecordRecord(answered("example.com", "www.example.com", "A", 300, "5.6.7.8"))
+	store.RecordRecord(answered("example.com", "www.example.com", "A", 60, "5.6.7.8"))
+	store.RecordRecord(answered("example.com", "mail.example.com", "A", 300, "9.9.9.9"))
+	store.DeleteRecord("example.com", "www.example.com", "A")
+
+	history, err = store.RecordHistory("example.com", "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("err from RecordHistory: %v", err)
+	}
+	expected := []struct {
+		ttl    int
+		answer string
+	}{{300, "1.2.3.4"}, {300, "5.6.7.8"}, {60, "5.6.7.8"}}
+	if len(history) != len(expected) {
+		t.Fatalf("Expected %d versions, got %d: %v", len(expected), len(history), history)
+	}
+	for i, e := range expected {
+		v := history[i]
+		if v.Version != i+1 {
+			t.Errorf("Version %d is numbered %d", i+1, v.Version)
+		}
+		if v.RecordedAt.IsZero() {
+			t.Errorf("Version %d has no timestamp", i+1)
+		}
+		if v.Record.TTL != e.ttl || v.Record.Answers[0].String() != e.answer {
+			t.Errorf("Version %d: expected %d %s, got %d %v", i+1, e.ttl, e.answer, v.Record.TTL, v.Record.Answers)
+		}
+	}
+}
+
+func TestRecordHistory(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+
+	checkHistory(t, store)
+}
+
+// checkHistoryCap checks that only the most recent versions are kept
+func checkHistoryCap(t *testing.T, store Storage) {
+	t.Helper()
+
+	for i := 0; i < maxVersions+10; i++ {
+		store.RecordRecord(answered("example.com", "www.example.com", "A", 300+i, "1.2.3.4"))
+	}
+	history, err := store.RecordHistory("example.com", "www.example.com", "A")
+	if err != nil {
+		t.Fatalf("err from RecordHistory: %v", err)
+	}
+	if len(history) != maxVersions {
+		t.Fatalf("Expected %d versions, got %d", maxVersions, len(history))
+	}
+	if first, last := history[0], history[len(history)-1]; first.Version != 11 || first.Record.TTL != 310 || last.Version != maxVersions+10 {
+		t.Errorf("Expected versions 11 to %d, got %d to %d", maxVersions+10, first.Version, last.Version)
+	}
+}
+
+func TestRecordHistoryCap(t *testing.T) {
+	store, cleanup := setup(t)
+	defer cleanup()
+
+	checkHistoryCap(t, store)
+}
@@ -7,5 +7,10 @@ package main
 import "golang.org/x/tools/godoc/vfs/mapfs"
 
 var Templates = mapfs.New(map[string]string{
-	`zone-add.tmpl`: "Zone {{.Zone}} created!\n\nTo publish your zone, you need to configure your registrar to use the following nameservers:\n{{ range .DNSServers -}}\n- {{.}}\n{{ end }}\n",
+	`audit.tmpl`:          "{{ range . -}}\n{{.Time.Format \"2006-01-02T15:04:05Z07:00\"}} {{ or .Principal \"anonymous\" }} {{.Verb}} {{.Target}} (request {{.RequestID}})\n{{ if .Was }}  - {{.Was}}\n{{ end }}{{ if .Now }}  + {{.Now}}\n{{ end }}{{ end -}}\n",
+	`record-history.tmpl`: "{{ range . -}}\n{{.Version}} {{.RecordedAt.Format \"2006-01-02T15:04:05Z07:00\"}} {{.Record.TTL}}{{ range .Record.Answers }} {{.}}{{ end }}\n{{ end -}}\n",
+	`record-list.tmpl`:    "{{ range . -}}\n{{.Domain}} {{.TTL}} {{.Type}}{{ range .Answers }} {{.}}{{ end }}\n{{ end -}}\n",
+	`zone-add.tmpl`:       "Zone {{.Zone}} created!\n\nTo publish your zone, you need to configure your registrar to use the following nameservers:\n{{ range .DNSServers -}}\n- {{.}}\n{{ end }}\n",
+	`zone-import.tmpl`:    "{{ range . -}}\n{{.Action}} {{.Domain}} {{.Type}}{{ if .Error }}: {{.Error}}{{ end }}\n{{ end -}}\n",
+	`zone-list.tmpl`:      "{{ range . -}}\n{{.Zone}}\n{{ end -}}\n",
 })
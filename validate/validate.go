@@ -0,0 +1,160 @@
+// Package validate checks record answers against the shape their record type
+// requires, so that malformed answers are caught before they reach NS1.
+package validate
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes a problem with one field of one answer
+type FieldError struct {
+	// Answer is the index of the answer at fault, or -1 for the record as a whole
+	Answer  int    `json:"answer"`
+	Field   string `json:"field"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	if e.Answer < 0 {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return fmt.Sprintf("answer %d, %s %q: %s", e.Answer+1, e.Field, e.Value, e.Message)
+}
+
+// Errors collects every FieldError found in a record's answers
+type Errors []FieldError
+
+func (es Errors) Error() string {
+	msgs := []string{}
+	for _, e := range es {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type checker func(string) string
+
+// shapes lists the fields of each record type's answers, in order
+var shapes = map[string][]struct {
+	name  string
+	check checker
+}{
+	"A":     {{"address", ipv4}},
+	"AAAA":  {{"address", ipv6}},
+	"CNAME": {{"host", hostname}},
+	"ALIAS": {{"host", hostname}},
+	"NS":    {{"host", hostname}},
+	"PTR":   {{"host", hostname}},
+	"MX":    {{"priority", uint16Field}, {"host", hostname}},
+	"TXT":   {{"text", text}},
+	"SRV":   {{"priority", uint16Field}, {"weight", uint16Field}, {"port", uint16Field}, {"target", hostname}},
+	"CAA":   {{"flag", uint8Field}, {"tag", caaTag}, {"value", text}},
+}
+
+// Answers checks each answer for a record of the given type. It returns nil,
+// or Errors listing every problem found. Types without a known shape are
+// only checked for having answers.
+func Answers(kind string, answers [][]string) error {
+	errs := Errors{}
+	if len(answers) == 0 {
+		errs = append(errs, FieldError{Answer: -1, Field: "answers", Message: "at least one answer is required"})
+	}
+
+	shape, known := shapes[strings.ToUpper(kind)]
+	if known {
+		for i, answer := range answers {
+			if len(answer) != len(shape) {
+				names := []string{}
+				for _, f := range shape {
+					names = append(names, f.name)
+				}
+				errs = append(errs, FieldError{
+					Answer:  i,
+					Field:   "answer",
+					Value:   strings.Join(answer, " "),
+					Message: fmt.Sprintf("%s answers need %d fields: %s", strings.ToUpper(kind), len(shape), strings.Join(names, ", ")),
+				})
+				continue
+			}
+			for j, f := range shape {
+				if msg := f.check(answer[j]); msg != "" {
+					errs = append(errs, FieldError{Answer: i, Field: f.name, Value: answer[j], Message: msg})
+				}
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func ipv4(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() == nil || strings.Contains(s, ":") {
+		return "not an IPv4 address"
+	}
+	return ""
+}
+
+func ipv6(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil || !strings.Contains(s, ":") {
+		return "not an IPv6 address"
+	}
+	return ""
+}
+
+var label = regexp.MustCompile(`^(\*|[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?)$`)
+
+func hostname(s string) string {
+	name := strings.TrimSuffix(s, ".")
+	if name == "" {
+		return "a host name is required"
+	}
+	if len(name) > 253 {
+		return "host names can be at most 253 characters"
+	}
+	for _, l := range strings.Split(name, ".") {
+		if !label.MatchString(l) {
+			return fmt.Sprintf("%q is not a valid label", l)
+		}
+	}
+	return ""
+}
+
+func uint16Field(s string) string {
+	if _, err := strconv.ParseUint(s, 10, 16); err != nil {
+		return "must be a number from 0 to 65535"
+	}
+	return ""
+}
+
+func uint8Field(s string) string {
+	if _, err := strconv.ParseUint(s, 10, 8); err != nil {
+		return "must be a number from 0 to 255"
+	}
+	return ""
+}
+
+func text(s string) string {
+	if s == "" {
+		return "must not be empty"
+	}
+	return ""
+}
+
+var caaTagPattern = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+func caaTag(s string) string {
+	if !caaTagPattern.MatchString(s) {
+		return "must be a tag such as issue, issuewild or iodef"
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package validate
+
+import (
+	"testing"
+)
+
+func TestValidAnswers(t *testing.T) {
+	for _, c := range []struct {
+		kind    string
+		answers [][]string
+	}{
+		{"A", [][]string{{"1.2.3.4"}, {"5.6.7.8"}}},
+		{"a", [][]string{{"1.2.3.4"}}},
+		{"AAAA", [][]string{{"2001:db8::1"}}},
+		{"CNAME", [][]string{{"www.example.com."}}},
+		{"ALIAS", [][]string{{"lb.example.net"}}},
+		{"NS", [][]string{{"ns1.example.com"}}},
+		{"PTR", [][]string{{"host.example.com"}}},
+		{"MX", [][]string{{"10", "mail.example.com"}}},
+		{"TXT", [][]string{{"v=spf1 include:_spf.example.com ~all"}}},
+		{"SRV", [][]string{{"10", "60", "5060", "sip.example.com"}}},
+		{"CAA", [][]string{{"0", "issue", "letsencrypt.org"}}},
+		{"CNAME", [][]string{{"*.example.com"}}},
+		{"SRV", [][]string{{"0", "0", "443", "_target._tcp.example.com"}}},
+		{"URLFWD", [][]string{{"/", "https://example.com", "301", "1", "0"}}},
+	} {
+		if err := Answers(c.kind, c.answers); err != nil {
+			t.Errorf("%s %v: unexpected error %v", c.kind, c.answers, err)
+		}
+	}
+}
+
+func TestInvalidAnswers(t *testing.T) {
+	for _, c := range []struct {
+		kind    string
+		answers [][]string
+		field   string
+	}{
+		{"A", [][]string{{"1.2.3"}}, "address"},
+		{"A", [][]string{{"2001:db8::1"}}, "address"},
+		{"AAAA", [][]string{{"1.2.3.4"}}, "address"},
+		{"CNAME", [][]string{{"bad name.example.com"}}, "host"},
+		{"MX", [][]string{{"mail.example.com"}}, "answer"},
+		{"MX", [][]string{{"high", "mail.example.com"}}, "priority"},
+		{"SRV", [][]string{{"10", "60", "sip.example.com"}}, "answer"},
+		{"SRV", [][]string{{"10", "60", "70000", "sip.example.com"}}, "port"},
+		{"CAA", [][]string{{"256", "issue", "letsencrypt.org"}}, "flag"},
+		{"TXT", [][]string{{""}}, "text"},
+		{"A", [][]string{}, "answers"},
+	} {
+		err := Answers(c.kind, c.answers)
+		if err == nil {
+			t.Errorf("%s %v: expected an error", c.kind, c.answers)
+			continue
+		}
+		errs := err.(Errors)
+		if len(errs) != 1 || errs[0].Field != c.field {
+			t.Errorf("%s %v: expected an error in %s, got %v", c.kind, c.answers, c.field, errs)
+		}
+	}
+}
+
+func TestErrorsIdentifyAnswers(t *testing.T) {
+	err := Answers("A", [][]string{{"1.2.3.4"}, {"nope"}, {"5.6.7.8"}, {"1.2.3.4.5"}})
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", err)
+	}
+	if errs[0].Answer != 1 || errs[1].Answer != 3 {
+		t.Errorf("Errors point at the wrong answers: %v", errs)
+	}
+}
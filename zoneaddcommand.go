@@ -1,7 +1,6 @@
 package main
 
 import (
-	"fmt"
 	"os"
 
 	"github.com/nyarly/inlinefiles/templatestore"
@@ -22,7 +21,7 @@ func zoneAddFn(cmd *cobra.Command, args []string) error {
 		panic(err)
 	}
 
-	addr, err := cmd.Flags().GetString("address")
+	client, err := newAPIClient(cmd)
 	if err != nil {
 		return err
 	}
@@ -32,9 +31,8 @@ func zoneAddFn(cmd *cobra.Command, args []string) error {
 		"name": args[0], // underflow should be guarded by Cobra
 	}
 
-	if err := doRequest("PUT", addr, "/zone", query, nil, zone); err != nil {
-		fmt.Println(err)
-		return nil
+	if err := client.doRequest("PUT", "/zone", query, nil, zone); err != nil {
+		return err
 	}
 
 	return tmpl.Execute(os.Stdout, zone)
@@ -14,7 +14,7 @@ var zoneDeleteCmd = &cobra.Command{
 }
 
 func zoneDeleteFn(cmd *cobra.Command, args []string) error {
-	addr, err := cmd.Flags().GetString("address")
+	client, err := newAPIClient(cmd)
 	if err != nil {
 		return err
 	}
@@ -23,9 +23,8 @@ func zoneDeleteFn(cmd *cobra.Command, args []string) error {
 		"name": args[0], // underflow should be guarded by Cobra
 	}
 
-	if err := doRequest("DELETE", addr, "/zone", query, nil, nil); err != nil {
-		fmt.Println(err)
-		return nil
+	if err := client.doRequest("DELETE", "/zone", query, nil, nil); err != nil {
+		return err
 	}
 
 	fmt.Println("Deleted.")
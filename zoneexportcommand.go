@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var zoneExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export a zone as a BIND master file",
+	RunE:  zoneExportFn,
+	Args:  cobra.ExactArgs(1),
+}
+
+func zoneExportFn(cmd *cobra.Command, args []string) error {
+	client, err := newAPIClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return err
+	}
+
+	query := map[string]string{
+		"name":   args[0], // underflow should be guarded by Cobra
+		"format": format,
+	}
+
+	if err := client.doRequest("GET", "/zone/export", query, nil, os.Stdout); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,296 @@
+// Package zonefile converts between NS1's representation of zones and
+// records and RFC 1035 master files, as used by BIND and most other DNS
+// software.
+package zonefile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+// Write renders a zone and its records as a master file.
+// Records that can't be represented (e.g. NS1's ALIAS) are written as comments.
+func Write(w io.Writer, zone *dns.Zone, records []*dns.Record) error {
+	origin := mdns.Fqdn(zone.Zone)
+
+	if _, err := fmt.Fprintf(w, "; %s exported by dns-manager\n$ORIGIN %s\n$TTL %d\n", zone.Zone, origin, zone.TTL); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintln(w, SOA(zone).String()); err != nil {
+		return err
+	}
+
+	records = sorted(records)
+	if !hasApexNS(zone, records) {
+		for _, ns := range zone.DNSServers {
+			rr := &mdns.NS{
+				Hdr: header(origin, mdns.TypeNS, zone.TTL),
+				Ns:  mdns.Fqdn(ns),
+			}
+			if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range records {
+		rrs, err := ToRRs(r)
+		if err != nil {
+			if _, err := fmt.Fprintf(w, "; %s %d %s %v: %v\n", r.Domain, r.TTL, r.Type, r.Answers, err); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, rr := range rrs {
+			if _, err := fmt.Fprintln(w, rr.String()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// SOA builds the start of authority record for an NS1 zone
+func SOA(zone *dns.Zone) *mdns.SOA {
+	primary := ""
+	if len(zone.DNSServers) > 0 {
+		primary = zone.DNSServers[0]
+	}
+
+	return &mdns.SOA{
+		Hdr:     header(mdns.Fqdn(zone.Zone), mdns.TypeSOA, zone.TTL),
+		Ns:      mdns.Fqdn(primary),
+		Mbox:    mdns.Fqdn(strings.Replace(zone.Hostmaster, "@", ".", 1)),
+		Serial:  uint32(zone.Serial),
+		Refresh: uint32(zone.Refresh),
+		Retry:   uint32(zone.Retry),
+		Expire:  uint32(zone.Expiry),
+		Minttl:  uint32(zone.NxTTL),
+	}
+}
+
+// ToRRs converts each answer of an NS1 record into a resource record
+func ToRRs(record *dns.Record) ([]mdns.RR, error) {
+	if record.Link != "" {
+		return nil, fmt.Errorf("linked to %s", record.Link)
+	}
+
+	kind, known := mdns.StringToType[strings.ToUpper(record.Type)]
+	if !known {
+		return nil, fmt.Errorf("%s records have no master file representation", record.Type)
+	}
+
+	name := mdns.Fqdn(record.Domain)
+	rrs := []mdns.RR{}
+	for _, a := range record.Answers {
+		rr, err := toRR(name, kind, record.TTL, a.Rdata)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+func toRR(name string, kind uint16, ttl int, rdata []string) (mdns.RR, error) {
+	switch kind {
+	case mdns.TypeTXT, mdns.TypeSPF:
+		return &mdns.TXT{
+			Hdr: header(name, kind, ttl),
+			Txt: splitTxt(strings.Join(rdata, "")),
+		}, nil
+	case mdns.TypeCAA:
+		if len(rdata) != 3 {
+			return nil, fmt.Errorf("CAA answers need flag, tag and value, got %v", rdata)
+		}
+		flag, err := strconv.ParseUint(rdata[0], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("CAA flag %q: %v", rdata[0], err)
+		}
+		return &mdns.CAA{
+			Hdr:   header(name, kind, ttl),
+			Flag:  uint8(flag),
+			Tag:   rdata[1],
+			Value: rdata[2],
+		}, nil
+	}
+
+	rr, err := mdns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, ttl, mdns.TypeToString[kind], strings.Join(rdata, " ")))
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("empty %s answer", mdns.TypeToString[kind])
+	}
+	return rr, nil
+}
+
+// splitTxt breaks a string into the 255 byte pieces a TXT record is made of
+func splitTxt(s string) []string {
+	parts := []string{}
+	for len(s) > 255 {
+		parts = append(parts, s[:255])
+		s = s[255:]
+	}
+	return append(parts, s)
+}
+
+func header(name string, kind uint16, ttl int) mdns.RR_Header {
+	return mdns.RR_Header{
+		Name:   name,
+		Rrtype: kind,
+		Class:  mdns.ClassINET,
+		Ttl:    uint32(ttl),
+	}
+}
+
+func hasApexNS(zone *dns.Zone, records []*dns.Record) bool {
+	for _, r := range records {
+		if r.Type == "NS" && mdns.Fqdn(r.Domain) == mdns.Fqdn(zone.Zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// sorted orders records with apex NS records first, then by name and type
+func sorted(records []*dns.Record) []*dns.Record {
+	out := append([]*dns.Record{}, records...)
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		aNS, bNS := a.Type == "NS" && a.Domain == a.Zone, b.Type == "NS" && b.Domain == b.Zone
+		if aNS != bNS {
+			return aNS
+		}
+		if a.Domain != b.Domain {
+			return a.Domain < b.Domain
+		}
+		return a.Type < b.Type
+	})
+	return out
+}
+
+// Read parses a master file into NS1 records, grouping resource records with
+// the same name and type into one record with several answers. origin is
+// used for relative names until the file sets its own $ORIGIN.
+//
+// The SOA and the zone's own NS records are skipped, since NS1 manages those.
+// Records named outside the zone, e.g. after an $ORIGIN for another zone, are
+// an error.
+func Read(r io.Reader, origin string) ([]*dns.Record, error) {
+	zone := strings.TrimSuffix(mdns.Fqdn(origin), ".")
+	apex := mdns.Fqdn(origin)
+
+	lines := &lineReader{r: bufio.NewReader(r), line: 1}
+	parser := mdns.NewZoneParser(lines, apex, "")
+	records := []*dns.Record{}
+	index := map[string]*dns.Record{}
+
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		hdr := rr.Header()
+		if !mdns.IsSubDomain(apex, hdr.Name) {
+			return nil, fmt.Errorf("line %d: %s is outside the zone %s", lines.line, hdr.Name, zone)
+		}
+		if hdr.Rrtype == mdns.TypeSOA {
+			continue
+		}
+		if hdr.Rrtype == mdns.TypeNS && strings.EqualFold(hdr.Name, apex) {
+			continue
+		}
+
+		domain := strings.TrimSuffix(hdr.Name, ".")
+		kind := mdns.TypeToString[hdr.Rrtype]
+		key := strings.ToLower(domain) + "/" + kind
+
+		record, has := index[key]
+		if !has {
+			record = dns.NewRecord(zone, domain, kind)
+			record.TTL = int(hdr.Ttl)
+			index[key] = record
+			records = append(records, record)
+		}
+		record.AddAnswer(dns.NewAnswer(FromRR(rr)))
+	}
+
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// lineReader counts the lines the parser has read, so that a record can be
+// reported by the line it ends on
+type lineReader struct {
+	r    *bufio.Reader
+	line int
+	eol  bool
+}
+
+// ReadByte is what the parser reads with, given an io.ByteReader
+func (l *lineReader) ReadByte() (byte, error) {
+	c, err := l.r.ReadByte()
+	if err != nil {
+		return c, err
+	}
+	// like the parser, count a newline as part of the line it ends
+	if l.eol {
+		l.line++
+	}
+	l.eol = c == '\n'
+	return c, nil
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c, err := l.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = c
+	return 1, nil
+}
+
+// FromRR converts a resource record's data into the form NS1 uses for answers
+func FromRR(rr mdns.RR) []string {
+	switch v := rr.(type) {
+	case *mdns.A:
+		return []string{v.A.String()}
+	case *mdns.AAAA:
+		return []string{v.AAAA.String()}
+	case *mdns.CNAME:
+		return []string{strings.TrimSuffix(v.Target, ".")}
+	case *mdns.NS:
+		return []string{strings.TrimSuffix(v.Ns, ".")}
+	case *mdns.PTR:
+		return []string{strings.TrimSuffix(v.Ptr, ".")}
+	case *mdns.MX:
+		return []string{strconv.Itoa(int(v.Preference)), strings.TrimSuffix(v.Mx, ".")}
+	case *mdns.TXT:
+		return []string{strings.Join(v.Txt, "")}
+	case *mdns.SPF:
+		return []string{strings.Join(v.Txt, "")}
+	case *mdns.SRV:
+		return []string{
+			strconv.Itoa(int(v.Priority)),
+			strconv.Itoa(int(v.Weight)),
+			strconv.Itoa(int(v.Port)),
+			strings.TrimSuffix(v.Target, "."),
+		}
+	case *mdns.CAA:
+		return []string{strconv.Itoa(int(v.Flag)), v.Tag, v.Value}
+	}
+
+	rdata := strings.TrimPrefix(rr.String(), rr.Header().String())
+	return strings.Fields(rdata)
+}
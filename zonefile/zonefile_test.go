@@ -0,0 +1,221 @@
+package zonefile
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+func testZone() *dns.Zone {
+	return &dns.Zone{
+		Zone:       "example.com",
+		TTL:        3600,
+		NxTTL:      300,
+		Retry:      7200,
+		Refresh:    43200,
+		Expiry:     1209600,
+		Serial:     1581544926,
+		Hostmaster: "hostmaster@nsone.net",
+		DNSServers: []string{"dns1.p01.nsone.net", "dns2.p01.nsone.net"},
+	}
+}
+
+func record(domain, kind string, ttl int, answers ...[]string) *dns.Record {
+	r := dns.NewRecord("example.com", domain, kind)
+	r.TTL = ttl
+	for _, a := range answers {
+		r.AddAnswer(dns.NewAnswer(a))
+	}
+	return r
+}
+
+func TestWrite(t *testing.T) {
+	records := []*dns.Record{
+		record("www.example.com", "A", 300, []string{"1.2.3.4"}, []string{"5.6.7.8"}),
+		record("example.com", "MX", 3600, []string{"10", "mail.example.com"}),
+		record("example.com", "TXT", 3600, []string{"v=spf1 include:_spf.example.com ~all"}),
+		record("example.com", "CAA", 3600, []string{"0", "issue", "letsencrypt.org"}),
+		record("_sip._tcp.example.com", "SRV", 3600, []string{"10", "60", "5060", "sip.example.com"}),
+		record("v6.example.com", "AAAA", 3600, []string{"2001:db8::1"}),
+		record("alias.example.com", "ALIAS", 3600, []string{"elsewhere.example.net"}),
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Write(buf, testZone(), records); err != nil {
+		t.Fatalf("err from Write: %v", err)
+	}
+	out := buf.String()
+
+	for _, expected := range []string{
+		"$ORIGIN example.com.\n",
+		"$TTL 3600\n",
+		"example.com.\t3600\tIN\tSOA\tdns1.p01.nsone.net. hostmaster.nsone.net. 1581544926 43200 7200 1209600 300\n",
+		"example.com.\t3600\tIN\tNS\tdns1.p01.nsone.net.\n",
+		"example.com.\t3600\tIN\tNS\tdns2.p01.nsone.net.\n",
+		"www.example.com.\t300\tIN\tA\t1.2.3.4\n",
+		"www.example.com.\t300\tIN\tA\t5.6.7.8\n",
+		"example.com.\t3600\tIN\tMX\t10 mail.example.com.\n",
+		"example.com.\t3600\tIN\tTXT\t\"v=spf1 include:_spf.example.com ~all\"\n",
+		"example.com.\t3600\tIN\tCAA\t0 issue \"letsencrypt.org\"\n",
+		"_sip._tcp.example.com.\t3600\tIN\tSRV\t10 60 5060 sip.example.com.\n",
+		"v6.example.com.\t3600\tIN\tAAAA\t2001:db8::1\n",
+		"; alias.example.com 3600 ALIAS",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Export doesn't include %q:\n%s", expected, out)
+		}
+	}
+
+	if strings.Index(out, "SOA") > strings.Index(out, "\tNS\t") {
+		t.Errorf("SOA should come before NS records:\n%s", out)
+	}
+}
+
+func TestWriteUsesApexNSRecords(t *testing.T) {
+	records := []*dns.Record{
+		record("example.com", "NS", 3600, []string{"ns1.example.net"}),
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Write(buf, testZone(), records); err != nil {
+		t.Fatalf("err from Write: %v", err)
+	}
+	out := buf.String()
+
+	if strings.Contains(out, "dns1.p01.nsone.net.\n") {
+		t.Errorf("Export shouldn't invent NS records when the zone has its own:\n%s", out)
+	}
+	if !strings.Contains(out, "\tNS\tns1.example.net.\n") {
+		t.Errorf("Export doesn't include zone NS record:\n%s", out)
+	}
+}
+
+func TestLongTXT(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	rrs, err := ToRRs(record("example.com", "TXT", 3600, []string{long}))
+	if err != nil {
+		t.Fatalf("err from ToRRs: %v", err)
+	}
+	if len(rrs) != 1 || !strings.Contains(rrs[0].String(), "\" \"") {
+		t.Errorf("Long TXT should be split into strings: %v", rrs)
+	}
+}
+
+const oldBind = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1.example.com. hostmaster.example.com. (
+		2020021801 ; serial
+		3h         ; refresh
+		1h         ; retry
+		1w         ; expire
+		1h )       ; minimum
+	IN	NS	ns1.example.com.
+	IN	MX	10 mail
+	IN	MX	20 mail.backup.example.net.
+	IN	TXT	( "v=spf1 "
+		  "mx ~all" )
+www	300	IN	A	1.2.3.4
+	300	IN	A	5.6.7.8
+mail	IN	A	1.2.3.5
+sub	IN	NS	ns.sub.example.com.
+$ORIGIN _tcp.example.com.
+_sip	IN	SRV	10 60 5060 sip.example.com.
+`
+
+func TestRead(t *testing.T) {
+	records, err := Read(strings.NewReader(oldBind), "example.com")
+	if err != nil {
+		t.Fatalf("err from Read: %v", err)
+	}
+
+	byKey := map[string]*dns.Record{}
+	for _, r := range records {
+		if r.Zone != "example.com" {
+			t.Errorf("Record in wrong zone: %v", r)
+		}
+		byKey[r.Domain+" "+r.Type] = r
+	}
+
+	if len(records) != 6 {
+		t.Errorf("Expected 6 records, got %d: %v", len(records), records)
+	}
+	if _, has := byKey["example.com SOA"]; has {
+		t.Errorf("SOA shouldn't be imported")
+	}
+	if _, has := byKey["example.com NS"]; has {
+		t.Errorf("Apex NS shouldn't be imported")
+	}
+
+	expect := func(key string, ttl int, answers ...string) {
+		t.Helper()
+		r, has := byKey[key]
+		if !has {
+			t.Errorf("Missing %s", key)
+			return
+		}
+		if r.TTL != ttl {
+			t.Errorf("%s: expected TTL %d, got %d", key, ttl, r.TTL)
+		}
+		got := []string{}
+		for _, a := range r.Answers {
+			got = append(got, strings.Join(a.Rdata, "|"))
+		}
+		if strings.Join(got, ",") != strings.Join(answers, ",") {
+			t.Errorf("%s: expected answers %v, got %v", key, answers, got)
+		}
+	}
+
+	expect("example.com MX", 3600, "10|mail.example.com", "20|mail.backup.example.net")
+	expect("example.com TXT", 3600, "v=spf1 mx ~all")
+	expect("www.example.com A", 300, "1.2.3.4", "5.6.7.8")
+	expect("mail.example.com A", 3600, "1.2.3.5")
+	expect("sub.example.com NS", 3600, "ns.sub.example.com")
+	expect("_sip._tcp.example.com SRV", 3600, "10|60|5060|sip.example.com")
+}
+
+func TestReadSyntaxError(t *testing.T) {
+	if _, err := Read(strings.NewReader("www IN A not-an-address\n"), "example.com"); err == nil {
+		t.Errorf("Expected an error for a malformed record")
+	}
+}
+
+func TestReadOutsideZone(t *testing.T) {
+	for text, line := range map[string]string{
+		"www IN A 1.2.3.4\nwww.example.org. IN A 1.2.3.4\n":            "line 2: www.example.org.",
+		"www IN A 1.2.3.4\n$ORIGIN example.org.\n\nwww IN A 1.2.3.4\n": "line 4: www.example.org.",
+		"txt IN TXT ( \"a\"\n \"b\" )\nnotexample.com. IN A 1.2.3.4\n": "line 3: notexample.com.",
+		"www IN A 1.2.3.4\nexample.com.example.org. IN A 1.2.3.4":      "line 2: example.com.example.org.",
+	} {
+		_, err := Read(strings.NewReader(text), "example.com")
+		if err == nil || !strings.Contains(err.Error(), line) {
+			t.Errorf("Expected an error naming %q for %q, got %v", line, text, err)
+		}
+	}
+
+	records, err := Read(strings.NewReader("$ORIGIN sub.example.com.\nwww IN A 1.2.3.4\n"), "example.com")
+	if err != nil || len(records) != 1 || records[0].Domain != "www.sub.example.com" {
+		t.Errorf("Expected a subdomain's record to be read, got %v, %v", records, err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	records, err := Read(strings.NewReader(oldBind), "example.com")
+	if err != nil {
+		t.Fatalf("err from Read: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Write(buf, testZone(), records); err != nil {
+		t.Fatalf("err from Write: %v", err)
+	}
+
+	again, err := Read(buf, "example.com")
+	if err != nil {
+		t.Fatalf("err from Read of exported zone: %v\n%s", err, buf.String())
+	}
+	if len(again) != len(records) {
+		t.Errorf("Expected %d records after round trip, got %d", len(records), len(again))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/nyarly/dns-manager/server"
+	"github.com/nyarly/inlinefiles/templatestore"
+	"github.com/spf13/cobra"
+)
+
+var zoneImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "create or update a zone's records from a BIND master file",
+	RunE:  zoneImportFn,
+	Args:  cobra.ExactArgs(2),
+}
+
+func zoneImportFn(cmd *cobra.Command, args []string) error {
+	tmpl, err := templatestore.LoadText(Templates, "zone-import", "zone-import.tmpl")
+	if err != nil {
+		panic(err)
+	}
+
+	client, err := newAPIClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(args[1]) // underflow should be guarded by Cobra
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	results := []server.ImportResult{}
+	query := map[string]string{
+		"name": args[0],
+	}
+
+	if err := client.doRequest("POST", "/zone/import", query, file, &results); err != nil {
+		return err
+	}
+
+	if err := tmpl.Execute(os.Stdout, results); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		if r.Action == "failed" {
+			return errors.New("some records could not be imported")
+		}
+	}
+	return nil
+}
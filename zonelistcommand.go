@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+
+	"github.com/nyarly/inlinefiles/templatestore"
+	"github.com/spf13/cobra"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+)
+
+var zoneListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list zones",
+	RunE:  zoneListFn,
+	Args:  cobra.NoArgs,
+}
+
+func zoneListFn(cmd *cobra.Command, args []string) error {
+	tmpl, err := templatestore.LoadText(Templates, "zone-list", "zone-list.tmpl")
+	if err != nil {
+		panic(err)
+	}
+
+	client, err := newAPIClient(cmd)
+	if err != nil {
+		return err
+	}
+
+	zones := []*dns.Zone{}
+	if err := client.doRequest("GET", "/zones", nil, nil, &zones); err != nil {
+		return err
+	}
+
+	return tmpl.Execute(os.Stdout, zones)
+}